@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Authentication methods, named as in pg_hba.conf.
+const (
+	authMethodTrust    = "trust"
+	authMethodPassword = "password"
+	authMethodMD5      = "md5"
+	authMethodSCRAM    = "scram-sha-256"
+)
+
+const (
+	scramMechanism  = "SCRAM-SHA-256"
+	scramIterations = 4096
+	scramSaltLen    = 16
+)
+
+// Authentication fails with errAuthFailed for bad credentials, errAuthProtocol for a
+// client that doesn't follow the exchange and errAuthConnection for one that has gone;
+// anything else is the server's own failure.
+var (
+	errAuthFailed     = errors.New("password authentication failed")
+	errAuthProtocol   = errors.New("invalid authentication exchange")
+	errAuthConnection = errors.New("connection lost during authentication")
+)
+
+// credentials are the stored secrets for a login. Like PostgreSQL, only derived
+// values are kept: a SCRAM verifier and the MD5 hash of password+username.
+type credentials struct {
+	playerID      int
+	scramVerifier string
+	md5Hash       string
+}
+
+// authenticate runs the authentication exchange for the connecting login, before
+// AuthenticationOk is sent. On failure the client has already been sent a FATAL
+// ErrorResponse and the connection should be closed.
+func (engine *Engine) authenticate(ctx context.Context) error {
+	if engine.trusted || engine.config.AuthMethod == authMethodTrust || (engine.config.AuthTrustLocal && isLoopback(engine.remoteAddr)) {
+		return nil
+	}
+
+	creds, err := engine.loadCredentials(ctx, engine.username)
+	if err != nil {
+		return engine.failAuth(err)
+	}
+
+	if creds == nil {
+		if !engine.config.AuthAutoRegister {
+			return engine.failAuth(fmt.Errorf("%w: no credentials for %q", errAuthFailed, engine.username))
+		}
+		// Only a new name may be claimed; a character without credentials isn't up for grabs
+		var exists bool
+		if err := engine.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM players WHERE username = $1)", engine.username).Scan(&exists); err != nil {
+			return engine.failAuth(fmt.Errorf("failed to look up player: %w", err))
+		}
+		if exists {
+			return engine.failAuth(fmt.Errorf("%w: player %q exists without credentials", errAuthFailed, engine.username))
+		}
+		// A new login chooses its password, which we need in the clear to derive the stored secrets.
+		password, err := engine.requestCleartextPassword()
+		if err != nil {
+			return engine.failAuth(err)
+		}
+		creds, err = engine.registerCredentials(ctx, engine.username, password)
+		if err != nil {
+			return engine.failAuth(err)
+		}
+		// If another connection registered this name first, its password wins.
+		if !verifyPasswordWithSCRAM(creds.scramVerifier, password) {
+			return engine.failAuth(errAuthFailed)
+		}
+		fmt.Printf("Registered credentials for player %q\n", engine.username)
+		return nil
+	}
+
+	switch engine.config.AuthMethod {
+	case authMethodSCRAM:
+		err = engine.authenticateSCRAM(creds)
+	case authMethodMD5:
+		err = engine.authenticateMD5(creds)
+	default:
+		var password string
+		password, err = engine.requestCleartextPassword()
+		if err == nil && !verifyPasswordWithSCRAM(creds.scramVerifier, password) {
+			err = errAuthFailed
+		}
+	}
+	if err != nil {
+		return engine.failAuth(err)
+	}
+	return nil
+}
+
+// failAuth reports a failed login the way PostgreSQL does: SQLSTATE 28P01 for bad
+// credentials, which doesn't say which part was wrong, 08P01 for a broken exchange, and
+// XX000 when the server couldn't check them.
+func (engine *Engine) failAuth(cause error) error {
+	fmt.Printf("Authentication failed for %q from %s: %v\n", engine.username, engine.remoteAddr, cause)
+	response := &pgproto3.ErrorResponse{Severity: "FATAL", SeverityUnlocalized: "FATAL"}
+	switch {
+	case errors.Is(cause, errAuthFailed):
+		response.Code = "28P01"
+		response.Message = fmt.Sprintf("password authentication failed for user %q", engine.username)
+	case errors.Is(cause, errAuthProtocol):
+		response.Code = sqlStateProtocolViolation
+		response.Message = cause.Error()
+	case errors.Is(cause, errAuthConnection):
+		response.Code = sqlStateConnectionFailure
+		response.Message = errAuthConnection.Error()
+	default:
+		response.Code = sqlStateInternalError
+		response.Message = fmt.Sprintf("could not authenticate user %q", engine.username)
+		response.Hint = "Please try again later."
+	}
+	engine.transport.Send(response)
+	if err := engine.transport.Flush(); err != nil {
+		fmt.Printf("Error flushing psql backend: %v\n", err)
+	}
+	return fmt.Errorf("authentication failed: %w", cause)
+}
+
+func (engine *Engine) loadCredentials(ctx context.Context, username string) (*credentials, error) {
+	creds := &credentials{}
+	err := engine.db.QueryRow(ctx, `
+		SELECT c.player_id, c.scram_verifier, c.md5_hash
+		FROM player_credentials c
+		INNER JOIN players p ON p.id = c.player_id
+		WHERE p.username = $1
+	`, username).Scan(&creds.playerID, &creds.scramVerifier, &creds.md5Hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// registerCredentials stores secrets derived from password for username, creating the
+// player if needed, and returns whatever credentials are stored afterwards.
+func (engine *Engine) registerCredentials(ctx context.Context, username, password string) (*credentials, error) {
+	playerID, err := engine.resolvePlayer(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := newSCRAMVerifier(password)
+	if err != nil {
+		return nil, err
+	}
+	_, err = engine.db.Exec(ctx,
+		"INSERT INTO player_credentials (player_id, scram_verifier, md5_hash) VALUES ($1, $2, $3) ON CONFLICT (player_id) DO NOTHING",
+		playerID, verifier, md5PasswordHash(username, password),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store credentials: %w", err)
+	}
+	creds, err := engine.loadCredentials(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		return nil, fmt.Errorf("credentials for %q vanished after registration", username)
+	}
+	return creds, nil
+}
+
+func (engine *Engine) requestCleartextPassword() (string, error) {
+	msg, err := engine.authRequest(&pgproto3.AuthenticationCleartextPassword{}, pgproto3.AuthTypeCleartextPassword)
+	if err != nil {
+		return "", err
+	}
+	passwordMsg, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return "", fmt.Errorf("%w: expected password message, got %T", errAuthProtocol, msg)
+	}
+	return passwordMsg.Password, nil
+}
+
+func (engine *Engine) authenticateMD5(creds *credentials) error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	msg, err := engine.authRequest(&pgproto3.AuthenticationMD5Password{Salt: salt}, pgproto3.AuthTypeMD5Password)
+	if err != nil {
+		return err
+	}
+	passwordMsg, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return fmt.Errorf("%w: expected password message, got %T", errAuthProtocol, msg)
+	}
+
+	// The client sends "md5" + md5(md5(password + username) + salt).
+	inner := strings.TrimPrefix(creds.md5Hash, "md5")
+	expected := "md5" + md5Hex(append([]byte(inner), salt[:]...))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(passwordMsg.Password)) != 1 {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// authenticateSCRAM runs the server side of SCRAM-SHA-256 (RFC 5802/7677) without channel binding.
+func (engine *Engine) authenticateSCRAM(creds *credentials) error {
+	iterations, salt, storedKey, serverKey, err := parseSCRAMVerifier(creds.scramVerifier)
+	if err != nil {
+		return err
+	}
+
+	msg, err := engine.authRequest(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{scramMechanism}}, pgproto3.AuthTypeSASL)
+	if err != nil {
+		return err
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return fmt.Errorf("%w: expected SASLInitialResponse, got %T", errAuthProtocol, msg)
+	}
+	if initial.AuthMechanism != scramMechanism {
+		return fmt.Errorf("%w: unsupported SASL mechanism %q", errAuthProtocol, initial.AuthMechanism)
+	}
+
+	// client-first-message: gs2-header "n,," (or "y,,") followed by "n=<user>,r=<client nonce>"
+	clientFirst := string(initial.Data)
+	var gs2Header string
+	switch {
+	case strings.HasPrefix(clientFirst, "n,,"), strings.HasPrefix(clientFirst, "y,,"):
+		gs2Header = clientFirst[:3]
+	default:
+		return fmt.Errorf("%w: unsupported SCRAM gs2 header in %q", errAuthProtocol, clientFirst)
+	}
+	clientFirstBare := clientFirst[len(gs2Header):]
+	clientNonce := scramAttribute(clientFirstBare, 'r')
+	if clientNonce == "" {
+		return fmt.Errorf("%w: missing client nonce", errAuthProtocol)
+	}
+
+	serverNonceBytes := make([]byte, 18)
+	if _, err := rand.Read(serverNonceBytes); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonceBytes)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), iterations)
+
+	msg, err = engine.authRequest(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)}, pgproto3.AuthTypeSASLContinue)
+	if err != nil {
+		return err
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return fmt.Errorf("%w: expected SASLResponse, got %T", errAuthProtocol, msg)
+	}
+
+	// client-final-message: "c=<b64 gs2 header>,r=<nonce>,p=<b64 proof>"
+	clientFinal := string(response.Data)
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return fmt.Errorf("%w: missing client proof", errAuthProtocol)
+	}
+	clientFinalWithoutProof := clientFinal[:proofIndex]
+	if scramAttribute(clientFinalWithoutProof, 'c') != base64.StdEncoding.EncodeToString([]byte(gs2Header)) {
+		return fmt.Errorf("%w: channel binding mismatch", errAuthProtocol)
+	}
+	if scramAttribute(clientFinalWithoutProof, 'r') != nonce {
+		return fmt.Errorf("%w: nonce mismatch", errAuthProtocol)
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return fmt.Errorf("%w: malformed client proof", errAuthProtocol)
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientSignature := hmacSHA256(storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	computedStoredKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(computedStoredKey[:], storedKey) != 1 {
+		return errAuthFailed
+	}
+
+	serverSignature := hmacSHA256(serverKey, authMessage)
+	engine.transport.Send(&pgproto3.AuthenticationSASLFinal{Data: []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature))})
+	return nil
+}
+
+// authRequest sends an authentication request and waits for the client's reply.
+func (engine *Engine) authRequest(request pgproto3.BackendMessage, authType uint32) (pgproto3.FrontendMessage, error) {
+	engine.transport.Send(request)
+	if err := engine.transport.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send authentication request: %w: %w", errAuthConnection, err)
+	}
+	if err := engine.transport.SetAuthType(authType); err != nil {
+		return nil, err
+	}
+	msg, err := engine.transport.Receive()
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive authentication response: %w: %w", errAuthConnection, err)
+	}
+	return msg, nil
+}
+
+// newSCRAMVerifier derives a verifier in PostgreSQL's pg_authid format:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func newSCRAMVerifier(password string) (string, error) {
+	salt := make([]byte, scramSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	storedKey, serverKey := scramKeys(password, salt, scramIterations)
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramMechanism, scramIterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey),
+		base64.StdEncoding.EncodeToString(serverKey),
+	), nil
+}
+
+func parseSCRAMVerifier(verifier string) (iterations int, salt, storedKey, serverKey []byte, err error) {
+	parts := strings.Split(verifier, "$")
+	if len(parts) != 3 || parts[0] != scramMechanism {
+		return 0, nil, nil, nil, errors.New("malformed SCRAM verifier")
+	}
+	iterAndSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterAndSalt) != 2 || len(keys) != 2 {
+		return 0, nil, nil, nil, errors.New("malformed SCRAM verifier")
+	}
+	if iterations, err = strconv.Atoi(iterAndSalt[0]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("malformed SCRAM iterations: %w", err)
+	}
+	if salt, err = base64.StdEncoding.DecodeString(iterAndSalt[1]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("malformed SCRAM salt: %w", err)
+	}
+	if storedKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("malformed SCRAM stored key: %w", err)
+	}
+	if serverKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("malformed SCRAM server key: %w", err)
+	}
+	return iterations, salt, storedKey, serverKey, nil
+}
+
+// verifyPasswordWithSCRAM checks a cleartext password against a stored SCRAM verifier.
+func verifyPasswordWithSCRAM(verifier, password string) bool {
+	iterations, salt, storedKey, _, err := parseSCRAMVerifier(verifier)
+	if err != nil {
+		return false
+	}
+	computedStoredKey, _ := scramKeys(password, salt, iterations)
+	return subtle.ConstantTimeCompare(computedStoredKey, storedKey) == 1
+}
+
+func scramKeys(password string, salt []byte, iterations int) (storedKey, serverKey []byte) {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	stored := sha256.Sum256(clientKey)
+	return stored[:], hmacSHA256(saltedPassword, "Server Key")
+}
+
+// scramAttribute returns the value of a single-letter attribute in a SCRAM message.
+func scramAttribute(message string, name byte) string {
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// md5PasswordHash is the value PostgreSQL stores for md5 auth: "md5" + md5(password + username).
+func md5PasswordHash(username, password string) string {
+	return "md5" + md5Hex([]byte(password+username))
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// authClient is the client side of an authentication exchange: it answers each request
+// the engine sends the way psql would, with a password and any tampering the test asks for.
+type authClient struct {
+	username string
+	password string
+	// tamper may change each message before it is sent.
+	tamper func(msg pgproto3.FrontendMessage)
+
+	sent     []pgproto3.BackendMessage
+	pending  []pgproto3.FrontendMessage
+	authType uint32
+
+	clientFirstBare string
+	saltedPassword  []byte
+	authMessage     string
+}
+
+func (client *authClient) Send(msg pgproto3.BackendMessage) {
+	client.sent = append(client.sent, msg)
+}
+
+func (client *authClient) SetAuthType(authType uint32) error {
+	client.authType = authType
+	return nil
+}
+
+// Flush answers the last request sent.
+func (client *authClient) Flush() error {
+	var reply pgproto3.FrontendMessage
+	switch request := client.sent[len(client.sent)-1].(type) {
+	case *pgproto3.AuthenticationCleartextPassword:
+		reply = &pgproto3.PasswordMessage{Password: client.password}
+	case *pgproto3.AuthenticationMD5Password:
+		inner := md5PasswordHash(client.username, client.password)[len("md5"):]
+		reply = &pgproto3.PasswordMessage{Password: "md5" + md5Hex(append([]byte(inner), request.Salt[:]...))}
+	case *pgproto3.AuthenticationSASL:
+		client.clientFirstBare = "n=,r=clientnonce"
+		reply = &pgproto3.SASLInitialResponse{AuthMechanism: scramMechanism, Data: []byte("n,," + client.clientFirstBare)}
+	case *pgproto3.AuthenticationSASLContinue:
+		serverFirst := string(request.Data)
+		salt, _ := base64.StdEncoding.DecodeString(scramAttribute(serverFirst, 's'))
+		var iterations int
+		fmt.Sscan(scramAttribute(serverFirst, 'i'), &iterations)
+		client.saltedPassword = pbkdf2.Key([]byte(client.password), salt, iterations, sha256.Size, sha256.New)
+		clientKey := hmacSHA256(client.saltedPassword, "Client Key")
+		storedKey := sha256.Sum256(clientKey)
+		withoutProof := "c=biws,r=" + scramAttribute(serverFirst, 'r')
+		client.authMessage = client.clientFirstBare + "," + serverFirst + "," + withoutProof
+		signature := hmacSHA256(storedKey[:], client.authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range clientKey {
+			proof[i] = clientKey[i] ^ signature[i]
+		}
+		reply = &pgproto3.SASLResponse{Data: []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))}
+	default:
+		return fmt.Errorf("unexpected request %T", request)
+	}
+	if client.tamper != nil {
+		client.tamper(reply)
+	}
+	client.pending = append(client.pending, reply)
+	return nil
+}
+
+func (client *authClient) Receive() (pgproto3.FrontendMessage, error) {
+	if len(client.pending) == 0 {
+		return nil, io.EOF
+	}
+	msg := client.pending[0]
+	client.pending = client.pending[1:]
+	return msg, nil
+}
+
+// serverVerified reports whether the engine's SASLFinal proves it knows the password.
+func (client *authClient) serverVerified() bool {
+	final, ok := client.sent[len(client.sent)-1].(*pgproto3.AuthenticationSASLFinal)
+	if !ok {
+		return false
+	}
+	want := hmacSHA256(hmacSHA256(client.saltedPassword, "Server Key"), client.authMessage)
+	return string(final.Data) == "v="+base64.StdEncoding.EncodeToString(want)
+}
+
+func testCredentials(t *testing.T, username, password string) *credentials {
+	t.Helper()
+	verifier, err := newSCRAMVerifier(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &credentials{playerID: 1, scramVerifier: verifier, md5Hash: md5PasswordHash(username, password)}
+}
+
+func TestAuthenticateSCRAM(t *testing.T) {
+	creds := testCredentials(t, "wanderer", "correct horse")
+	tests := []struct {
+		name     string
+		password string
+		tamper   func(pgproto3.FrontendMessage)
+		err      error
+	}{
+		{"right password", "correct horse", nil, nil},
+		{"wrong password", "battery staple", nil, errAuthFailed},
+		{"other mechanism", "correct horse", func(msg pgproto3.FrontendMessage) {
+			if initial, ok := msg.(*pgproto3.SASLInitialResponse); ok {
+				initial.AuthMechanism = "SCRAM-SHA-256-PLUS"
+			}
+		}, errAuthProtocol},
+		{"channel binding asked for", "correct horse", func(msg pgproto3.FrontendMessage) {
+			if initial, ok := msg.(*pgproto3.SASLInitialResponse); ok {
+				initial.Data = []byte("p=tls-server-end-point,,n=,r=clientnonce")
+			}
+		}, errAuthProtocol},
+		{"nonce changed", "correct horse", func(msg pgproto3.FrontendMessage) {
+			if response, ok := msg.(*pgproto3.SASLResponse); ok {
+				response.Data = []byte(strings.Replace(string(response.Data), "r=clientnonce", "r=othernonce", 1))
+			}
+		}, errAuthProtocol},
+		{"proof missing", "correct horse", func(msg pgproto3.FrontendMessage) {
+			if response, ok := msg.(*pgproto3.SASLResponse); ok {
+				response.Data = []byte(string(response.Data)[:strings.LastIndex(string(response.Data), ",p=")])
+			}
+		}, errAuthProtocol},
+		{"proof malformed", "correct horse", func(msg pgproto3.FrontendMessage) {
+			if response, ok := msg.(*pgproto3.SASLResponse); ok {
+				response.Data = append(response.Data, "=="...)
+			}
+		}, errAuthProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &authClient{username: "wanderer", password: tt.password, tamper: tt.tamper}
+			engine := &Engine{transport: client}
+			err := engine.authenticateSCRAM(creds)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("authenticateSCRAM error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !client.serverVerified() {
+				t.Error("the server's signature doesn't prove it knows the password")
+			}
+		})
+	}
+}
+
+func TestAuthenticateMD5(t *testing.T) {
+	creds := testCredentials(t, "wanderer", "correct horse")
+	tests := []struct {
+		name               string
+		username, password string
+		err                error
+	}{
+		{"right password", "wanderer", "correct horse", nil},
+		{"wrong password", "wanderer", "battery staple", errAuthFailed},
+		// The hash is salted with the username, so another login's password doesn't fit
+		{"other username", "innkeeper", "correct horse", errAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &Engine{transport: &authClient{username: tt.username, password: tt.password}}
+			if err := engine.authenticateMD5(creds); !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Errorf("authenticateMD5 error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMD5PasswordHash(t *testing.T) {
+	// As PostgreSQL stores it for CREATE ROLE postgres PASSWORD 'postgres'
+	if got, want := md5PasswordHash("postgres", "postgres"), "md53175bce1d3201d16594cebf9d7eb3f9d"; got != want {
+		t.Errorf("md5PasswordHash = %q, want %q", got, want)
+	}
+}
+
+func TestSCRAMKeys(t *testing.T) {
+	// The example exchange of RFC 7677
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	storedKey, serverKey := scramKeys("pencil", salt, 4096)
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	if got, want := base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, authMessage)), "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="; got != want {
+		t.Errorf("server signature = %s, want %s", got, want)
+	}
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	signature := hmac.New(sha256.New, storedKey)
+	signature.Write([]byte(authMessage))
+	clientKey := make([]byte, len(proof))
+	for i, b := range signature.Sum(nil) {
+		clientKey[i] = proof[i] ^ b
+	}
+	if computed := sha256.Sum256(clientKey); !hmac.Equal(computed[:], storedKey) {
+		t.Error("the RFC's client proof doesn't match the stored key")
+	}
+}
+
+func TestVerifyPasswordWithSCRAM(t *testing.T) {
+	verifier, err := newSCRAMVerifier("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, verifier, password string
+		want                     bool
+	}{
+		{"right password", verifier, "correct horse", true},
+		{"wrong password", verifier, "correct horse ", false},
+		{"empty password", verifier, "", false},
+		{"other mechanism", strings.Replace(verifier, scramMechanism, "SCRAM-SHA-1", 1), "correct horse", false},
+		{"malformed", "SCRAM-SHA-256$4096", "correct horse", false},
+		{"bad iterations", strings.Replace(verifier, "$4096:", "$many:", 1), "correct horse", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyPasswordWithSCRAM(tt.verifier, tt.password); got != tt.want {
+				t.Errorf("verifyPasswordWithSCRAM = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingTransport keeps what the engine sends.
+type recordingTransport struct {
+	sent []pgproto3.BackendMessage
+}
+
+func (transport *recordingTransport) Receive() (pgproto3.FrontendMessage, error) { return nil, io.EOF }
+func (transport *recordingTransport) Send(msg pgproto3.BackendMessage) {
+	transport.sent = append(transport.sent, msg)
+}
+func (transport *recordingTransport) Flush() error             { return nil }
+func (transport *recordingTransport) SetAuthType(uint32) error { return nil }
+
+func TestFailAuth(t *testing.T) {
+	tests := []struct {
+		name  string
+		cause error
+		code  string
+	}{
+		{"bad password", errAuthFailed, "28P01"},
+		{"unknown login", fmt.Errorf("%w: no credentials for %q", errAuthFailed, "wanderer"), "28P01"},
+		{"broken exchange", fmt.Errorf("%w: nonce mismatch", errAuthProtocol), sqlStateProtocolViolation},
+		{"client gone", fmt.Errorf("failed to receive authentication response: %w: %w", errAuthConnection, io.EOF), sqlStateConnectionFailure},
+		{"database down", errors.New("failed to load credentials: connection refused"), sqlStateInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &recordingTransport{}
+			engine := &Engine{transport: transport, username: "wanderer"}
+			if err := engine.failAuth(tt.cause); !errors.Is(err, tt.cause) {
+				t.Errorf("failAuth returned %v, which doesn't wrap %v", err, tt.cause)
+			}
+			if len(transport.sent) != 1 {
+				t.Fatalf("sent %d messages, want one ErrorResponse", len(transport.sent))
+			}
+			response, ok := transport.sent[0].(*pgproto3.ErrorResponse)
+			if !ok || response.Severity != "FATAL" || response.Code != tt.code {
+				t.Fatalf("sent %+v, want FATAL %s", transport.sent[0], tt.code)
+			}
+			if tt.code != "28P01" && strings.Contains(response.Message, "password") {
+				t.Errorf("message %q blames the password", response.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The emulated system catalogs describe the game schema to psql's \d commands and to
+// GUI tools, so the game's tables can be browsed like any database's. Simple queries
+// against them go through the SQL evaluator; the joins psql and GUI tools send are
+// answered by answerCatalogQuery.
+
+// OIDs of the catalog objects. Game tables are numbered from firstTableOID, in
+// virtualTables order.
+const (
+	pgCatalogOID         = 11
+	gameSchemaOID        = 2200
+	informationSchemaOID = 13000
+	databaseOID          = 16383
+	firstTableOID        = 16384
+	gameOwnerOID         = 10
+	heapAccessMethodOID  = 2
+)
+
+// gameOwner owns every game table and schema.
+const gameOwner = "dungeon_master"
+
+// catalogRow is one row of an emulated catalog, keyed by column name. Rows may carry
+// extra keys named after the column aliases psql gives derived values (e.g. "type"
+// for the CASE over relkind in \dt), which answerCatalogQuery falls back to.
+type catalogRow map[string]any
+
+func tableOID(table *virtualTable) int64 {
+	return int64(firstTableOID + slices.Index(virtualTables, table))
+}
+
+var catalogTables = []*virtualTable{
+	{
+		Schema: "pg_catalog", Name: "pg_namespace",
+		Columns: []sqlColumn{{"oid", oidInt4}, {"nspname", oidText}, {"nspowner", oidInt4}, {"nspacl", oidText}},
+		catalogRows: func(*sqlSession) []catalogRow {
+			return []catalogRow{
+				{"oid": int64(gameSchemaOID), "nspname": "public", "nspowner": int64(gameOwnerOID), "nspacl": nil,
+					"description": "The world, as your character sees it"},
+				{"oid": int64(pgCatalogOID), "nspname": "pg_catalog", "nspowner": int64(gameOwnerOID), "nspacl": nil,
+					"description": "system catalog schema"},
+				{"oid": int64(informationSchemaOID), "nspname": "information_schema", "nspowner": int64(gameOwnerOID), "nspacl": nil},
+			}
+		},
+	},
+	{
+		Schema: "pg_catalog", Name: "pg_class",
+		Columns: []sqlColumn{
+			{"oid", oidInt4}, {"relname", oidText}, {"relnamespace", oidInt4}, {"reltype", oidInt4},
+			{"relowner", oidInt4}, {"relam", oidInt4}, {"reltablespace", oidInt4}, {"reltuples", oidNumeric},
+			{"relhasindex", oidBool}, {"relpersistence", oidText}, {"relkind", oidText}, {"relnatts", oidInt4},
+			{"relchecks", oidInt4}, {"relhasrules", oidBool}, {"relhastriggers", oidBool},
+			{"relrowsecurity", oidBool}, {"relforcerowsecurity", oidBool}, {"relispartition", oidBool},
+			{"reloftype", oidInt4}, {"relreplident", oidText},
+		},
+		catalogRows: func(*sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, table := range virtualTables {
+				rows = append(rows, catalogRow{
+					"oid": tableOID(table), "relname": table.Name, "relnamespace": int64(gameSchemaOID),
+					"reltype": int64(0), "relowner": int64(gameOwnerOID), "relam": int64(heapAccessMethodOID),
+					"reltablespace": int64(0), "reltuples": float64(-1), "relhasindex": false,
+					"relpersistence": "p", "relkind": "r", "relnatts": int64(len(table.Columns)),
+					"relchecks": int64(0), "relhasrules": false, "relhastriggers": false,
+					"relrowsecurity": false, "relforcerowsecurity": false, "relispartition": false,
+					"relhasoids": false, "reloftype": int64(0), "relreplident": "d",
+					// Joined in, or derived, by psql's queries
+					"nspname": "public", "amname": "heap", "type": "table", "persistence": "permanent",
+					"access method": "heap", "description": table.Description,
+				})
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "pg_catalog", Name: "pg_attribute",
+		Columns: []sqlColumn{
+			{"attrelid", oidInt4}, {"attname", oidText}, {"atttypid", oidInt4}, {"attlen", oidInt4},
+			{"attnum", oidInt4}, {"atttypmod", oidInt4}, {"attnotnull", oidBool}, {"atthasdef", oidBool},
+			{"attidentity", oidText}, {"attgenerated", oidText}, {"attisdropped", oidBool}, {"attstorage", oidText},
+		},
+		catalogRows: func(*sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, table := range virtualTables {
+				for i, column := range table.Columns {
+					storage := "p"
+					if typeSize(column.Type) < 0 {
+						storage = "x"
+					}
+					rows = append(rows, catalogRow{
+						"attrelid": tableOID(table), "attname": column.Name, "atttypid": int64(column.Type),
+						"attlen": int64(typeSize(column.Type)), "attnum": int64(i + 1), "atttypmod": int64(-1),
+						"attnotnull": false, "atthasdef": false, "attidentity": "", "attgenerated": "",
+						"attisdropped": false, "attstorage": storage, "attcollation": nil,
+						"relname": table.Name, "nspname": "public", "format_type": typeNames[column.Type],
+					})
+				}
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "pg_catalog", Name: "pg_type",
+		Columns: []sqlColumn{
+			{"oid", oidInt4}, {"typname", oidText}, {"typnamespace", oidInt4}, {"typowner", oidInt4},
+			{"typlen", oidInt4}, {"typtype", oidText}, {"typcategory", oidText}, {"typrelid", oidInt4},
+			{"typelem", oidInt4}, {"typbasetype", oidInt4},
+		},
+		catalogRows: func(*sqlSession) []catalogRow {
+			categories := map[string]string{"numeric": "N", "text": "S", "bool": "B", "timestamp": "D"}
+			var rows []catalogRow
+			for _, oid := range []uint32{oidBool, oidInt8, oidInt4, oidText, oidUnknown, oidTimestamptz, oidNumeric} {
+				rows = append(rows, catalogRow{
+					"oid": int64(oid), "typname": shortTypeNames[oid], "typnamespace": int64(pgCatalogOID),
+					"typowner": int64(gameOwnerOID), "typlen": int64(typeSize(oid)), "typtype": "b",
+					"typcategory": categories[typeCategory(oid)], "typrelid": int64(0), "typelem": int64(0),
+					"typbasetype": int64(0), "nspname": "pg_catalog", "format_type": typeNames[oid],
+				})
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "pg_catalog", Name: "pg_database",
+		Columns: []sqlColumn{
+			{"oid", oidInt4}, {"datname", oidText}, {"datdba", oidInt4}, {"encoding", oidInt4},
+			{"datlocprovider", oidText}, {"datistemplate", oidBool}, {"datallowconn", oidBool},
+			{"datcollate", oidText}, {"datctype", oidText}, {"daticulocale", oidText}, {"datacl", oidText},
+		},
+		catalogRows: func(session *sqlSession) []catalogRow {
+			return []catalogRow{{
+				"oid": int64(databaseOID), "datname": session.Database, "datdba": int64(gameOwnerOID),
+				"encoding": int64(6), "datlocprovider": "c", "datistemplate": false, "datallowconn": true,
+				"datcollate": "C.UTF-8", "datctype": "C.UTF-8", "daticulocale": nil, "daticurules": nil,
+				"datacl": nil, "locale provider": "libc", "description": "A text adventure",
+			}}
+		},
+	},
+	{
+		Schema: "pg_catalog", Name: "pg_tables",
+		Columns: []sqlColumn{
+			{"schemaname", oidText}, {"tablename", oidText}, {"tableowner", oidText}, {"tablespace", oidText},
+			{"hasindexes", oidBool}, {"hasrules", oidBool}, {"hastriggers", oidBool}, {"rowsecurity", oidBool},
+		},
+		catalogRows: func(*sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, table := range virtualTables {
+				rows = append(rows, catalogRow{
+					"schemaname": "public", "tablename": table.Name, "tableowner": gameOwner, "tablespace": nil,
+					"hasindexes": false, "hasrules": false, "hastriggers": false, "rowsecurity": false,
+				})
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "pg_catalog", Name: "pg_settings",
+		Columns: []sqlColumn{{"name", oidText}, {"setting", oidText}, {"unit", oidText}, {"short_desc", oidText}, {"context", oidText}, {"vartype", oidText}},
+		catalogRows: func(session *sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, setting := range serverSettings {
+				rows = append(rows, catalogRow{
+					"name": setting.Name, "setting": session.setting(setting.Name), "unit": nil,
+					"short_desc": setting.Description, "context": "user", "vartype": "string",
+				})
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "information_schema", Name: "schemata",
+		Columns: []sqlColumn{{"catalog_name", oidText}, {"schema_name", oidText}, {"schema_owner", oidText}},
+		catalogRows: func(session *sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, schema := range []string{"information_schema", "pg_catalog", "public"} {
+				rows = append(rows, catalogRow{"catalog_name": session.Database, "schema_name": schema, "schema_owner": gameOwner})
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "information_schema", Name: "tables",
+		Columns: []sqlColumn{
+			{"table_catalog", oidText}, {"table_schema", oidText}, {"table_name", oidText},
+			{"table_type", oidText}, {"is_insertable_into", oidText},
+		},
+		catalogRows: func(session *sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, table := range virtualTables {
+				rows = append(rows, catalogRow{
+					"table_catalog": session.Database, "table_schema": "public", "table_name": table.Name,
+					"table_type": "BASE TABLE", "is_insertable_into": "NO",
+				})
+			}
+			return rows
+		},
+	},
+	{
+		Schema: "information_schema", Name: "columns",
+		Columns: []sqlColumn{
+			{"table_catalog", oidText}, {"table_schema", oidText}, {"table_name", oidText},
+			{"column_name", oidText}, {"ordinal_position", oidInt4}, {"column_default", oidText},
+			{"is_nullable", oidText}, {"data_type", oidText}, {"udt_name", oidText},
+		},
+		catalogRows: func(session *sqlSession) []catalogRow {
+			var rows []catalogRow
+			for _, table := range virtualTables {
+				for i, column := range table.Columns {
+					rows = append(rows, catalogRow{
+						"table_catalog": session.Database, "table_schema": "public", "table_name": table.Name,
+						"column_name": column.Name, "ordinal_position": int64(i + 1), "column_default": nil,
+						"is_nullable": "YES", "data_type": typeNames[column.Type], "udt_name": shortTypeNames[column.Type],
+					})
+				}
+			}
+			return rows
+		},
+	},
+}
+
+// catalogTableRows lays out a catalog's rows in its Columns order, for the evaluator.
+func catalogTableRows(table *virtualTable, session *sqlSession) [][]any {
+	var rows [][]any
+	for _, row := range table.catalogRows(session) {
+		values := make([]any, len(table.Columns))
+		for i, column := range table.Columns {
+			values[i] = row[column.Name]
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+// serverSetting is a run-time parameter clients can SHOW. Reported settings are also
+// sent as ParameterStatus when a session starts, like PostgreSQL's GUC_REPORT ones.
+type serverSetting struct {
+	Name        string
+	Value       string // empty for the per-session settings worked out by sqlSession.setting
+	Description string
+	Reported    bool
+}
+
+var serverSettings = []serverSetting{
+	{"application_name", "", "Sets the application name to be reported in statistics and logs.", true},
+	{"client_encoding", "UTF8", "Sets the client's character set encoding.", true},
+	{"DateStyle", "ISO, MDY", "Sets the display format for date and time values.", true},
+	{"default_transaction_read_only", "on", "Sets the default read-only status of new transactions.", true},
+	{"in_hot_standby", "off", "Shows whether hot standby is currently active.", true},
+	{"integer_datetimes", "on", "Shows whether datetimes are integer based.", true},
+	{"IntervalStyle", "postgres", "Sets the display format for interval values.", true},
+	{"is_superuser", "off", "Shows whether the current user is a superuser.", true},
+	{"max_identifier_length", "63", "Shows the maximum identifier length.", false},
+	{"search_path", `"$user", public`, "Sets the schema search order for names that are not schema-qualified.", false},
+	{"server_encoding", "UTF8", "Shows the server (database) character set encoding.", true},
+	{"server_version", "16.8", "Shows the server version.", true},
+	{"server_version_num", "160008", "Shows the server version as an integer.", false},
+	{"session_authorization", "", "Sets the session user name.", true},
+	{"standard_conforming_strings", "on", "Causes '...' strings to treat backslashes literally.", true},
+	{"TimeZone", "UTC", "Sets the time zone for displaying and interpreting time stamps.", true},
+	{"transaction_isolation", "read committed", "Sets the current transaction's isolation level.", false},
+}
+
+// findSetting looks a setting up by name, which is case-insensitive.
+func findSetting(name string) (serverSetting, bool) {
+	for _, setting := range serverSettings {
+		if strings.EqualFold(setting.Name, name) {
+			return setting, true
+		}
+	}
+	return serverSetting{}, false
+}
+
+// setting returns a setting's value for this session.
+func (session *sqlSession) setting(name string) string {
+	switch strings.ToLower(name) {
+	case "application_name":
+		return session.ApplicationName
+	case "session_authorization":
+		return session.User
+	}
+	setting, _ := findSetting(name)
+	return setting.Value
+}
+
+// showQuery matches SHOW with a single parameter name. Anything else starting with
+// "show" ("show me the map") is a player action.
+var showQuery = regexp.MustCompile(`(?is)^\s*show\s+("?[a-z_][a-z0-9_.]*"?)\s*;?\s*$`)
+
+func isShowQuery(query string) bool {
+	match := showQuery.FindStringSubmatch(query)
+	if match == nil {
+		return false
+	}
+	name := strings.Trim(match[1], `"`)
+	_, known := findSetting(name)
+	return known || strings.EqualFold(name, "all")
+}
+
+// runShow answers SHOW name and SHOW ALL.
+func runShow(query string, session *sqlSession) *resultSet {
+	name := strings.Trim(showQuery.FindStringSubmatch(query)[1], `"`)
+	if strings.EqualFold(name, "all") {
+		result := &resultSet{Columns: []sqlColumn{{"name", oidText}, {"setting", oidText}, {"description", oidText}}}
+		for _, setting := range serverSettings {
+			result.Rows = append(result.Rows, []any{setting.Name, session.setting(setting.Name), setting.Description})
+		}
+		return result
+	}
+	setting, _ := findSetting(name)
+	return &resultSet{
+		Columns: []sqlColumn{{strings.ToLower(setting.Name), oidText}},
+		Rows:    [][]any{{session.setting(setting.Name)}},
+	}
+}
+
+// catalogQuery matches queries that read the system catalogs.
+var catalogQuery = regexp.MustCompile(`(?i)\b(pg_catalog|information_schema)\s*\.|\bpg_[a-z_]+\b`)
+
+func isCatalogQuery(query string) bool {
+	return catalogQuery.MatchString(query)
+}
+
+// catalogFunctions compute the catalog functions psql and GUI tools call, from the row
+// they are called on.
+var catalogFunctions = map[string]func(row catalogRow) any{
+	"pg_get_userbyid":        func(catalogRow) any { return gameOwner },
+	"format_type":            func(row catalogRow) any { return row["format_type"] },
+	"obj_description":        func(row catalogRow) any { return row["description"] },
+	"shobj_description":      func(row catalogRow) any { return row["description"] },
+	"col_description":        func(catalogRow) any { return nil },
+	"pg_encoding_to_char":    func(catalogRow) any { return "UTF8" },
+	"pg_size_pretty":         func(catalogRow) any { return "0 bytes" },
+	"pg_table_size":          func(catalogRow) any { return int64(0) },
+	"pg_relation_size":       func(catalogRow) any { return int64(0) },
+	"pg_total_relation_size": func(catalogRow) any { return int64(0) },
+	"pg_database_size":       func(catalogRow) any { return int64(0) },
+	"pg_table_is_visible":    func(catalogRow) any { return true },
+	"has_table_privilege":    func(catalogRow) any { return true },
+	"has_schema_privilege":   func(catalogRow) any { return true },
+}
+
+// answerCatalogQuery answers a catalog query the evaluator can't, such as the joins
+// behind psql's \d commands. Rather than evaluating it, the query is read for the
+// catalog it is mainly about (its first FROM table) and the simple conditions on it;
+// each selected column is then filled from the matching rows by name. Catalogs the
+// game doesn't emulate (policies, triggers, inheritance...) have no rows.
+func answerCatalogQuery(query string, session *sqlSession) *resultSet {
+	clauses := splitClauses(query)
+	var table *virtualTable
+	if match := fromTable.FindStringSubmatch(clauses["from"]); match != nil {
+		for _, candidate := range catalogTables {
+			if candidate.Name == strings.ToLower(match[2]) && (match[1] == "" || strings.EqualFold(match[1], candidate.Schema)) {
+				table = candidate
+			}
+		}
+	}
+
+	var all, rows []catalogRow
+	if table != nil {
+		all = table.catalogRows(session)
+		for _, row := range all {
+			if matchesConditions(row, clauses["where"]) {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	result := &resultSet{}
+	var entries []string
+	for _, entry := range splitTopLevel(clauses["select"], ',') {
+		entry = strings.TrimSpace(entry)
+		// x.* expands to the catalog's columns
+		if starEntry.MatchString(entry) && table != nil {
+			for _, column := range table.Columns {
+				entries = append(entries, column.Name)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	for _, entry := range entries {
+		expr, name := splitAlias(entry)
+		result.Columns = append(result.Columns, sqlColumn{Name: name, Type: oidText})
+		for i, row := range rows {
+			if len(result.Rows) <= i {
+				result.Rows = append(result.Rows, nil)
+			}
+			result.Rows[i] = append(result.Rows[i], catalogValue(expr, name, row))
+		}
+	}
+
+	// Type each column by its values in the catalog's first row, filtered or not, so a
+	// prepared query's columns have the same types however it is run
+	if len(all) > 0 {
+		for i, entry := range entries {
+			expr, name := splitAlias(entry)
+			if v := catalogValue(expr, name, all[0]); v != nil {
+				result.Columns[i].Type = valueType(v)
+			}
+		}
+	}
+	return result
+}
+
+var (
+	fromTable    = regexp.MustCompile(`^\s*(?:"?(\w+)"?\s*\.\s*)?"?(\w+)"?`)
+	starEntry    = regexp.MustCompile(`^(\w+\.)?\*$`)
+	plainColumn  = regexp.MustCompile(`^(?:"?\w+"?\.)?"?(\w+)"?$`)
+	functionCall = regexp.MustCompile(`(?i)^(?:pg_catalog\.)?(\w+)\s*\(`)
+	aliasSuffix  = regexp.MustCompile(`(?is)^(.*)\s+as\s+("(?:[^"]|"")*"|\w+)$`)
+)
+
+// splitAlias separates a select list entry into its expression and the column name
+// the result gets.
+func splitAlias(entry string) (string, string) {
+	if match := aliasSuffix.FindStringSubmatch(entry); match != nil && balanced(match[1]) {
+		alias := match[2]
+		if strings.HasPrefix(alias, `"`) {
+			alias = strings.ReplaceAll(alias[1:len(alias)-1], `""`, `"`)
+		} else {
+			alias = strings.ToLower(alias)
+		}
+		return strings.TrimSpace(match[1]), alias
+	}
+	if match := plainColumn.FindStringSubmatch(entry); match != nil {
+		return entry, match[1]
+	}
+	if match := functionCall.FindStringSubmatch(entry); match != nil {
+		return entry, strings.ToLower(match[1])
+	}
+	return entry, "?column?"
+}
+
+// catalogValue works out one selected value from a catalog row: a column of the row,
+// a known catalog function, a value the row has under the column's alias, or a literal.
+func catalogValue(expr, name string, row catalogRow) any {
+	if match := plainColumn.FindStringSubmatch(expr); match != nil {
+		if value, ok := row[strings.ToLower(match[1])]; ok {
+			return value
+		}
+	}
+	if match := functionCall.FindStringSubmatch(expr); match != nil {
+		if function, ok := catalogFunctions[strings.ToLower(match[1])]; ok {
+			return function(row)
+		}
+	}
+	if value, ok := row[strings.ToLower(name)]; ok {
+		return value
+	}
+	switch literal := strings.ToLower(strings.TrimSpace(expr)); {
+	case literal == "true" || literal == "false":
+		return literal == "true"
+	case strings.HasPrefix(literal, "'") && strings.HasSuffix(literal, "'") && len(literal) > 1:
+		return strings.ReplaceAll(expr[1:len(expr)-1], "''", "'")
+	default:
+		if n, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			return n
+		}
+	}
+	return nil
+}
+
+var (
+	regexCondition    = regexp.MustCompile(`(?i)(?:\w+\.)?(\w+)\s*(operator\s*\(\s*pg_catalog\.(!?~\*?)\s*\)|!?~\*?)\s*'((?:[^']|'')*)'`)
+	equalityCondition = regexp.MustCompile(`(?i)(?:\w+\.)?(\w+)\s*(=|<>|!=)\s*('(?:[^']|'')*'|-?\d+)`)
+	inCondition       = regexp.MustCompile(`(?i)(?:\w+\.)?(\w+)\s+(not\s+)?in\s*\(([^()]*)\)`)
+	quotedLiteral     = regexp.MustCompile(`'((?:[^']|'')*)'`)
+)
+
+// matchesConditions checks a row against the comparisons of columns with literals in a
+// WHERE clause (=, <>, ~, !~ and IN), treating them as ANDed. Conditions on columns the
+// row doesn't have, like join conditions, are ignored.
+func matchesConditions(row catalogRow, where string) bool {
+	for _, match := range regexCondition.FindAllStringSubmatch(where, -1) {
+		value, ok := row[strings.ToLower(match[1])]
+		if !ok {
+			continue
+		}
+		op := match[3]
+		if op == "" {
+			op = match[2]
+		}
+		pattern := strings.ReplaceAll(match[4], "''", "'")
+		if strings.HasSuffix(op, "*") {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		if re.MatchString(formatValue(value)) == strings.HasPrefix(op, "!") {
+			return false
+		}
+	}
+	for _, match := range equalityCondition.FindAllStringSubmatch(where, -1) {
+		value, ok := row[strings.ToLower(match[1])]
+		if !ok {
+			continue
+		}
+		literal := strings.ReplaceAll(strings.Trim(match[3], "'"), "''", "'")
+		equal := value != nil && formatValue(value) == literal
+		if equal != (match[2] == "=") {
+			return false
+		}
+	}
+	for _, match := range inCondition.FindAllStringSubmatch(where, -1) {
+		value, ok := row[strings.ToLower(match[1])]
+		if !ok {
+			continue
+		}
+		found := false
+		for _, literal := range quotedLiteral.FindAllStringSubmatch(match[3], -1) {
+			if value != nil && formatValue(value) == literal[1] {
+				found = true
+			}
+		}
+		if found == (match[2] != "") {
+			return false
+		}
+	}
+	return true
+}
+
+// splitClauses finds a query's top-level SELECT list, FROM and WHERE clauses, ignoring
+// any inside parentheses (subqueries).
+func splitClauses(query string) map[string]string {
+	keywords := []string{"select", "from", "where", "group", "having", "order", "limit", "offset", "union", "for"}
+	clauses := map[string]string{}
+	current, start := "", 0
+	depth, quote := 0, rune(0)
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			continue
+		case r == '\'' || r == '"':
+			quote = r
+			continue
+		case r == '(':
+			depth++
+			continue
+		case r == ')':
+			depth--
+			continue
+		}
+		if depth != 0 || (i > 0 && (isWordRune(runes[i-1]) || runes[i-1] == '.')) {
+			continue
+		}
+		for _, keyword := range keywords {
+			end := i + len(keyword)
+			if end <= len(runes) && strings.EqualFold(string(runes[i:end]), keyword) && (end == len(runes) || !isWordRune(runes[end])) {
+				if current != "" {
+					if _, seen := clauses[current]; !seen {
+						clauses[current] = string(runes[start:i])
+					}
+				}
+				current, start = keyword, end
+				i = end - 1
+				break
+			}
+		}
+	}
+	if _, seen := clauses[current]; current != "" && !seen {
+		clauses[current] = string(runes[start:])
+	}
+	return clauses
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// splitTopLevel splits text on sep where it isn't inside parentheses or quotes.
+func splitTopLevel(text string, sep rune) []string {
+	var parts []string
+	depth, quote, start := 0, rune(0), 0
+	runes := []rune(text)
+	for i, r := range runes {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == sep && depth == 0:
+			parts = append(parts, string(runes[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, string(runes[start:]))
+}
+
+// balanced reports whether text's parentheses and quotes are all closed, so a match
+// that ends there is at the top level.
+func balanced(text string) bool {
+	depth, quote := 0, rune(0)
+	for _, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		}
+	}
+	return depth == 0 && quote == 0
+}
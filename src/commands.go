@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// errNotHandled is returned by a command handler that can't resolve the player's
+// command itself, so it goes to the dungeon master instead.
+var errNotHandled = errors.New("command not handled")
+
+// commandHandler resolves a command inside tx. It returns what to tell the player and,
+// for commands that change the world, the changes to log as the turn (nil otherwise).
+type commandHandler func(engine *Engine, ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error)
+
+// commands maps verbs to their handlers. Movement ("go north", "n") is recognised
+// separately by parseMovement.
+var commands = map[string]commandHandler{
+	"inventory": (*Engine).inventoryCommand,
+	"inv":       (*Engine).inventoryCommand,
+	"i":         (*Engine).inventoryCommand,
+	"look":      (*Engine).lookCommand,
+	"l":         (*Engine).lookCommand,
+	"examine":   (*Engine).examineCommand,
+	"x":         (*Engine).examineCommand,
+	"inspect":   (*Engine).examineCommand,
+	"look at":   (*Engine).examineCommand,
+	"take":      (*Engine).takeCommand,
+	"get":       (*Engine).takeCommand,
+	"grab":      (*Engine).takeCommand,
+	"pick up":   (*Engine).takeCommand,
+	"drop":      (*Engine).dropCommand,
+	"put down":  (*Engine).dropCommand,
+	"help":      (*Engine).helpCommand,
+	"commands":  (*Engine).helpCommand,
+}
+
+// flavourSystem asks the narrator to retell a result the game has already decided.
+const flavourSystem = `You are the dungeon master of a text adventure game. The game has already resolved the player's action; retell the result below in your own voice, in two or three sentences. Keep every fact (names, items, directions and exits) and add nothing that changes the world. Do not call any tools.
+
+# Result
+%s`
+
+// splitCommand separates a command's verb from its arguments, recognising two-word verbs
+// like "pick up", and drops articles from the arguments.
+func splitCommand(query string) (string, string) {
+	words := strings.Fields(strings.ToLower(strings.Trim(query, " .!?")))
+	if len(words) == 0 {
+		return "", ""
+	}
+	verb, rest := words[0], words[1:]
+	if len(rest) > 0 {
+		if _, ok := commands[verb+" "+rest[0]]; ok {
+			verb, rest = verb+" "+rest[0], rest[1:]
+		}
+	}
+	for len(rest) > 1 && (rest[0] == "the" || rest[0] == "a" || rest[0] == "an") {
+		rest = rest[1:]
+	}
+	return verb, strings.Join(rest, " ")
+}
+
+// handleCommand answers common commands straight from the database, without an LLM
+// round trip. It reports whether the query was handled, and if so whether it failed;
+// free-form actions, and commands naming things the database doesn't know, are left to
+// the dungeon master.
+func (engine *Engine) handleCommand(ctx context.Context, query string) (bool, error) {
+	handler, args := (*Engine).goCommand, ""
+	if target, ok := parseMovement(query); ok {
+		args = target
+	} else {
+		var verb string
+		verb, args = splitCommand(query)
+		if handler, ok = commands[verb]; !ok {
+			return false, nil
+		}
+	}
+
+	var narrative []string
+	err := engine.inTurn(ctx, func(tx pgx.Tx) error {
+		var changes *GameResponse
+		var err error
+		narrative, changes, err = handler(engine, ctx, tx, args)
+		if err != nil || changes == nil {
+			return err
+		}
+		changes.DungeonMasterResponse = strings.Join(narrative, "\n\n")
+		return engine.recordTurn(ctx, tx, query, changes)
+	})
+	if errors.Is(err, errNotHandled) {
+		return false, nil
+	}
+	if err != nil {
+		fmt.Printf("Error handling command %q: %v\n", query, err)
+		return true, errFizzled
+	}
+
+	engine.tellResult(ctx, query, narrative)
+	engine.compactMemoryInBackground()
+	return true, nil
+}
+
+// tellResult shows a command's result, retold by the narrator when FastPathFlavour is
+// on. The plain text is the fallback if the narrator fails.
+func (engine *Engine) tellResult(ctx context.Context, query string, narrative []string) {
+	if engine.config.FastPathFlavour {
+		result := strings.Join(narrative, "\n\n")
+		writer := &narrationWriter{emit: func(text string) { engine.Sayf("%s", text) }}
+		_, err := engine.narrator.Narrate(ctx, NarrationRequest{System: fmt.Sprintf(flavourSystem, result), Action: query}, writer.Write)
+		writer.Flush()
+		if err == nil || writer.written {
+			return
+		}
+		fmt.Printf("Error flavouring command result: %v\n", err)
+	}
+	for _, paragraph := range narrative {
+		engine.Sayf("%s", paragraph)
+	}
+}
+
+// lockPlayer locks the player's row for the rest of tx, so turns for the same player
+// apply one at a time, and returns their current location. Inside a transaction block
+// the lock would last until COMMIT, holding up the player's other sessions, so the row
+// is only read.
+func (engine *Engine) lockPlayer(ctx context.Context, tx pgx.Tx) (int, error) {
+	return engine.playerLocation(ctx, tx, engine.tx == nil)
+}
+
+// playerLocation returns the player's current location, or 0 if they have none, and
+// with lock set locks their row for the rest of tx. Commands that only look don't
+// lock it, so they don't wait for a turn in progress.
+func (engine *Engine) playerLocation(ctx context.Context, tx pgx.Tx, lock bool) (int, error) {
+	query := "SELECT COALESCE(current_location_id, 0) FROM players WHERE id = $1"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var locationID int
+	err := tx.QueryRow(ctx, query, engine.playerID).Scan(&locationID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read location of player %d: %w", engine.playerID, err)
+	}
+	return locationID, nil
+}
+
+func (engine *Engine) goCommand(ctx context.Context, tx pgx.Tx, target string) ([]string, *GameResponse, error) {
+	narrative, err := engine.followExit(ctx, tx, target)
+	if errors.Is(err, errNoExit) {
+		return nil, nil, errNotHandled
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return narrative, &GameResponse{}, nil
+}
+
+func (engine *Engine) inventoryCommand(ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error) {
+	if args != "" {
+		return nil, nil, errNotHandled
+	}
+	carried, err := engine.carriedItems(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(carried) == 0 {
+		return []string{"You aren't carrying anything."}, nil, nil
+	}
+	return []string{fmt.Sprintf("You are carrying: %s.", joinNames(carried))}, nil, nil
+}
+
+func (engine *Engine) lookCommand(ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error) {
+	if args != "" {
+		// "look north", "look under the bed"... are the dungeon master's to describe
+		return nil, nil, errNotHandled
+	}
+	locationID, err := engine.playerLocation(ctx, tx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if locationID == 0 {
+		return nil, nil, errNotHandled
+	}
+	narrative, err := describeLocation(ctx, tx, locationID)
+	return narrative, nil, err
+}
+
+func (engine *Engine) examineCommand(ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error) {
+	if args == "" {
+		return []string{"Examine what?"}, nil, nil
+	}
+	locationID, err := engine.playerLocation(ctx, tx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	carried, err := engine.carriedItems(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	here, err := thingsAt(ctx, tx, "items", locationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	npcs, err := thingsAt(ctx, tx, "npcs", locationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matches := fuzzyMatch(args, append(append(carried, here...), npcs...))
+	switch len(matches) {
+	case 0:
+		return nil, nil, errNotHandled
+	case 1:
+		if matches[0].Description == "" {
+			return []string{fmt.Sprintf("You see nothing special about the %s.", matches[0].Name)}, nil, nil
+		}
+		return []string{matches[0].Description}, nil, nil
+	default:
+		return []string{whichOne(matches)}, nil, nil
+	}
+}
+
+func (engine *Engine) takeCommand(ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error) {
+	if args == "" {
+		return []string{"Take what?"}, nil, nil
+	}
+	locationID, err := engine.lockPlayer(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	here, err := thingsAt(ctx, tx, "items", locationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matches := fuzzyMatch(args, here)
+	switch len(matches) {
+	case 0:
+		carried, err := engine.carriedItems(ctx, tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if held := fuzzyMatch(args, carried); len(held) == 1 {
+			return []string{fmt.Sprintf("You already have the %s.", held[0].Name)}, nil, nil
+		}
+		return nil, nil, errNotHandled
+	case 1:
+		if err := engine.addToInventory(ctx, tx, matches[0].ID); err != nil {
+			return nil, nil, err
+		}
+		changes := &GameResponse{ItemsToAddToInventory: []int{matches[0].ID}}
+		return []string{fmt.Sprintf("You take the %s.", matches[0].Name)}, changes, nil
+	default:
+		return []string{whichOne(matches)}, nil, nil
+	}
+}
+
+func (engine *Engine) dropCommand(ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error) {
+	if args == "" {
+		return []string{"Drop what?"}, nil, nil
+	}
+	locationID, err := engine.lockPlayer(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	carried, err := engine.carriedItems(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matches := fuzzyMatch(args, carried)
+	switch len(matches) {
+	case 0:
+		return nil, nil, errNotHandled
+	case 1:
+		item := matches[0]
+		_, err := tx.Exec(ctx, "DELETE FROM player_items WHERE player_id = $1 AND item_id = $2", engine.playerID, item.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to remove item %d from inventory: %w", item.ID, err)
+		}
+		if locationID > 0 {
+			if _, err := tx.Exec(ctx, "UPDATE items SET location_id = $1 WHERE id = $2", locationID, item.ID); err != nil {
+				return nil, nil, fmt.Errorf("failed to drop item %d: %w", item.ID, err)
+			}
+		}
+		changes := &GameResponse{ItemsToRemoveFromInventory: []int{item.ID}}
+		return []string{fmt.Sprintf("You drop the %s.", item.Name)}, changes, nil
+	default:
+		return []string{whichOne(matches)}, nil, nil
+	}
+}
+
+func (engine *Engine) helpCommand(ctx context.Context, tx pgx.Tx, args string) ([]string, *GameResponse, error) {
+	return []string{
+		"Type what you want to do, in your own words, and the dungeon master will tell you what happens.",
+		"Some commands are answered straight away: look, inventory (i), examine <thing> (x), take <item>, drop <item>, go <direction or place> (or just n, s, e, w, up, down...), and help.",
+	}, nil, nil
+}
+
+// namedThing is an item or NPC a command can refer to by name.
+type namedThing struct {
+	ID          int
+	Name        string
+	Description string
+}
+
+func (engine *Engine) carriedItems(ctx context.Context, tx pgx.Tx) ([]namedThing, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT i.id, COALESCE(i.name, ''), COALESCE(i.description, '')
+		FROM items i
+		INNER JOIN player_items pi ON i.id = pi.item_id
+		WHERE pi.player_id = $1
+		ORDER BY i.id
+	`, engine.playerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query inventory: %w", err)
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[namedThing])
+}
+
+// thingsAt lists the rows of table ("items" or "npcs") in a location.
+func thingsAt(ctx context.Context, tx pgx.Tx, table string, locationID int) ([]namedThing, error) {
+	rows, err := tx.Query(ctx,
+		"SELECT id, COALESCE(name, ''), COALESCE(description, '') FROM "+pgx.Identifier{table}.Sanitize()+" WHERE location_id = $1 ORDER BY id",
+		locationID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s at location %d: %w", table, locationID, err)
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[namedThing])
+}
+
+func joinNames(things []namedThing) string {
+	names := make([]string, len(things))
+	for i, thing := range things {
+		names[i] = thing.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func whichOne(matches []namedThing) string {
+	return fmt.Sprintf("Which do you mean: %s?", joinNames(matches))
+}
+
+// fuzzyMatch returns the candidates whose names best match what the player typed.
+// From best to worst: the exact name, the name containing the words typed, and names
+// whose words are all within a typo of the words typed ("rusty kee", "candel").
+func fuzzyMatch(query string, candidates []namedThing) []namedThing {
+	query = strings.ToLower(strings.TrimSpace(query))
+	bestScore := 0
+	var best []namedThing
+	for _, candidate := range candidates {
+		score := matchScore(query, strings.ToLower(candidate.Name))
+		if score == 0 || score < bestScore {
+			continue
+		}
+		if score > bestScore {
+			bestScore, best = score, nil
+		}
+		best = append(best, candidate)
+	}
+	return best
+}
+
+func matchScore(query, name string) int {
+	switch {
+	case query == "" || name == "":
+		return 0
+	case query == name:
+		return 4
+	case containsWords(name, query):
+		return 3
+	case strings.Contains(name, query):
+		return 2
+	}
+
+	// Every word typed must be close to a word of the name
+	nameWords := strings.Fields(name)
+	for _, word := range strings.Fields(query) {
+		close := false
+		for _, nameWord := range nameWords {
+			if editDistance(word, nameWord) <= max(1, len(nameWord)/4) {
+				close = true
+				break
+			}
+		}
+		if !close {
+			return 0
+		}
+	}
+	return 1
+}
+
+// containsWords reports whether the words of query appear in name as whole words, in order.
+func containsWords(name, query string) bool {
+	return strings.Contains(" "+strings.Join(strings.Fields(name), " ")+" ", " "+strings.Join(strings.Fields(query), " ")+" ")
+}
+
+// editDistance is the number of single-letter edits, counting swapping two neighbouring
+// letters as one, that turn a into b.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
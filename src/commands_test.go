@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	things := []namedThing{
+		{ID: 1, Name: "Rusty Key"},
+		{ID: 2, Name: "Brass Key"},
+		{ID: 3, Name: "Candle"},
+		{ID: 4, Name: "Candlestick"},
+		{ID: 5, Name: "Old Map"},
+	}
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"rusty key", []int{1}},
+		{"  RUSTY KEY ", []int{1}},
+		{"key", []int{1, 2}},
+		{"candle", []int{3}},
+		{"stick", []int{4}},
+		{"rusty kee", []int{1}},
+		{"candel", []int{3}},
+		{"map", []int{5}},
+		{"olde mapp", []int{5}},
+		{"sword", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got []int
+			for _, match := range fuzzyMatch(tt.query, things) {
+				got = append(got, match.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fuzzyMatch(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		query, verb, args string
+	}{
+		{"look", "look", ""},
+		{"Take the rusty key.", "take", "rusty key"},
+		{"pick up a candle", "pick up", "candle"},
+		{"look at the map!", "look at", "map"},
+		{"drop the", "drop", "the"},
+		{"   ", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if verb, args := splitCommand(tt.query); verb != tt.verb || args != tt.args {
+				t.Errorf("splitCommand(%q) = %q, %q, want %q, %q", tt.query, verb, args, tt.verb, tt.args)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DBConfig holds the database settings, all that `migrate` needs.
+type DBConfig struct {
+	// DatabaseURL is the connection string for the game-state database.
+	DatabaseURL string
+	// DBMaxConns and DBMinConns size the connection pool shared by every player.
+	DBMaxConns int32
+	DBMinConns int32
+	// DBAutoMigrate applies pending schema migrations at startup. Disable it to run
+	// `migrate up` as a separate deploy step instead.
+	DBAutoMigrate bool
+	// DBLockTimeout is how long a turn waits for rows another player's transaction
+	// block holds before it fizzles.
+	DBLockTimeout time.Duration
+	// TxIdleTimeout is how long a transaction block may sit idle between statements
+	// before it is rolled back and the session ended, as PostgreSQL's
+	// idle_in_transaction_session_timeout does; zero turns it off.
+	TxIdleTimeout time.Duration
+}
+
+// Config holds the server settings, read from environment variables at startup.
+type Config struct {
+	DBConfig
+
+	// AuthMethod is the password check applied to psql logins, using the pg_hba.conf names:
+	// "scram-sha-256", "md5", "password" (cleartext) or "trust".
+	AuthMethod string
+	// AuthAutoRegister lets a login for a name no character has yet claim it by choosing
+	// a password on first connect. Characters that exist without credentials, such as
+	// those from before passwords, can't be claimed this way.
+	AuthAutoRegister bool
+	// AuthTrustLocal skips authentication for loopback connections. Off by default, as
+	// a proxy on the same host makes every connection look local.
+	AuthTrustLocal bool
+
+	// TLSMode controls SSLRequest handling: "disable", "prefer" or "require".
+	TLSMode string
+	// TLSCertFile and TLSKeyFile point at a PEM key pair, reloaded when the files change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSSelfSignedDir is where the fallback self-signed certificate is kept when no
+	// key pair is configured; TLSHostnames are extra names it is issued for.
+	TLSSelfSignedDir string
+	TLSHostnames     []string
+
+	// LLMProvider picks the dungeon master backend: "anthropic", "openai" (any
+	// OpenAI-compatible server) or "stub" (canned responses, no network).
+	LLMProvider string
+	// LLMModel is the model name passed to the provider.
+	LLMModel        string
+	AnthropicAPIKey string
+	// OpenAIBaseURL is the API root of the OpenAI-compatible server, e.g. Ollama's
+	// http://localhost:11434/v1; OpenAIAPIKey is optional for local servers.
+	OpenAIBaseURL string
+	OpenAIAPIKey  string
+	// LLMStubFixtures is the stub provider's fixture file; empty uses the built-in one.
+	LLMStubFixtures string
+
+	// MemoryTurns is how many recent turns are replayed to the narrator, and
+	// MemoryTokenBudget roughly how many tokens they may take; older turns are
+	// summarised into the player's story so far.
+	MemoryTurns       int
+	MemoryTokenBudget int
+	// PromptTokenBudget is roughly how many tokens the world description in each
+	// prompt may take before outlying places are left out.
+	PromptTokenBudget int
+	// FastPathFlavour has the narrator retell the results of commands the game answers
+	// itself (look, take, go...), at the cost of an LLM call each.
+	FastPathFlavour bool
+
+	// WSAllowedOrigins are the web pages, besides those on the WebSocket's own host,
+	// whose scripts may connect to /ws; "*" allows any.
+	WSAllowedOrigins []string
+	// WSMaxMessageBytes caps the size of a message from a WebSocket client.
+	WSMaxMessageBytes int
+	// WSQueriesPerMinute and WSQueryBurst rate-limit each WebSocket client's queries;
+	// zero queries a minute turns the limit off.
+	WSQueriesPerMinute int
+	WSQueryBurst       int
+	// WSSessionSecret signs the session tokens of web clients; when it isn't set, a
+	// random one is used, and tokens don't outlive the server.
+	WSSessionSecret string
+	// WSSessionGrace is how long a web client's session waits for it to reconnect, and
+	// WSReplayMessages how many of the session's latest messages are kept to send it
+	// when it does.
+	WSSessionGrace   time.Duration
+	WSReplayMessages int
+
+	// TTSVoices maps the voice names /tts accepts to piper models, and TTSDefaultVoice
+	// is the one used when a request names none.
+	TTSVoices       map[string]string
+	TTSDefaultVoice string
+	// TTSCacheDir is where spoken sentences are cached; it may be emptied at any time.
+	// The sentences heard least recently are evicted once it holds more than
+	// TTSCacheMaxBytes; zero leaves it to grow.
+	TTSCacheDir      string
+	TTSCacheMaxBytes int64
+	// TTSMaxTextBytes caps the text of a /tts request.
+	TTSMaxTextBytes int
+	// TTSWorkers is how many piper processes may run at once.
+	TTSWorkers int
+
+	// MetricsAddr is the address of the admin listener serving /debug/vars, such as
+	// 127.0.0.1:9090; empty serves it nowhere. It shouldn't be reachable by players.
+	MetricsAddr string
+}
+
+// defaultAnthropicModel is the model used when LLM_MODEL isn't set for the Anthropic provider.
+const defaultAnthropicModel = "claude-opus-4-5-20251101"
+
+// LoadDBConfig reads the database settings from the environment.
+func LoadDBConfig() (*DBConfig, error) {
+	config := &DBConfig{
+		DatabaseURL:   os.Getenv("DATABASE_URL"),
+		DBMaxConns:    int32(envInt("DB_MAX_CONNS", 20)),
+		DBMinConns:    int32(envInt("DB_MIN_CONNS", 2)),
+		DBAutoMigrate: envBool("DB_AUTO_MIGRATE", true),
+		DBLockTimeout: time.Duration(envInt("DB_LOCK_TIMEOUT_SECONDS", 5)) * time.Second,
+		TxIdleTimeout: time.Duration(envInt("TX_IDLE_TIMEOUT_SECONDS", 60)) * time.Second,
+	}
+	if config.DBMaxConns < 1 || config.DBMinConns < 0 || config.DBMinConns > config.DBMaxConns {
+		return nil, fmt.Errorf("invalid pool size DB_MIN_CONNS=%d DB_MAX_CONNS=%d", config.DBMinConns, config.DBMaxConns)
+	}
+	if config.DBLockTimeout <= 0 || config.TxIdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid timeouts DB_LOCK_TIMEOUT_SECONDS=%d TX_IDLE_TIMEOUT_SECONDS=%d",
+			int(config.DBLockTimeout/time.Second), int(config.TxIdleTimeout/time.Second))
+	}
+	return config, nil
+}
+
+// LoadConfig reads the rest of the server configuration from the environment.
+func LoadConfig(db *DBConfig) (*Config, error) {
+	config := &Config{
+		DBConfig:           *db,
+		AuthMethod:         strings.ToLower(envString("AUTH_METHOD", authMethodSCRAM)),
+		AuthAutoRegister:   envBool("AUTH_AUTO_REGISTER", false),
+		AuthTrustLocal:     envBool("AUTH_TRUST_LOCAL", false),
+		TLSMode:            strings.ToLower(envString("TLS_MODE", tlsModePrefer)),
+		TLSCertFile:        envString("TLS_CERT_FILE", ""),
+		TLSKeyFile:         envString("TLS_KEY_FILE", ""),
+		TLSSelfSignedDir:   envString("TLS_SELF_SIGNED_DIR", "certs"),
+		TLSHostnames:       envList("TLS_HOSTNAMES"),
+		LLMProvider:        strings.ToLower(envString("LLM_PROVIDER", llmProviderAnthropic)),
+		LLMModel:           envString("LLM_MODEL", ""),
+		AnthropicAPIKey:    os.Getenv("ANTHROPIC_API_KEY"),
+		OpenAIBaseURL:      envString("OPENAI_BASE_URL", "http://localhost:11434/v1"),
+		OpenAIAPIKey:       os.Getenv("OPENAI_API_KEY"),
+		LLMStubFixtures:    envString("LLM_STUB_FIXTURES", ""),
+		MemoryTurns:        envInt("MEMORY_TURNS", 10),
+		MemoryTokenBudget:  envInt("MEMORY_TOKEN_BUDGET", 3000),
+		PromptTokenBudget:  envInt("PROMPT_TOKEN_BUDGET", 4000),
+		FastPathFlavour:    envBool("FAST_PATH_FLAVOUR", false),
+		WSAllowedOrigins:   envList("WS_ALLOWED_ORIGINS"),
+		WSMaxMessageBytes:  envInt("WS_MAX_MESSAGE_BYTES", 16384),
+		WSQueriesPerMinute: envInt("WS_QUERIES_PER_MINUTE", 60),
+		WSQueryBurst:       envInt("WS_QUERY_BURST", 10),
+		WSSessionSecret:    os.Getenv("WS_SESSION_SECRET"),
+		WSSessionGrace:     time.Duration(envInt("WS_SESSION_GRACE_SECONDS", 300)) * time.Second,
+		WSReplayMessages:   envInt("WS_REPLAY_MESSAGES", 256),
+		TTSDefaultVoice:    envString("TTS_DEFAULT_VOICE", "narrator"),
+		TTSCacheDir:        envString("TTS_CACHE_DIR", "tts-cache"),
+		TTSCacheMaxBytes:   int64(envInt("TTS_CACHE_MAX_MB", 256)) << 20,
+		TTSMaxTextBytes:    envInt("TTS_MAX_TEXT_BYTES", 4096),
+		TTSWorkers:         envInt("TTS_WORKERS", 2),
+		MetricsAddr:        envString("METRICS_ADDR", ""),
+	}
+	if config.WSAllowedOrigins == nil {
+		// The web client's development server
+		config.WSAllowedOrigins = []string{"http://localhost:3000", "http://127.0.0.1:3000"}
+	}
+	voices, err := envMap("TTS_VOICES")
+	if err != nil {
+		return nil, err
+	}
+	config.TTSVoices = voices
+	if config.TTSVoices == nil {
+		// The voice the Docker image downloads
+		config.TTSVoices = map[string]string{"narrator": "/opt/piper-voices/en_US-lessac-medium.onnx"}
+	}
+
+	switch config.AuthMethod {
+	case authMethodTrust, authMethodPassword, authMethodMD5, authMethodSCRAM:
+	default:
+		return nil, fmt.Errorf("unsupported AUTH_METHOD %q", config.AuthMethod)
+	}
+
+	switch config.TLSMode {
+	case tlsModeDisable, tlsModePrefer, tlsModeRequire:
+	default:
+		return nil, fmt.Errorf("unsupported TLS_MODE %q", config.TLSMode)
+	}
+	switch config.LLMProvider {
+	case llmProviderAnthropic:
+		if config.LLMModel == "" {
+			config.LLMModel = defaultAnthropicModel
+		}
+	case llmProviderOpenAI:
+		if config.LLMModel == "" {
+			return nil, fmt.Errorf("LLM_MODEL must be set for LLM_PROVIDER=%s", llmProviderOpenAI)
+		}
+	case llmProviderStub:
+	default:
+		return nil, fmt.Errorf("unsupported LLM_PROVIDER %q", config.LLMProvider)
+	}
+	if config.MemoryTurns < 1 || config.MemoryTokenBudget < 1 {
+		return nil, fmt.Errorf("invalid memory size MEMORY_TURNS=%d MEMORY_TOKEN_BUDGET=%d", config.MemoryTurns, config.MemoryTokenBudget)
+	}
+	if config.PromptTokenBudget < 1 {
+		return nil, fmt.Errorf("invalid PROMPT_TOKEN_BUDGET=%d", config.PromptTokenBudget)
+	}
+	if config.WSMaxMessageBytes < 1 || config.WSQueriesPerMinute < 0 || config.WSQueryBurst < 1 {
+		return nil, fmt.Errorf("invalid WebSocket limits WS_MAX_MESSAGE_BYTES=%d WS_QUERIES_PER_MINUTE=%d WS_QUERY_BURST=%d",
+			config.WSMaxMessageBytes, config.WSQueriesPerMinute, config.WSQueryBurst)
+	}
+	if config.WSSessionGrace < 0 || config.WSReplayMessages < 0 {
+		return nil, fmt.Errorf("invalid web sessions WS_SESSION_GRACE_SECONDS=%d WS_REPLAY_MESSAGES=%d",
+			int(config.WSSessionGrace/time.Second), config.WSReplayMessages)
+	}
+	if _, ok := config.TTSVoices[config.TTSDefaultVoice]; !ok {
+		return nil, fmt.Errorf("TTS_DEFAULT_VOICE %q isn't one of TTS_VOICES", config.TTSDefaultVoice)
+	}
+	if config.TTSWorkers < 1 {
+		return nil, fmt.Errorf("invalid TTS_WORKERS=%d", config.TTSWorkers)
+	}
+	if config.TTSCacheMaxBytes < 0 || config.TTSMaxTextBytes < 1 {
+		return nil, fmt.Errorf("invalid TTS limits TTS_CACHE_MAX_MB=%d TTS_MAX_TEXT_BYTES=%d",
+			config.TTSCacheMaxBytes>>20, config.TTSMaxTextBytes)
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	return config, nil
+}
+
+func envString(key, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envList splits a comma-separated variable, dropping empty entries.
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envMap reads a comma-separated list of name=value pairs, such as TTS_VOICES.
+func envMap(key string) (map[string]string, error) {
+	var values map[string]string
+	for _, entry := range envList(key) {
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid %s entry %q; expected name=value", key, entry)
+		}
+		if values == nil {
+			values = map[string]string{}
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+func envInt(key string, fallback int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("Warning: ignoring invalid %s=%q, using %d\n", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func envBool(key string, fallback bool) bool {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("Warning: ignoring invalid %s=%q, using %v\n", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
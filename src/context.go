@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strings"
+)
+
+// maxNeighbours and maxIndexedPlaces cap the rows fetched for the outer rings of the
+// world context; the token budget usually cuts them shorter.
+const (
+	maxNeighbours    = 8
+	maxIndexedPlaces = 200
+)
+
+// promptMetrics tracks prompt sizes, served with the other expvars at /debug/vars on
+// the METRICS_ADDR listener.
+var (
+	promptMetrics    = expvar.NewMap("prompt")
+	promptTokensLast = new(expvar.Int)
+	promptTokensMax  = new(expvar.Int)
+)
+
+func init() {
+	promptMetrics.Set("tokens_last", promptTokensLast)
+	promptMetrics.Set("tokens_max", promptTokensMax)
+}
+
+// worldContext is the part of the system prompt describing the world around the player.
+type worldContext struct {
+	Text    string
+	Tokens  int
+	Omitted int // places left out to stay within the token budget
+}
+
+// assembleWorldContext describes the world from the player's point of view. The current
+// location, inventory, items and NPCs present and exits are always included;
+// neighbouring places and then a name-only index of distant ones fill the rest of
+// PromptTokenBudget.
+func (engine *Engine) assembleWorldContext(ctx context.Context, locationID int) worldContext {
+	var sections []string
+	used := 0
+	add := func(title, body string) {
+		section := fmt.Sprintf("## %s:\n%s", title, body)
+		sections = append(sections, section)
+		used += estimateTokens(section)
+	}
+
+	var name, description string
+	err := engine.world().QueryRow(ctx, "SELECT name, description FROM locations WHERE id = $1", locationID).Scan(&name, &description)
+	if err != nil {
+		fmt.Printf("Error loading current location %d: %v\n", locationID, err)
+		add("Current Location", "Unknown - the player is nowhere in particular.")
+	} else {
+		add("Current Location", fmt.Sprintf("ID %d: %s: %s", locationID, name, description))
+	}
+	add("Items in Inventory", engine.getItems(ctx))
+	add("Items Here", engine.getItemsAt(ctx, locationID))
+	add("NPCs Here (with interaction history)", engine.getNpcsForLocation(ctx, locationID))
+	if exits, err := getExits(ctx, engine.world(), locationID, true); err != nil {
+		fmt.Printf("Error loading exits: %v\n", err)
+	} else if len(exits) > 0 {
+		lines := make([]string, len(exits))
+		for i, exit := range exits {
+			lines[i] = exit.String()
+		}
+		add("Exits", strings.Join(lines, "\n"))
+	} else {
+		add("Exits", "None known yet.")
+	}
+
+	shown := []int{locationID}
+	if err == nil {
+		neighbours, ids := engine.getNeighbours(ctx, locationID, name, description)
+		var lines []string
+		for i, neighbour := range neighbours {
+			// Neighbours that don't fit in full can still make the index below
+			if used+estimateTokens(neighbour) > engine.config.PromptTokenBudget {
+				break
+			}
+			lines = append(lines, neighbour)
+			shown = append(shown, ids[i])
+			used += estimateTokens(neighbour)
+		}
+		if len(lines) > 0 {
+			add("Nearby Places", strings.Join(lines, "\n\n"))
+		}
+	}
+
+	// Everywhere else is listed by name only, so the DM knows it exists without paying for it
+	places := engine.getPlaceIndex(ctx, shown)
+	var index []string
+	omitted := 0
+	for i, place := range places {
+		if used+estimateTokens(place) > engine.config.PromptTokenBudget {
+			omitted += len(places) - i
+			break
+		}
+		index = append(index, place)
+		used += estimateTokens(place)
+	}
+	if omitted > 0 {
+		index = append(index, fmt.Sprintf("(%d more places not listed)", omitted))
+	}
+	if len(index) > 0 {
+		add("Distant Places", strings.Join(index, "\n"))
+	}
+
+	text := strings.Join(sections, "\n\n")
+	return worldContext{Text: text, Tokens: estimateTokens(text), Omitted: omitted}
+}
+
+// getItemsAt lists the items lying in a location.
+func (engine *Engine) getItemsAt(ctx context.Context, locationID int) string {
+	rows, err := engine.world().Query(ctx,
+		"SELECT id, name, description FROM items WHERE location_id = $1 ORDER BY id",
+		locationID,
+	)
+	if err != nil {
+		fmt.Printf("Error querying items at location %d: %v\n", locationID, err)
+		return "Unable to load items."
+	}
+	defer rows.Close()
+
+	var items []string
+	for rows.Next() {
+		var id int
+		var name, description string
+		if err := rows.Scan(&id, &name, &description); err != nil {
+			continue
+		}
+		items = append(items, fmt.Sprintf("ID %d: %s: %s", id, name, description))
+	}
+	if len(items) == 0 {
+		return "Nothing of note lies here."
+	}
+	return strings.Join(items, "\n\n")
+}
+
+// getNeighbours returns the places next to a location, described along with what can
+// be found there, and their IDs. Neighbours are the places its visible exits lead to;
+// for a location with no exits yet, places are taken to be neighbours when either
+// one's description mentions the other by name.
+func (engine *Engine) getNeighbours(ctx context.Context, locationID int, name, description string) ([]string, []int) {
+	rows, err := engine.world().Query(ctx, `
+		SELECT l.id, l.name, l.description,
+			COALESCE((SELECT string_agg(i.name, ', ' ORDER BY i.id) FROM items i WHERE i.location_id = l.id), ''),
+			COALESCE((SELECT string_agg(n.name, ', ' ORDER BY n.id) FROM npcs n WHERE n.location_id = l.id), '')
+		FROM locations l
+		WHERE l.id <> $1 AND (
+			l.id IN (SELECT e.to_location_id FROM location_exits e WHERE e.from_location_id = $1 AND NOT e.hidden)
+			OR (NOT EXISTS (SELECT 1 FROM location_exits e WHERE e.from_location_id = $1)
+				AND l.name <> ''
+				AND (position(lower(l.name) in lower($2)) > 0 OR ($3 <> '' AND position(lower($3) in lower(l.description)) > 0))))
+		ORDER BY l.id
+		LIMIT $4
+	`, locationID, description, name, maxNeighbours)
+	if err != nil {
+		fmt.Printf("Error querying neighbours of location %d: %v\n", locationID, err)
+		return nil, nil
+	}
+	defer rows.Close()
+
+	var neighbours []string
+	var ids []int
+	for rows.Next() {
+		var id int
+		var name, description, items, npcs string
+		if err := rows.Scan(&id, &name, &description, &items, &npcs); err != nil {
+			continue
+		}
+		neighbour := fmt.Sprintf("ID %d: %s: %s", id, name, description)
+		if items != "" {
+			neighbour += "\n  Items: " + items
+		}
+		if npcs != "" {
+			neighbour += "\n  NPCs: " + npcs
+		}
+		neighbours = append(neighbours, neighbour)
+		ids = append(ids, id)
+	}
+	return neighbours, ids
+}
+
+// getPlaceIndex lists every location not already described, most recently created first.
+func (engine *Engine) getPlaceIndex(ctx context.Context, exclude []int) []string {
+	rows, err := engine.world().Query(ctx,
+		"SELECT id, name FROM locations WHERE id <> ALL($1) ORDER BY id DESC LIMIT $2",
+		exclude, maxIndexedPlaces,
+	)
+	if err != nil {
+		fmt.Printf("Error querying place index: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var places []string
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			continue
+		}
+		places = append(places, fmt.Sprintf("ID %d: %s", id, name))
+	}
+	return places
+}
+
+// recordPromptMetrics logs and publishes the size of one turn's prompt.
+func recordPromptMetrics(playerID int, world worldContext, systemTokens, historyTokens int) {
+	total := systemTokens + historyTokens
+	promptMetrics.Add("turns", 1)
+	promptMetrics.Add("tokens_total", int64(total))
+	promptMetrics.Add("world_tokens_total", int64(world.Tokens))
+	promptMetrics.Add("history_tokens_total", int64(historyTokens))
+	if world.Omitted > 0 {
+		promptMetrics.Add("truncated_turns", 1)
+	}
+	promptTokensLast.Set(int64(total))
+	if int64(total) > promptTokensMax.Value() {
+		promptTokensMax.Set(int64(total))
+	}
+	fmt.Printf("Prompt for player %d: ~%d tokens (world %d, history %d, %d places omitted)\n",
+		playerID, total, world.Tokens, historyTokens, world.Omitted)
+}
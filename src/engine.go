@@ -2,28 +2,71 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"regexp"
-	"github.com/anthropics/anthropic-sdk-go"
-	"github.com/anthropics/anthropic-sdk-go/option"
+	"net"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgproto3"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Transport carries a session's protocol messages to and from its client. psql
+// connections use a *pgproto3.Backend; the web client's sessions use a wsTransport.
+type Transport interface {
+	Receive() (pgproto3.FrontendMessage, error)
+	Send(msg pgproto3.BackendMessage)
+	Flush() error
+	// SetAuthType tells the transport which kind of password message comes next.
+	SetAuthType(authType uint32) error
+}
+
 type Engine struct {
-	psqlBackend  *pgproto3.Backend
+	transport  Transport
 	db *pgxpool.Pool
-	llm anthropic.Client
-	model string
+	narrator Narrator
+	config *Config
+	remoteAddr net.Addr
+	// trusted sessions, such as the web client's, skip authentication.
+	trusted bool
+
+	// username is the login from the StartupMessage; playerID is the players row it resolves to.
+	username   string
+	clientName string
+	database   string
+	playerID   int
+
+	// processID and secretKey are this session's BackendKeyData, which a CancelRequest must quote.
+	processID   uint32
+	secretKey   uint32
+	queryMu     sync.Mutex
+	cancelQuery context.CancelFunc
+
+	// Prepared statements and portals of the extended query protocol, by name. After an
+	// error, its messages are skipped until the next Sync.
+	statements   map[string]*preparedStatement
+	portals      map[string]*portal
+	skipTillSync bool
+
+	// tx is the transaction block opened by BEGIN, if any; txFailed is set once an
+	// action in it has failed, after which only COMMIT or ROLLBACK is accepted.
+	tx       pgx.Tx
+	txFailed bool
+	// While the client is idle in a transaction block, txIdleTimer rolls it back after
+	// TxIdleTimeout and sets txExpired. txMu guards these and the block while idle.
+	txMu        sync.Mutex
+	txIdle      bool
+	txIdleTimer *time.Timer
+	txExpired   bool
 }
 
-// GameResponse represents the structured JSON response from the LLM
+// GameResponse is one turn's result from the LLM: the narrative plus the state changes
+// to apply. The narrative is the model's prose; the changes are its tool calls (see gameTools).
 type GameResponse struct {
-	DungeonMasterResponse string        `json:"dungeon_master_response"`
+	DungeonMasterResponse string        `json:"dungeon_master_response,omitempty"`
 	ItemsToAdd           []ItemUpdate   `json:"items_to_add,omitempty"`
 	ItemsToUpdate        []ItemUpdate   `json:"items_to_update,omitempty"`
 	ItemsToRemove        []int          `json:"items_to_remove,omitempty"`
@@ -35,78 +78,125 @@ type GameResponse struct {
 	NpcInteractions      []NPCInteraction `json:"npc_interactions,omitempty"` // New interactions to record
 	LocationsToAdd       []LocationUpdate `json:"locations_to_add,omitempty"`
 	LocationsToUpdate    []LocationUpdate `json:"locations_to_update,omitempty"`
-	PlayerStateUpdates   map[string]interface{} `json:"player_state_updates,omitempty"`
+	PlayerStateUpdates   *PlayerStateUpdate `json:"player_state_updates,omitempty"`
+	ExitsToAdd           []ExitUpdate   `json:"exits_to_add,omitempty"`
+	ExitsToUnlock        []int          `json:"exits_to_unlock,omitempty"` // Exit IDs to unlock
+	ExitsToReveal        []int          `json:"exits_to_reveal,omitempty"` // Exit IDs of hidden exits the player has found
 }
 
 type ItemUpdate struct {
-	ID          int    `json:"id,omitempty"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	LocationID  int    `json:"location_id,omitempty"`
+	ID          int    `json:"id,omitempty" description:"ID of the existing item"`
+	Name        string `json:"name" description:"Short name of the item"`
+	Description string `json:"description" description:"What the player sees when examining the item"`
+	LocationID  int    `json:"location_id,omitempty" description:"ID of the location the item lies in"`
 }
 
 type NPCUpdate struct {
-	ID          int    `json:"id,omitempty"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	LocationID  int    `json:"location_id,omitempty"`
+	ID          int    `json:"id,omitempty" description:"ID of the existing NPC"`
+	Name        string `json:"name" description:"Name of the NPC"`
+	Description string `json:"description" description:"Appearance and demeanour of the NPC"`
+	LocationID  int    `json:"location_id,omitempty" description:"ID of the location the NPC is in"`
 }
 
 type LocationUpdate struct {
-	ID          int    `json:"id,omitempty"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	ID          int    `json:"id,omitempty" description:"ID of the existing location"`
+	Name        string `json:"name" description:"Name of the location"`
+	Description string `json:"description" description:"What the player sees on arriving"`
 }
 
 type NPCInteraction struct {
-	NpcID      int    `json:"npc_id"`      // Required: ID of the NPC
-	PlayerID   int    `json:"player_id,omitempty"` // Optional: defaults to 1
-	Interaction string `json:"interaction"` // Required: description of what happened
-	Sentiment  string `json:"sentiment,omitempty"` // Optional: "positive", "negative", "neutral"
+	NpcID       int    `json:"npc_id" description:"ID of the NPC"`
+	Interaction string `json:"interaction" description:"Brief description of what happened, e.g. \"Player gave the NPC a gift\""`
+	Sentiment   string `json:"sentiment,omitempty" description:"How the NPC perceived the interaction" enum:"positive,negative,neutral"`
 }
 
-func NewEngine(psqlBackend *pgproto3.Backend) *Engine {
-	psqlBackend.Send(&pgproto3.AuthenticationOk{})
-	psqlBackend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "16.8"})
-	psqlBackend.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
-	psqlBackend.Send(&pgproto3.BackendKeyData{ProcessID: 1234, SecretKey: 5678})
-	psqlBackend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
-	err := psqlBackend.Flush()
-	if err != nil {
-		fmt.Printf("Error flushing psql backend: %v\n", err)
-		return nil
-	}
-
-	db, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
-	if err != nil {
-		fmt.Printf("Error connecting to database: %v\n", err)
-		return nil
-	}
-
-	apiKey := os.Getenv("ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		fmt.Printf("Warning: ANTHROPIC_API_KEY not set\n")
-	}
+// ExitUpdate creates a way from one location to another.
+type ExitUpdate struct {
+	FromLocationID  int    `json:"from_location_id,omitempty" description:"ID of the location the exit leads out of; defaults to the player's current location"`
+	ToLocationID    int    `json:"to_location_id,omitempty" description:"ID of the existing location the exit leads to"`
+	ToLocationName  string `json:"to_location_name,omitempty" description:"Name of the location the exit leads to, for a location created this turn"`
+	Direction       string `json:"direction" description:"Which way the player goes to take the exit: a compass direction, up, down, in, out, or a short name like \"trapdoor\""`
+	ReturnDirection string `json:"return_direction,omitempty" description:"Direction of the way back from the destination; set it to create the reverse exit too"`
+	Description     string `json:"description,omitempty" description:"What the exit looks like, e.g. \"a narrow staircase\""`
+	Locked          bool   `json:"locked,omitempty" description:"Whether the exit is locked"`
+	Hidden          bool   `json:"hidden,omitempty" description:"Whether the exit is hidden until the player finds it"`
+	RequiredItemID  int    `json:"required_item_id,omitempty" description:"ID of an item the player must carry to pass, which also unlocks the exit if it is locked"`
+}
 
-	llmClient := anthropic.NewClient(option.WithAPIKey(apiKey))
+// PlayerStateUpdate changes the connected player's own state.
+type PlayerStateUpdate struct {
+	CurrentLocationID   int    `json:"current_location_id,omitempty" description:"ID of the existing location the player moves to"`
+	CurrentLocationName string `json:"current_location_name,omitempty" description:"Name of the location the player moves to, for a location created this turn"`
+}
 
+func NewEngine(transport Transport, db *pgxpool.Pool, narrator Narrator, config *Config, startupParams map[string]string, remoteAddr net.Addr) *Engine {
 	return &Engine{
-		psqlBackend: psqlBackend,
+		transport: transport,
 		db: db,
-		llm: llmClient,
-		model: "claude-opus-4-5-20251101",
+		narrator: narrator,
+		config: config,
+		remoteAddr: remoteAddr,
+		username: playerNameFromStartup(startupParams),
+		clientName: startupParams["application_name"],
+		database: startupParams["database"],
+		statements: map[string]*preparedStatement{},
+		portals: map[string]*portal{},
+	}
+}
+
+// playerNameFromStartup picks the login name for a connection from its StartupMessage parameters.
+// The "user" parameter is authoritative; application_name is only used when a client omits it.
+func playerNameFromStartup(params map[string]string) string {
+	if user := strings.TrimSpace(params["user"]); user != "" {
+		return user
 	}
+	if appName := strings.TrimSpace(params["application_name"]); appName != "" {
+		return appName
+	}
+	return "Player"
 }
 
 
 func (engine *Engine) Run() error {
 
-	// INIT the database
-	engine.initDatabase()
+	// Check the login's password before letting it into the world
+	if err := engine.authenticate(context.Background()); err != nil {
+		return err
+	}
+
+	// Resolve (or create) the player this connection controls
+	playerID, err := engine.resolvePlayer(context.Background(), engine.username)
+	if err != nil {
+		fmt.Printf("Error resolving player %q: %v\n", engine.username, err)
+		return err
+	}
+	engine.playerID = playerID
+	fmt.Printf("Player %q (ID: %d) connected via %q\n", engine.username, engine.playerID, engine.clientName)
+
+	if err := cancelTargets.register(engine); err != nil {
+		return err
+	}
+
+	engine.transport.Send(&pgproto3.AuthenticationOk{})
+	session := engine.sqlSession()
+	for _, setting := range serverSettings {
+		if setting.Reported {
+			engine.transport.Send(&pgproto3.ParameterStatus{Name: setting.Name, Value: session.setting(setting.Name)})
+		}
+	}
+	engine.transport.Send(&pgproto3.BackendKeyData{ProcessID: engine.processID, SecretKey: engine.secretKey})
+	if err := engine.sendReadyForQuery(); err != nil {
+		fmt.Printf("Error flushing psql backend: %v\n", err)
+		return err
+	}
 
 	// Run the game loop
 	for {
-		msg, err := engine.psqlBackend.Receive()
+		engine.waitIdle()
+		msg, err := engine.transport.Receive()
+		if engine.stopIdle() {
+			return engine.terminateIdle()
+		}
 		if err != nil {
 		if err == io.EOF {
 			fmt.Printf("Client disconnected\n")
@@ -116,99 +206,57 @@ func (engine *Engine) Run() error {
 		return err
 		}
 
-		switch m := msg.(type) {
-		case *pgproto3.Query:
-			query := m.String
-			fmt.Printf("Received: %s\n", query)
-			if strings.HasPrefix(query, "SELECT version()") {
-				engine.psqlBackend.Send(&pgproto3.RowDescription{
-					Fields: []pgproto3.FieldDescription{
-						{Name: []byte("version")},
-					},
-				})
-				engine.psqlBackend.Send(&pgproto3.DataRow{
-					Values: [][]byte{[]byte("foo")},
-				})
-				engine.psqlBackend.Send(&pgproto3.CommandComplete{
-					CommandTag: []byte("SELECT 1"),
-				})
-				engine.psqlBackend.Send(&pgproto3.ReadyForQuery{})
-				err := engine.psqlBackend.Flush()
-				if err != nil {
-					fmt.Printf("Error flushing psql backend: %v\n", err)
-					return err
-				}
+		// After an error in an extended query, the rest of it is skipped
+		if engine.skipTillSync {
+			switch msg.(type) {
+			case *pgproto3.Sync, *pgproto3.Terminate:
+			default:
 				continue
 			}
-			if strings.HasPrefix(query, "SELECT ") && strings.HasSuffix(query, "as type;") {
-				engine.psqlBackend.Send(&pgproto3.RowDescription{
-					Fields: []pgproto3.FieldDescription{
-						{Name: []byte("type")},
-					},
-				})
-				engine.psqlBackend.Send(&pgproto3.DataRow{
-					Values: [][]byte{
-						[]byte("log"),
-					},
-				})
-				engine.psqlBackend.Send(&pgproto3.CommandComplete{
-					CommandTag: []byte("SELECT 1"),
-				})
-				engine.psqlBackend.Send(&pgproto3.ReadyForQuery{})
-				err = engine.psqlBackend.Flush()
-				if err != nil {
-					fmt.Printf("Error flushing psql backend: %v\n", err)
-					return err
-				}
-				continue
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			fmt.Printf("Received: %s\n", m.String)
+			engine.resetUnnamed(true)
+			statements := splitStatements(m.String)
+			if len(statements) == 0 {
+				engine.transport.Send(&pgproto3.EmptyQueryResponse{})
 			}
-			if strings.HasPrefix(query, "SELECT ") {
-				engine.psqlBackend.Send(&pgproto3.RowDescription{
-					Fields: []pgproto3.FieldDescription{},
-				})
-				engine.psqlBackend.Send(&pgproto3.DataRow{
-					Values: [][]byte{},
-				})
-				engine.psqlBackend.Send(&pgproto3.CommandComplete{
-					CommandTag: []byte("SELECT 0"),
-				})
-				engine.psqlBackend.Send(&pgproto3.ReadyForQuery{})
-				err = engine.psqlBackend.Flush()
-				if err != nil {
-					fmt.Printf("Error flushing psql backend: %v\n", err)
-					return err
+			// Each statement is its own action; the first to fail ends the query, as in PostgreSQL
+			for _, statement := range statements {
+				if err := engine.runStatement(statement.Text); err != nil {
+					var sqlErr *sqlError
+					if errors.As(err, &sqlErr) && sqlErr.Position > 0 {
+						located := *sqlErr
+						located.Position += statement.Offset
+						err = &located
+					}
+					engine.sendQueryError(statement.Text, err)
+					break
 				}
-				continue
 			}
-			if strings.HasPrefix(query, "SET ") {
-				engine.psqlBackend.Send(&pgproto3.CommandComplete{
-					CommandTag: []byte("SET"),
-				})
-				engine.psqlBackend.Send(&pgproto3.ReadyForQuery{})
-				err = engine.psqlBackend.Flush()
-				if err != nil {
-					fmt.Printf("Error flushing psql backend: %v\n", err)
-					return err
-				}
-				continue
+			err = engine.sendReadyForQuery()
+			if err != nil {
+				fmt.Printf("Error flushing psql backend: %v\n", err)
+				return err
 			}
-		query = strings.Replace(query, "\n", "", -1)
-		query = strings.Replace(query, ";", "", -1)
-		engine.handleQuery(query)
-
-		engine.psqlBackend.Send(&pgproto3.ReadyForQuery{})
-		err := engine.psqlBackend.Flush()
-		if err != nil {
-			fmt.Printf("Error flushing psql backend: %v\n", err)
-			return err
-		}
 
 		case *pgproto3.Terminate:
 			fmt.Printf("Client disconnected\n")
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close, *pgproto3.Flush:
+			if err := engine.handleExtendedQuery(m); err != nil {
+				fmt.Printf("Error flushing psql backend: %v\n", err)
+				return err
+			}
 		case *pgproto3.Sync:
 			fmt.Printf("Received Sync message\n")
-			engine.psqlBackend.Send(&pgproto3.ReadyForQuery{})
-			err := engine.psqlBackend.Flush()
+			engine.skipTillSync = false
+			// Portals last until the end of the transaction: this Sync's, or the block's
+			if engine.tx == nil {
+				engine.resetUnnamed(false)
+			}
+			err := engine.sendReadyForQuery()
 			if err != nil {
 				fmt.Printf("Error flushing psql backend: %v\n", err)
 			}
@@ -219,13 +267,47 @@ func (engine *Engine) Run() error {
 }
 
 
+// runStatement runs one statement of a simple query and completes it. SELECTs read the
+// game schema; everything else is a player action.
+func (engine *Engine) runStatement(query string) error {
+	switch {
+	case isTransactionCommand(query) || engine.txFailed:
+		tag, err := engine.runTransactionCommand(query)
+		if err != nil {
+			return err
+		}
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+	case isSQLQuery(query):
+		ctx, done := engine.startQuery()
+		result, err := engine.runQuery(ctx, query, nil)
+		done()
+		if err != nil {
+			return err
+		}
+		engine.sendResultSet(result)
+	case isSetQuery(query):
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte("SET")})
+	default:
+		ctx, done := engine.startQuery()
+		err := engine.act(ctx, playerAction(query))
+		done()
+		if err != nil {
+			return err
+		}
+		// An action returns no rows, like a DO block
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte("DO")})
+	}
+	return nil
+}
+
+
 func (engine *Engine) Sayf(format string, a ...any) {
 	msg := fmt.Sprintf(format, a...)
-	engine.psqlBackend.Send(&pgproto3.NoticeResponse{
+	engine.transport.Send(&pgproto3.NoticeResponse{
 		Severity: "",
 		Message:  msg,
 	})
-	err := engine.psqlBackend.Flush()
+	err := engine.transport.Flush()
 	if err != nil {
 		fmt.Printf("Error flushing psql backend: %v\n", err)
 		return
@@ -233,268 +315,115 @@ func (engine *Engine) Sayf(format string, a ...any) {
 }
 
 
-func (engine *Engine) handleQuery(query string) {
-	world := engine.getWorld()
-	items := engine.getItems()
-	worldItems := engine.getWorldItems()
-	
-	// Get current player location
-	currentLocationID := engine.getCurrentPlayerLocation()
-	npcs := engine.getNpcsForLocation(currentLocationID)
-
-	jsonSchema := `{
-		"type": "object",
-		"properties": {
-			"dungeon_master_response": {
-			"type": "string",
-			"description": "The narrative response to show the player describing what happens"
-			},
-			"items_to_add": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"name": {"type": "string"},
-				"description": {"type": "string"},
-				"location_id": {"type": "integer"}
-				},
-				"required": ["name", "description"]
-			}
-			},
-			"items_to_update": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"id": {"type": "integer"},
-				"name": {"type": "string"},
-				"description": {"type": "string"},
-				"location_id": {"type": "integer"}
-				},
-				"required": ["id"]
-			}
-			},
-			"items_to_remove": {
-			"type": "array",
-			"items": {"type": "integer"}
-			},
-			"items_to_add_to_inventory": {
-			"type": "array",
-			"items": {"type": "integer"},
-			"description": "Item IDs to add to the player's inventory (must exist in items table)"
-			},
-			"items_to_remove_from_inventory": {
-			"type": "array",
-			"items": {"type": "integer"},
-			"description": "Item IDs to remove from the player's inventory"
-			},
-			"npcs_to_add": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"name": {"type": "string"},
-				"description": {"type": "string"},
-				"location_id": {"type": "integer"}
-				},
-				"required": ["name", "description"]
-			}
-			},
-			"npcs_to_update": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"id": {"type": "integer"},
-				"name": {"type": "string"},
-				"description": {"type": "string"},
-				"location_id": {"type": "integer"}
-				},
-				"required": ["id"]
-			}
-			},
-			"npcs_to_remove": {
-			"type": "array",
-			"items": {"type": "integer"}
-			},
-			"npc_interactions": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"npc_id": {"type": "integer"},
-				"player_id": {"type": "integer"},
-				"interaction": {"type": "string"},
-				"sentiment": {"type": "string", "enum": ["positive", "negative", "neutral"]}
-				},
-				"required": ["npc_id", "interaction"]
-			},
-			"description": "Record new interactions between NPCs and the player. Use this when the player talks to, helps, or interacts with an NPC."
-			},
-			"locations_to_add": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"name": {"type": "string"},
-				"description": {"type": "string"}
-				},
-				"required": ["name", "description"]
-			}
-			},
-			"locations_to_update": {
-			"type": "array",
-			"items": {
-				"type": "object",
-				"properties": {
-				"id": {"type": "integer"},
-				"name": {"type": "string"},
-				"description": {"type": "string"}
-				},
-				"required": ["id"]
-			}
-			}
-		},
-		"required": ["dungeon_master_response"]
-	}`
-
-	// Get current player location for context
-	var locationContext string
-	if currentLocationID > 0 {
-		var locationName string
-		err := engine.db.QueryRow(context.Background(), "SELECT name FROM locations WHERE id = $1", currentLocationID).Scan(&locationName)
-		if err == nil {
-			locationContext = fmt.Sprintf("\n## Current Player Location: %s (ID: %d)\nNote: Only NPCs in this location will show their interaction history with the player.", locationName, currentLocationID)
-		}
+// startQuery returns the context for a query about to run, which a CancelRequest can cancel.
+// The returned func must be called once the query is finished.
+func (engine *Engine) startQuery() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	engine.queryMu.Lock()
+	engine.cancelQuery = cancel
+	engine.queryMu.Unlock()
+	return ctx, func() {
+		engine.queryMu.Lock()
+		engine.cancelQuery = nil
+		engine.queryMu.Unlock()
+		cancel()
 	}
-	
-	systemPrompt := fmt.Sprintf(`You are a dungeon master for a text adventure game. You must respond ONLY with valid JSON in the exact format specified below.
+}
 
-# Current World State
-## Locations:
-%s%s
+// cancelRunningQuery interrupts the query in progress, if any.
+func (engine *Engine) cancelRunningQuery() {
+	engine.queryMu.Lock()
+	defer engine.queryMu.Unlock()
+	if engine.cancelQuery != nil {
+		engine.cancelQuery()
+	}
+}
 
-## Items in Inventory:
-%s
+// playerAction tidies a statement into the action it describes, on one line.
+func playerAction(query string) string {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	return strings.Join(strings.Fields(query), " ")
+}
 
-## Items in the World:
-%s
+// handleQuery plays out a player's action. Failures are returned as a *sqlError
+// explaining them to the player.
+func (engine *Engine) handleQuery(ctx context.Context, query string) error {
+	// Common commands, like walking along a known exit, need no dungeon master
+	if handled, err := engine.handleCommand(ctx, query); handled {
+		return err
+	}
+
+	// Describe the world around the player rather than all of it
+	currentLocationID := engine.getCurrentPlayerLocation(ctx)
+	world := engine.assembleWorldContext(ctx, currentLocationID)
 
-## NPCs (in current location with interaction history):
+	// Recent turns are replayed as conversation; anything older is in the story so far
+	story, history, err := engine.loadMemory(ctx)
+	if err != nil {
+		fmt.Printf("Error loading conversation memory: %v\n", err)
+	}
+	var storyContext string
+	if story != "" {
+		storyContext = fmt.Sprintf("\n# Story So Far\n%s\n", story)
+	}
+	
+	systemPrompt := fmt.Sprintf(`You are a dungeon master for a text adventure game. You respond to each player action by first telling the player what happens, then calling tools to change the world to match.
+%s
+# Current World State
 %s
 
 IMPORTANT: The "Interaction History" shown for each NPC contains the actual recorded history of interactions between the player and that NPC. When the player asks about their history with an NPC, you MUST reference the specific interactions listed in the Interaction History. Do not make up or ignore the interaction history - it is the factual record of what has happened.
 
-# Response Format
-You MUST respond with a JSON object matching this schema:
-%s
-
 # Rules:
-1. Respond ONLY with valid JSON - no markdown, no code blocks, no explanations
-2. The dungeon_master_response field is REQUIRED and should be the narrative description of what happens
-3. Only include fields that have changes (omit empty arrays)
-4. When adding items/NPCs/locations, provide name and description
-5. When updating, you must include the id field
-6. When removing, provide the id in the appropriate _to_remove array
-7. When a player takes/picks up an item:
-   - If the item already exists, add its ID to items_to_add_to_inventory array
-   - If you're creating a new item in items_to_add, you can still add a placeholder ID (like 999) to items_to_add_to_inventory - the system will automatically match it to the newly created item
-8. When a player drops/loses an item, add the item ID to items_to_remove_from_inventory array
-9. When the player interacts with an NPC (talks, helps, threatens, etc.), add an entry to npc_interactions with:
-   - npc_id: The ID of the NPC
-   - interaction: A brief description of what happened (e.g., "Player was friendly and helpful", "Player insulted the NPC", "Player gave the NPC a gift")
-   - sentiment: "positive", "negative", or "neutral" based on how the NPC would perceive the interaction
-10. When the player moves to a new location:
-   - If the location already exists, update player_state_updates with {"current_location_id": <location_id>}
-   - If you're creating a new location in locations_to_add, you can either:
-     a) Use a placeholder ID (like 999) in player_state_updates - the system will auto-match to the newly created location
-     b) Include {"current_location_name": "<location name>"} in player_state_updates to match by name
-     c) The system will automatically move the player to a newly created location if only one location is created
-11. NPCs remember past interactions - ALWAYS use the interaction history shown above to inform their responses
-12. When the player asks about their history with an NPC, reference the specific interactions from the Interaction History field
-13. Only NPCs in the player's current location will show their interaction history - this helps focus on relevant NPCs
-14. Be creative and respond to player actions appropriately`, world, locationContext, items, worldItems, npcs, jsonSchema)
-
-	response, err := engine.llm.Messages.New(
-		context.Background(),
-		anthropic.MessageNewParams{
-			Model: anthropic.Model(engine.model),
-			MaxTokens: 2048,
-			System: []anthropic.TextBlockParam{
-				{Text: systemPrompt},
-			},
-			Messages: []anthropic.MessageParam{
-				anthropic.NewUserMessage(
-					anthropic.NewTextBlock(fmt.Sprintf("Player action: %s\n\nRespond with JSON only:", query)),
-				),
-			},
-		},
-	)
+1. Always start with the narrative description of what happens, written as plain prose addressed to the player
+2. Only call tools for things that actually change this turn, after the narrative
+3. When the player takes/picks up an item, call add_to_inventory with its ID (use 0 for an item you create with add_item in the same turn)
+4. When the player drops/loses an item, call remove_from_inventory
+5. When the player interacts with an NPC (talks, helps, threatens, etc.), call record_interaction with the sentiment the NPC would perceive
+6. When the player moves, call move_player with the existing location's ID, or with the name of a location you create with add_location this turn. Moves along known exits are handled for you, so you only see the ones the map can't answer
+7. NPCs remember past interactions - ALWAYS use the interaction history shown above to inform their responses
+8. When the player asks about their history with an NPC, reference the specific interactions from the Interaction History field
+9. Only NPCs in the player's current location will show their interaction history - this helps focus on relevant NPCs
+10. Distant places are listed by name only; don't invent their contents unless the player goes there
+11. When you create a place the player can reach, call add_exit to connect it (with return_direction for the way back). Unlock or reveal exits with unlock_exit and reveal_exit when the player earns it
+12. Be creative and respond to player actions appropriately`, storyContext, world.Text)
+	recordPromptMetrics(engine.playerID, world, estimateTokens(systemPrompt)+estimateTokens(query), turnTokens(history))
+
+	// Stream the narrative to the player as it is written; state changes wait for the full reply
+	narration := &narrationWriter{emit: func(text string) { engine.Sayf("%s", text) }}
+	gameResponse, err := engine.narrator.Narrate(ctx, NarrationRequest{System: systemPrompt, History: history, Action: query}, narration.Write)
+	narration.Flush()
 	
 	if err != nil {
-		errStr := err.Error()
 		fmt.Printf("Error calling LLM: %v\n", err)
-		
-		if strings.Contains(errStr, "429") || strings.Contains(errStr, "quota") || strings.Contains(errStr, "billing") {
-			engine.Sayf("I'm sorry, but I'm unable to process your request right now due to API quota limits. Please check your Anthropic account billing and quota settings at https://console.anthropic.com/")
-		} else if strings.Contains(errStr, "401") || strings.Contains(errStr, "403") {
-			engine.Sayf("Authentication error with Anthropic API. Please check your API key in the .env file.")
-		} else {
-			engine.Sayf("I encountered an error processing your request: %v. Please try again later.", err)
-		}
-		return
+		return narrationError(err, narration.written)
 	}
 	
-	// Extract text content from Claude's response
-	var responseText string
-	for _, content := range response.Content {
-		if textBlock := content.AsText(); textBlock.Text != "" {
-			responseText += textBlock.Text
+	// Update database based on the response, all or nothing
+	err = engine.inTurn(ctx, func(tx pgx.Tx) error {
+		if err := engine.applyGameUpdates(ctx, tx, gameResponse); err != nil {
+			return err
 		}
+		return engine.recordTurn(ctx, tx, query, gameResponse)
+	})
+	if err != nil {
+		fmt.Printf("Error applying game updates, rolled back: %v\n", err)
+		return errFizzled
 	}
-	
-	// Parse JSON from response (may be wrapped in markdown code blocks)
-	jsonStr := engine.extractJSON(responseText)
-	
-	var gameResponse GameResponse
-	if err := json.Unmarshal([]byte(jsonStr), &gameResponse); err != nil {
-		fmt.Printf("Error parsing JSON response: %v\nRaw response: %s\n", err, responseText)
-		// Fallback: show raw response if JSON parsing fails
-		engine.Sayf("Error parsing game response. Raw: %s", responseText)
-		return
-	}
-	
-	// Update database based on the response
-	engine.applyGameUpdates(&gameResponse)
-	
-	// Show the dungeon master response to the user
-	engine.Sayf(gameResponse.DungeonMasterResponse)
+
+	engine.compactMemoryInBackground()
+	return nil
 }
 
-// extractJSON extracts JSON from a string, handling markdown code blocks
-func (engine *Engine) extractJSON(text string) string {
-	// Remove markdown code blocks if present
-	jsonBlockRegex := regexp.MustCompile("(?s)```(?:json)?\\s*(\\{.*?\\})\\s*```")
-	matches := jsonBlockRegex.FindStringSubmatch(text)
-	if len(matches) > 1 {
-		return matches[1]
-	}
-	
-	// Try to find JSON object directly
-	jsonObjRegex := regexp.MustCompile("(\\{.*\\})")
-	matches = jsonObjRegex.FindStringSubmatch(text)
-	if len(matches) > 1 {
-		return matches[1]
+// applyGameUpdates applies the game state changes from the LLM response inside tx.
+// Any failure is returned so the caller can roll the whole turn back; references the
+// LLM got wrong (unknown IDs) are skipped rather than treated as failures.
+func (engine *Engine) applyGameUpdates(ctx context.Context, tx pgx.Tx, response *GameResponse) error {
+	// Lock the player's row so concurrent turns for the same player apply one at a time
+	if _, err := engine.lockPlayer(ctx, tx); err != nil {
+		return err
 	}
-	
-	// Return as-is if no pattern matches
-	return strings.TrimSpace(text)
-}
 
-// applyGameUpdates applies the game state changes from the LLM response to the database
-func (engine *Engine) applyGameUpdates(response *GameResponse) {
-	ctx := context.Background()
-	
 	// Track newly created items by name so we can add them to inventory if needed
 	newItemIDs := make(map[string]int)
 	
@@ -503,7 +432,7 @@ func (engine *Engine) applyGameUpdates(response *GameResponse) {
 	for _, item := range allItems {
 		if item.ID > 0 {
 			// Update existing item - only update fields that are provided and non-empty
-			_, err := engine.db.Exec(ctx,
+			_, err := tx.Exec(ctx,
 				`INSERT INTO items (id, name, description, location_id) 
 				 VALUES ($1, $2, $3, CASE WHEN $4 > 0 AND EXISTS(SELECT 1 FROM locations WHERE id = $4) THEN $4 ELSE NULL END)
 				 ON CONFLICT (id) 
@@ -518,150 +447,84 @@ func (engine *Engine) applyGameUpdates(response *GameResponse) {
 				item.ID, item.Name, item.Description, item.LocationID,
 			)
 			if err != nil {
-				fmt.Printf("Error upserting item %d: %v\n", item.ID, err)
-			} else {
-				fmt.Printf("Upserted item ID %d: %s\n", item.ID, item.Name)
+				return fmt.Errorf("failed to upsert item %d: %w", item.ID, err)
 			}
+			fmt.Printf("Upserted item ID %d: %s\n", item.ID, item.Name)
 		} else {
 			// Insert new item - handle location_id: use NULL if 0 or invalid
-			var locationID interface{}
-			if item.LocationID > 0 {
-				// Verify location exists before using it
-				var exists bool
-				err := engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM locations WHERE id = $1)", item.LocationID).Scan(&exists)
-				if err == nil && exists {
-					locationID = item.LocationID
-				} else {
-					locationID = nil
-				}
-			} else {
-				locationID = nil
+			locationID, err := existingLocation(ctx, tx, item.LocationID)
+			if err != nil {
+				return err
 			}
 			
 			// Insert and get the new item ID
 			var newItemID int
-			err := engine.db.QueryRow(ctx,
+			err = tx.QueryRow(ctx,
 				"INSERT INTO items (name, description, location_id) VALUES ($1, $2, $3) RETURNING id",
 				item.Name, item.Description, locationID,
 			).Scan(&newItemID)
 			if err != nil {
-				fmt.Printf("Error adding item %s: %v\n", item.Name, err)
-			} else {
-				fmt.Printf("Added item ID %d: %s\n", newItemID, item.Name)
-				// Store the new item ID by name for potential inventory addition
-				newItemIDs[strings.ToLower(item.Name)] = newItemID
+				return fmt.Errorf("failed to add item %s: %w", item.Name, err)
 			}
+			fmt.Printf("Added item ID %d: %s\n", newItemID, item.Name)
+			// Store the new item ID by name for potential inventory addition
+			newItemIDs[strings.ToLower(item.Name)] = newItemID
 		}
 	}
 	
 	// Remove items
 	for _, itemID := range response.ItemsToRemove {
-		_, err := engine.db.Exec(ctx, "DELETE FROM items WHERE id = $1", itemID)
-		if err != nil {
-			fmt.Printf("Error removing item %d: %v\n", itemID, err)
-		} else {
-			fmt.Printf("Removed item ID: %d\n", itemID)
+		if _, err := tx.Exec(ctx, "DELETE FROM items WHERE id = $1", itemID); err != nil {
+			return fmt.Errorf("failed to remove item %d: %w", itemID, err)
 		}
+		fmt.Printf("Removed item ID: %d\n", itemID)
 	}
 	
-	// Ensure default player exists before adding items to inventory
-	engine.ensureDefaultPlayer(ctx)
-	
-	// Add items to player inventory (player_id = 1 for now)
+	// Add items to the connected player's inventory. IDs that don't exist may be
+	// placeholders for items created above; they are matched afterwards.
+	invalidItemIDs := make([]int, 0)
 	for _, itemID := range response.ItemsToAddToInventory {
-		// Check if item exists and is not already in inventory
 		var exists bool
-		err := engine.db.QueryRow(ctx, 
-			"SELECT EXISTS(SELECT 1 FROM items WHERE id = $1)", 
-			itemID,
-		).Scan(&exists)
+		err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM items WHERE id = $1)", itemID).Scan(&exists)
 		if err != nil {
-			fmt.Printf("Error checking if item %d exists: %v\n", itemID, err)
-			continue
+			return fmt.Errorf("failed to check if item %d exists: %w", itemID, err)
 		}
 		if !exists {
-			fmt.Printf("Warning: Item %d does not exist, skipping inventory add\n", itemID)
-			continue
-		}
-		
-		// Check if already in inventory
-		var inInventory bool
-		err = engine.db.QueryRow(ctx,
-			"SELECT EXISTS(SELECT 1 FROM player_items WHERE player_id = 1 AND item_id = $1)",
-			itemID,
-		).Scan(&inInventory)
-		if err != nil {
-			fmt.Printf("Error checking inventory for item %d: %v\n", itemID, err)
+			invalidItemIDs = append(invalidItemIDs, itemID)
 			continue
 		}
-		
-		if !inInventory {
-			_, err = engine.db.Exec(ctx,
-				"INSERT INTO player_items (player_id, item_id) VALUES (1, $1) ON CONFLICT DO NOTHING",
-				itemID,
-			)
-			if err != nil {
-				fmt.Printf("Error adding item %d to inventory: %v\n", itemID, err)
-			} else {
-				fmt.Printf("Added item %d to player inventory\n", itemID)
-			}
-		} else {
-			fmt.Printf("Item %d already in inventory, skipping\n", itemID)
+		if err := engine.addToInventory(ctx, tx, itemID); err != nil {
+			return err
 		}
 	}
 	
 	// Handle case where LLM created new items that should be added to inventory
-	// If items_to_add_to_inventory contains IDs that don't exist, try to match them to newly created items
-	// This handles the case where LLM creates an item but doesn't know its ID yet
-	invalidItemIDs := make([]int, 0)
-	for _, itemID := range response.ItemsToAddToInventory {
-		var itemExists bool
-		err := engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM items WHERE id = $1)", itemID).Scan(&itemExists)
-		if err == nil && !itemExists {
-			invalidItemIDs = append(invalidItemIDs, itemID)
-		}
-	}
-	
-	// If we have invalid IDs and newly created items, try to match them
 	// Heuristic: if exactly one new item was created and there's exactly one invalid ID, assume they match
 	if len(invalidItemIDs) > 0 && len(newItemIDs) > 0 {
 		if len(invalidItemIDs) == 1 && len(newItemIDs) == 1 {
-			// Single new item and single invalid ID - likely a match
 			for _, newItemID := range newItemIDs {
 				fmt.Printf("Auto-adding newly created item ID %d to inventory (matched with invalid ID %d)\n", newItemID, invalidItemIDs[0])
-				var inInventory bool
-				err := engine.db.QueryRow(ctx,
-					"SELECT EXISTS(SELECT 1 FROM player_items WHERE player_id = 1 AND item_id = $1)",
-					newItemID,
-				).Scan(&inInventory)
-				if err == nil && !inInventory {
-					_, err = engine.db.Exec(ctx,
-						"INSERT INTO player_items (player_id, item_id) VALUES (1, $1) ON CONFLICT DO NOTHING",
-						newItemID,
-					)
-					if err != nil {
-						fmt.Printf("Error auto-adding item %d to inventory: %v\n", newItemID, err)
-					} else {
-						fmt.Printf("Auto-added item %d to player inventory\n", newItemID)
-					}
+				if err := engine.addToInventory(ctx, tx, newItemID); err != nil {
+					return err
 				}
 			}
 		} else {
 			fmt.Printf("Warning: Cannot auto-match %d invalid item IDs with %d newly created items (need 1:1 match)\n", len(invalidItemIDs), len(newItemIDs))
 		}
+	} else if len(invalidItemIDs) > 0 {
+		fmt.Printf("Warning: Items %v do not exist, skipping inventory add\n", invalidItemIDs)
 	}
 	
 	// Remove items from player inventory
 	for _, itemID := range response.ItemsToRemoveFromInventory {
-		_, err := engine.db.Exec(ctx,
-			"DELETE FROM player_items WHERE player_id = 1 AND item_id = $1",
-			itemID,
+		_, err := tx.Exec(ctx,
+			"DELETE FROM player_items WHERE player_id = $1 AND item_id = $2",
+			engine.playerID, itemID,
 		)
 		if err != nil {
-			fmt.Printf("Error removing item %d from inventory: %v\n", itemID, err)
-		} else {
-			fmt.Printf("Removed item %d from player inventory\n", itemID)
+			return fmt.Errorf("failed to remove item %d from inventory: %w", itemID, err)
 		}
+		fmt.Printf("Removed item %d from player inventory\n", itemID)
 	}
 	
 	// Upsert NPCs (combine add and update)
@@ -669,13 +532,13 @@ func (engine *Engine) applyGameUpdates(response *GameResponse) {
 	for _, npc := range allNpcs {
 		if npc.ID > 0 {
 			// Update existing NPC
-			_, err := engine.db.Exec(ctx,
+			_, err := tx.Exec(ctx,
 				`INSERT INTO npcs (id, name, description, location_id) 
 				 VALUES ($1, $2, $3, CASE WHEN $4 > 0 AND EXISTS(SELECT 1 FROM locations WHERE id = $4) THEN $4 ELSE NULL END)
 				 ON CONFLICT (id) 
 				 DO UPDATE SET 
-				   name = COALESCE(EXCLUDED.name, npcs.name),
-				   description = COALESCE(EXCLUDED.description, npcs.description),
+				   name = CASE WHEN EXCLUDED.name != '' THEN EXCLUDED.name ELSE npcs.name END,
+				   description = CASE WHEN EXCLUDED.description != '' THEN EXCLUDED.description ELSE npcs.description END,
 				   location_id = CASE 
 				     WHEN EXCLUDED.location_id > 0 AND EXISTS(SELECT 1 FROM locations WHERE id = EXCLUDED.location_id) 
 				     THEN EXCLUDED.location_id 
@@ -684,94 +547,62 @@ func (engine *Engine) applyGameUpdates(response *GameResponse) {
 				npc.ID, npc.Name, npc.Description, npc.LocationID,
 			)
 			if err != nil {
-				fmt.Printf("Error upserting NPC %d: %v\n", npc.ID, err)
-			} else {
-				fmt.Printf("Upserted NPC ID %d: %s\n", npc.ID, npc.Name)
+				return fmt.Errorf("failed to upsert NPC %d: %w", npc.ID, err)
 			}
+			fmt.Printf("Upserted NPC ID %d: %s\n", npc.ID, npc.Name)
 		} else {
 			// Insert new NPC - handle location_id: use NULL if 0 or invalid
-			var locationID interface{}
-			if npc.LocationID > 0 {
-				// Verify location exists before using it
-				var exists bool
-				err := engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM locations WHERE id = $1)", npc.LocationID).Scan(&exists)
-				if err == nil && exists {
-					locationID = npc.LocationID
-				} else {
-					locationID = nil
-				}
-			} else {
-				locationID = nil
+			locationID, err := existingLocation(ctx, tx, npc.LocationID)
+			if err != nil {
+				return err
 			}
 			
-			_, err := engine.db.Exec(ctx,
+			_, err = tx.Exec(ctx,
 				"INSERT INTO npcs (name, description, location_id) VALUES ($1, $2, $3)",
 				npc.Name, npc.Description, locationID,
 			)
 			if err != nil {
-				fmt.Printf("Error adding NPC %s: %v\n", npc.Name, err)
-			} else {
-				fmt.Printf("Added NPC: %s\n", npc.Name)
+				return fmt.Errorf("failed to add NPC %s: %w", npc.Name, err)
 			}
+			fmt.Printf("Added NPC: %s\n", npc.Name)
 		}
 	}
 	
 	// Remove NPCs
 	for _, npcID := range response.NpcsToRemove {
-		_, err := engine.db.Exec(ctx, "DELETE FROM npcs WHERE id = $1", npcID)
-		if err != nil {
-			fmt.Printf("Error removing NPC %d: %v\n", npcID, err)
-		} else {
-			fmt.Printf("Removed NPC ID: %d\n", npcID)
+		if _, err := tx.Exec(ctx, "DELETE FROM npcs WHERE id = $1", npcID); err != nil {
+			return fmt.Errorf("failed to remove NPC %d: %w", npcID, err)
 		}
+		fmt.Printf("Removed NPC ID: %d\n", npcID)
 	}
 	
 	// Save NPC interactions
 	for _, interaction := range response.NpcInteractions {
-		playerID := interaction.PlayerID
-		if playerID == 0 {
-			playerID = 1 // Default to player 1
-		}
-		
 		// Verify NPC exists
 		var npcExists bool
-		err := engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM npcs WHERE id = $1)", interaction.NpcID).Scan(&npcExists)
+		err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM npcs WHERE id = $1)", interaction.NpcID).Scan(&npcExists)
 		if err != nil {
-			fmt.Printf("Error checking if NPC %d exists: %v\n", interaction.NpcID, err)
-			continue
+			return fmt.Errorf("failed to check if NPC %d exists: %w", interaction.NpcID, err)
 		}
 		if !npcExists {
 			fmt.Printf("Warning: NPC %d does not exist, skipping interaction\n", interaction.NpcID)
 			continue
 		}
 		
-		// Verify player exists
-		var playerExists bool
-		err = engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM players WHERE id = $1)", playerID).Scan(&playerExists)
-		if err != nil {
-			fmt.Printf("Error checking if player %d exists: %v\n", playerID, err)
-			continue
-		}
-		if !playerExists {
-			fmt.Printf("Warning: Player %d does not exist, skipping interaction\n", playerID)
-			continue
-		}
-		
 		// Validate sentiment if provided
 		sentiment := interaction.Sentiment
 		if sentiment != "" && sentiment != "positive" && sentiment != "negative" && sentiment != "neutral" {
 			sentiment = "neutral" // Default to neutral if invalid
 		}
 		
-		_, err = engine.db.Exec(ctx,
+		_, err = tx.Exec(ctx,
 			"INSERT INTO npc_player_interactions (npc_id, player_id, interaction, sentiment) VALUES ($1, $2, $3, $4)",
-			interaction.NpcID, playerID, interaction.Interaction, sentiment,
+			interaction.NpcID, engine.playerID, interaction.Interaction, sentiment,
 		)
 		if err != nil {
-			fmt.Printf("Error saving interaction with NPC %d: %v\n", interaction.NpcID, err)
-		} else {
-			fmt.Printf("Recorded interaction: NPC %d - %s [%s]\n", interaction.NpcID, interaction.Interaction, sentiment)
+			return fmt.Errorf("failed to save interaction with NPC %d: %w", interaction.NpcID, err)
 		}
+		fmt.Printf("Recorded interaction: NPC %d - %s [%s]\n", interaction.NpcID, interaction.Interaction, sentiment)
 	}
 	
 	// Handle player state updates (including location changes)
@@ -783,7 +614,7 @@ func (engine *Engine) applyGameUpdates(response *GameResponse) {
 	for _, location := range allLocations {
 		if location.ID > 0 {
 			// Update existing location
-			_, err := engine.db.Exec(ctx,
+			_, err := tx.Exec(ctx,
 				`INSERT INTO locations (id, name, description) 
 				 VALUES ($1, $2, $3)
 				 ON CONFLICT (id) 
@@ -793,124 +624,125 @@ func (engine *Engine) applyGameUpdates(response *GameResponse) {
 				location.ID, location.Name, location.Description,
 			)
 			if err != nil {
-				fmt.Printf("Error upserting location %d: %v\n", location.ID, err)
-			} else {
-				fmt.Printf("Upserted location ID %d: %s\n", location.ID, location.Name)
+				return fmt.Errorf("failed to upsert location %d: %w", location.ID, err)
 			}
+			fmt.Printf("Upserted location ID %d: %s\n", location.ID, location.Name)
 		} else {
 			// Insert new location and capture the ID
 			var newLocationID int
-			err := engine.db.QueryRow(ctx,
+			err := tx.QueryRow(ctx,
 				"INSERT INTO locations (name, description) VALUES ($1, $2) RETURNING id",
 				location.Name, location.Description,
 			).Scan(&newLocationID)
 			if err != nil {
-				fmt.Printf("Error adding location %s: %v\n", location.Name, err)
-			} else {
-				fmt.Printf("Added location ID %d: %s\n", newLocationID, location.Name)
-				// Store the new location ID by name for potential player location update
-				newLocationIDs[strings.ToLower(location.Name)] = newLocationID
+				return fmt.Errorf("failed to add location %s: %w", location.Name, err)
 			}
+			fmt.Printf("Added location ID %d: %s\n", newLocationID, location.Name)
+			// Store the new location ID by name for potential player location update
+			newLocationIDs[strings.ToLower(location.Name)] = newLocationID
 		}
 	}
 	
+	// Exits may lead to the locations created above
+	if err := engine.applyExitUpdates(ctx, tx, response, newLocationIDs); err != nil {
+		return err
+	}
+
 	// Now process player location updates - can reference newly created locations
-	if response.PlayerStateUpdates != nil {
-		if currentLocationID, ok := response.PlayerStateUpdates["current_location_id"].(float64); ok {
-			locationIDInt := int(currentLocationID)
-			// Verify location exists
-			var exists bool
-			err := engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM locations WHERE id = $1)", locationIDInt).Scan(&exists)
-			if err == nil && exists {
-				_, err = engine.db.Exec(ctx, "UPDATE players SET current_location_id = $1 WHERE id = 1", locationIDInt)
-				if err != nil {
-					fmt.Printf("Error updating player location: %v\n", err)
-				} else {
-					fmt.Printf("Updated player location to %d\n", locationIDInt)
+	if update := response.PlayerStateUpdates; update != nil {
+		if update.CurrentLocationID > 0 {
+			locationID, err := existingLocation(ctx, tx, update.CurrentLocationID)
+			if err != nil {
+				return err
+			}
+			if locationID != nil {
+				if err := engine.movePlayer(ctx, tx, update.CurrentLocationID); err != nil {
+					return err
 				}
-			} else if err == nil {
-				// Location ID doesn't exist - might be a newly created location
-				// Try to find it in newly created locations by checking if the ID matches any new location
-				// Since we can't match by ID (it's wrong), we'll handle this differently
-				fmt.Printf("Warning: Location %d does not exist, skipping location update\n", locationIDInt)
+			} else {
+				fmt.Printf("Warning: Location %d does not exist, skipping location update\n", update.CurrentLocationID)
 			}
 		}
-		// Also check if player_state_updates contains a location name (for newly created locations)
-		if locationName, ok := response.PlayerStateUpdates["current_location_name"].(string); ok && locationName != "" {
+		// Also check for a location name (for newly created locations)
+		if update.CurrentLocationName != "" {
 			// Try to find location by name (case-insensitive)
 			var locationID int
-			err := engine.db.QueryRow(ctx, 
+			err := tx.QueryRow(ctx, 
 				"SELECT id FROM locations WHERE LOWER(name) = LOWER($1) LIMIT 1",
-				locationName,
+				update.CurrentLocationName,
 			).Scan(&locationID)
 			if err == nil {
-				_, err = engine.db.Exec(ctx, "UPDATE players SET current_location_id = $1 WHERE id = 1", locationID)
-				if err != nil {
-					fmt.Printf("Error updating player location by name: %v\n", err)
-				} else {
-					fmt.Printf("Updated player location to %d (%s) by name\n", locationID, locationName)
+				if err := engine.movePlayer(ctx, tx, locationID); err != nil {
+					return err
 				}
+			} else if !errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("failed to look up location %q: %w", update.CurrentLocationName, err)
 			}
 		}
-		// Handle other player state updates here if needed
 	}
-	
-	// Auto-update: If exactly one new location was created and player action suggests movement,
-	// automatically move player to that location (heuristic for when LLM doesn't provide location update)
-	if len(newLocationIDs) == 1 && response.PlayerStateUpdates == nil {
-		// Only one new location created and no explicit location update - likely the player moved there
-		for locationName, locationID := range newLocationIDs {
-			fmt.Printf("Auto-updating player location to newly created location %d (%s)\n", locationID, locationName)
-			_, err := engine.db.Exec(ctx, "UPDATE players SET current_location_id = $1 WHERE id = 1", locationID)
-			if err != nil {
-				fmt.Printf("Error auto-updating player location: %v\n", err)
-			} else {
-				fmt.Printf("Auto-updated player location to %d\n", locationID)
-			}
-		}
+
+	return nil
+}
+
+// existingLocation returns locationID if it names a location, or nil (for a NULL column) otherwise.
+func existingLocation(ctx context.Context, tx pgx.Tx, locationID int) (interface{}, error) {
+	if locationID <= 0 {
+		return nil, nil
 	}
+	var exists bool
+	err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM locations WHERE id = $1)", locationID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check location %d: %w", locationID, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	return locationID, nil
 }
 
-func (engine *Engine) getWorld() string {
-	ctx := context.Background()
-	var locations []string
-	
-	rows, err := engine.db.Query(ctx, "SELECT name, description FROM locations ORDER BY id")
+// addToInventory puts an existing item in the connected player's inventory, once.
+func (engine *Engine) addToInventory(ctx context.Context, tx pgx.Tx, itemID int) error {
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO player_items (player_id, item_id)
+		 SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM player_items WHERE player_id = $1 AND item_id = $2)`,
+		engine.playerID, itemID,
+	)
 	if err != nil {
-		fmt.Printf("Error querying locations: %v\n", err)
-		return "Unable to load world information."
+		return fmt.Errorf("failed to add item %d to inventory: %w", itemID, err)
 	}
-	defer rows.Close()
-	
-	for rows.Next() {
-		var name, description string
-		if err := rows.Scan(&name, &description); err != nil {
-			continue
-		}
-		locations = append(locations, fmt.Sprintf("%s: %s", name, description))
+	// A carried item no longer lies anywhere
+	if _, err := tx.Exec(ctx, "UPDATE items SET location_id = NULL WHERE id = $1", itemID); err != nil {
+		return fmt.Errorf("failed to pick up item %d: %w", itemID, err)
 	}
-	
-	if len(locations) == 0 {
-		return "No locations found in the world."
+	if tag.RowsAffected() == 0 {
+		fmt.Printf("Item %d already in inventory, skipping\n", itemID)
+	} else {
+		fmt.Printf("Added item %d to player inventory\n", itemID)
 	}
-	
-	return strings.Join(locations, "\n\n")
+	return nil
+}
+
+// movePlayer sets the connected player's current location.
+func (engine *Engine) movePlayer(ctx context.Context, tx pgx.Tx, locationID int) error {
+	_, err := tx.Exec(ctx, "UPDATE players SET current_location_id = $1 WHERE id = $2", locationID, engine.playerID)
+	if err != nil {
+		return fmt.Errorf("failed to update player location: %w", err)
+	}
+	fmt.Printf("Updated player location to %d\n", locationID)
+	return nil
 }
 
-func (engine *Engine) getItems() string {
-	ctx := context.Background()
+func (engine *Engine) getItems(ctx context.Context) string {
 	var items []string
 	
-	// Get items in player's inventory (items linked via player_items table)
-	// For now, using player_id = 1 as the default player
-	// TODO: Track current player_id per connection
-	rows, err := engine.db.Query(ctx, `
+	// Get items in the connected player's inventory (items linked via player_items table)
+	rows, err := engine.world().Query(ctx, `
 		SELECT i.id, i.name, i.description 
 		FROM items i
 		INNER JOIN player_items pi ON i.id = pi.item_id
-		WHERE pi.player_id = 1
+		WHERE pi.player_id = $1
 		ORDER BY i.id
-	`)
+	`, engine.playerID)
 	if err != nil {
 		fmt.Printf("Error querying inventory items: %v\n", err)
 		return "Unable to load inventory items."
@@ -941,48 +773,12 @@ func (engine *Engine) getItems() string {
 }
 
 
-func (engine *Engine) getWorldItems() string {
-	ctx := context.Background()
-	var items []string
-	
-	rows, err := engine.db.Query(ctx, `
-		SELECT i.id, i.name, i.description, l.name as location_name 
-		FROM items i 
-		LEFT JOIN locations l ON i.location_id = l.id 
-		ORDER BY i.id
-	`)
-	if err != nil {
-		fmt.Printf("Error querying items: %v\n", err)
-		return "Unable to load items."
-	}
-	defer rows.Close()
-	
-	for rows.Next() {
-		var id int
-		var name, description, locationName string
-		if err := rows.Scan(&id, &name, &description, &locationName); err != nil {
-			continue
-		}
-		if locationName != "" {
-			items = append(items, fmt.Sprintf("ID %d: %s (at %s): %s", id, name, locationName, description))
-		} else {
-			items = append(items, fmt.Sprintf("ID %d: %s: %s", id, name, description))
-		}
-	}
-	
-	if len(items) == 0 {
-		return "No items found in the world."
-	}
-	
-	return strings.Join(items, "\n\n")
-}
-
-// getCurrentPlayerLocation returns the current location ID for player 1
-func (engine *Engine) getCurrentPlayerLocation() int {
-	ctx := context.Background()
+// getCurrentPlayerLocation returns the current location ID for the connected player
+func (engine *Engine) getCurrentPlayerLocation(ctx context.Context) int {
 	var locationID int
-	err := engine.db.QueryRow(ctx, 
-		"SELECT COALESCE(current_location_id, 0) FROM players WHERE id = 1",
+	err := engine.world().QueryRow(ctx, 
+		"SELECT COALESCE(current_location_id, 0) FROM players WHERE id = $1",
+		engine.playerID,
 	).Scan(&locationID)
 	if err != nil {
 		fmt.Printf("Error getting current player location: %v\n", err)
@@ -993,8 +789,7 @@ func (engine *Engine) getCurrentPlayerLocation() int {
 
 // getNpcsForLocation returns NPCs in the specified location with their interaction history
 // Only returns NPCs that are in the specified location (locationID > 0)
-func (engine *Engine) getNpcsForLocation(locationID int) string {
-	ctx := context.Background()
+func (engine *Engine) getNpcsForLocation(ctx context.Context, locationID int) string {
 	var npcs []string
 	
 	// Only return NPCs if we have a valid location
@@ -1010,7 +805,7 @@ func (engine *Engine) getNpcsForLocation(locationID int) string {
 		ORDER BY n.id
 	`
 	
-	rows, err := engine.db.Query(ctx, query, locationID)
+	rows, err := engine.world().Query(ctx, query, locationID)
 	if err != nil {
 		fmt.Printf("Error querying NPCs: %v\n", err)
 		return "Unable to load NPCs."
@@ -1025,7 +820,7 @@ func (engine *Engine) getNpcsForLocation(locationID int) string {
 		}
 		
 		// Get interaction history for NPCs in the current location
-		interactions := engine.getNPCInteractions(ctx, id, 1)
+		interactions := engine.getNPCInteractions(ctx, id, engine.playerID)
 		
 		npcStr := fmt.Sprintf("ID %d: %s", id, name)
 		if locationName != "" {
@@ -1050,16 +845,11 @@ func (engine *Engine) getNpcsForLocation(locationID int) string {
 	return strings.Join(npcs, "\n\n")
 }
 
-// getNpcs returns all NPCs (kept for backward compatibility if needed)
-func (engine *Engine) getNpcs() string {
-	return engine.getNpcsForLocation(0) // 0 means all locations
-}
-
 // getNPCInteractions returns a formatted string of interaction history between an NPC and player
 func (engine *Engine) getNPCInteractions(ctx context.Context, npcID, playerID int) string {
 	// First check if any interactions exist
 	var count int
-	err := engine.db.QueryRow(ctx, `
+	err := engine.world().QueryRow(ctx, `
 		SELECT COUNT(*) 
 		FROM npc_player_interactions 
 		WHERE npc_id = $1 AND player_id = $2
@@ -1075,7 +865,7 @@ func (engine *Engine) getNPCInteractions(ctx context.Context, npcID, playerID in
 	
 	fmt.Printf("Found %d interactions for NPC %d, player %d, retrieving...\n", count, npcID, playerID)
 	
-	rows, err := engine.db.Query(ctx, `
+	rows, err := engine.world().Query(ctx, `
 		SELECT interaction, COALESCE(sentiment, '') as sentiment, created_at
 		FROM npc_player_interactions
 		WHERE npc_id = $1 AND player_id = $2
@@ -1120,210 +910,62 @@ func (engine *Engine) getNPCInteractions(ctx context.Context, npcID, playerID in
 	return result
 }
 
-func (engine *Engine) initDatabase() {
-	ctx := context.Background()
-	
-	// Create tables
-	queries := []string{
-		"CREATE TABLE IF NOT EXISTS players (id SERIAL PRIMARY KEY, name VARCHAR(255), current_location_id INT REFERENCES locations(id) ON DELETE SET NULL)",
-		"CREATE TABLE IF NOT EXISTS locations (id SERIAL PRIMARY KEY, name VARCHAR(255), description TEXT)",
-		"CREATE TABLE IF NOT EXISTS items (id SERIAL PRIMARY KEY, name VARCHAR(255), description TEXT, location_id INT REFERENCES locations(id) ON DELETE SET NULL)",
-		"CREATE TABLE IF NOT EXISTS npcs (id SERIAL PRIMARY KEY, name VARCHAR(255), description TEXT, location_id INT REFERENCES locations(id) ON DELETE SET NULL)",
-		"CREATE TABLE IF NOT EXISTS player_items (id SERIAL PRIMARY KEY, player_id INT REFERENCES players(id), item_id INT REFERENCES items(id))",
-		"CREATE TABLE IF NOT EXISTS player_notes (id SERIAL PRIMARY KEY, player_id INT REFERENCES players(id), note TEXT)",
-		"CREATE TABLE IF NOT EXISTS npc_player_interactions (id SERIAL PRIMARY KEY, npc_id INT REFERENCES npcs(id) ON DELETE CASCADE, player_id INT REFERENCES players(id) ON DELETE CASCADE, interaction TEXT, sentiment VARCHAR(20), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)",
-	}
-	for _, query := range queries {
-		_, err := engine.db.Exec(ctx, query)
-		if err != nil {
-			fmt.Printf("Error executing query: %v\n", err)
-			return
-		}
-	}
-
-	// Ensure location_id columns allow NULL (migration for existing tables)
-	alterQueries := []string{
-		"ALTER TABLE items ALTER COLUMN location_id DROP NOT NULL",
-		"ALTER TABLE npcs ALTER COLUMN location_id DROP NOT NULL",
-	}
-	for _, query := range alterQueries {
-		_, err := engine.db.Exec(ctx, query)
-		// Ignore errors - column might already allow NULL or not exist
-		if err != nil {
-			// Only log if it's not a "column does not exist" or "already correct" error
-			if !strings.Contains(err.Error(), "does not exist") && !strings.Contains(err.Error(), "is not null") {
-				fmt.Printf("Note: Could not alter column (may already be correct): %v\n", err)
-			}
-		}
-	}
-	
-	// Add current_location_id to players table if it doesn't exist (migration)
-	// Check if column exists first
-	var columnExists bool
-	var err2 error
-	err2 = engine.db.QueryRow(ctx, `
-		SELECT EXISTS (
-			SELECT 1 
-			FROM information_schema.columns 
-			WHERE table_schema = 'public'
-			AND table_name = 'players' 
-			AND column_name = 'current_location_id'
-		)
-	`).Scan(&columnExists)
-	
-	if err2 != nil {
-		fmt.Printf("Error checking for current_location_id column: %v\n", err2)
-	} else if !columnExists {
-		// Column doesn't exist, add it
-		// First, add the column without the foreign key constraint
-		_, err2 = engine.db.Exec(ctx, `ALTER TABLE players ADD COLUMN current_location_id INT`)
-		if err2 != nil {
-			fmt.Printf("Error adding current_location_id column: %v\n", err2)
-		} else {
-			fmt.Printf("Added current_location_id column to players table\n")
-			
-			// Then add the foreign key constraint (if locations table exists)
-			_, err2 = engine.db.Exec(ctx, `
-				DO $$
-				BEGIN
-					IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'locations') THEN
-						ALTER TABLE players 
-						ADD CONSTRAINT players_current_location_id_fkey 
-						FOREIGN KEY (current_location_id) 
-						REFERENCES locations(id) 
-						ON DELETE SET NULL;
-					END IF;
-				END $$;
-			`)
-			if err2 != nil {
-				// Constraint might already exist
-				fmt.Printf("Note: Could not add foreign key constraint (may already exist): %v\n", err2)
-			}
+// initDatabase brings the schema up to date and seeds an empty world. It runs once at startup.
+func initDatabase(ctx context.Context, db *pgxpool.Pool, autoMigrate bool) error {
+	if autoMigrate {
+		if _, err := migrateUp(ctx, db); err != nil {
+			return err
 		}
 	}
 
-	// Ensure default player exists (player_id = 1)
-	engine.ensureDefaultPlayer(ctx)
-
 	// Check if database is empty and seed default data
 	var locationCount int
-	err := engine.db.QueryRow(context.Background(), "SELECT COUNT(*) FROM locations").Scan(&locationCount)
+	err := db.QueryRow(ctx, "SELECT COUNT(*) FROM locations").Scan(&locationCount)
 	if err != nil {
-		fmt.Printf("Error checking location count: %v\n", err)
-		return
+		return fmt.Errorf("failed to check location count: %w", err)
 	}
 
 	if locationCount == 0 {
 		fmt.Printf("Database is empty, seeding default data...\n")
 		// Only seed if database is truly empty - don't drop existing tables
-		engine.seedDefaultData()
+		seedDefaultData(ctx, db)
 	} else {
 		fmt.Printf("Database already has %d location(s), skipping seed.\n", locationCount)
 	}
+	return nil
 }
 
-// ensureDefaultPlayer creates a default player with ID 1 if it doesn't exist
-func (engine *Engine) ensureDefaultPlayer(ctx context.Context) {
-	var exists bool
-	err := engine.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM players WHERE id = 1)").Scan(&exists)
+// resolvePlayer returns the ID of the player owning the given login name, creating the
+// player (placed at the first location) the first time that name connects.
+func (engine *Engine) resolvePlayer(ctx context.Context, username string) (int, error) {
+	var playerID int
+	err := engine.db.QueryRow(ctx, `
+		INSERT INTO players (name, username, current_location_id)
+		VALUES ($1, $1, (SELECT id FROM locations ORDER BY id LIMIT 1))
+		ON CONFLICT (username) DO UPDATE SET username = EXCLUDED.username
+		RETURNING id
+	`, username).Scan(&playerID)
 	if err != nil {
-		fmt.Printf("Error checking for default player: %v\n", err)
-		return
+		return 0, fmt.Errorf("failed to upsert player: %w", err)
 	}
-	
-	if !exists {
-		// Get the first location as default (or NULL if no locations exist)
-		var defaultLocationID interface{}
-		err := engine.db.QueryRow(ctx, "SELECT id FROM locations ORDER BY id LIMIT 1").Scan(&defaultLocationID)
-		if err != nil {
-			defaultLocationID = nil // No locations yet, will be set when location is created
-		}
-		
-		// Insert player with ID 1
-		_, err = engine.db.Exec(ctx, 
-			"INSERT INTO players (id, name, current_location_id) VALUES (1, 'Player', $1) ON CONFLICT (id) DO NOTHING",
-			defaultLocationID,
-		)
-		if err != nil {
-			fmt.Printf("Error creating default player: %v\n", err)
-			return
-		}
-		
-		// Ensure the sequence is set correctly for future inserts
-		_, err = engine.db.Exec(ctx,
-			"SELECT setval('players_id_seq', GREATEST((SELECT MAX(id) FROM players), 1), true)",
-		)
-		if err != nil {
-			// Ignore sequence errors - not critical
-			fmt.Printf("Note: Could not update players sequence (may not exist): %v\n", err)
-		}
-		
-		fmt.Printf("Created default player (ID: 1)\n")
-	} else {
-		// Ensure player has a location if one exists but player doesn't have one set
-		var hasLocation bool
-		err := engine.db.QueryRow(ctx, "SELECT current_location_id IS NOT NULL FROM players WHERE id = 1").Scan(&hasLocation)
-		if err == nil && !hasLocation {
-			var firstLocationID interface{}
-			err := engine.db.QueryRow(ctx, "SELECT id FROM locations ORDER BY id LIMIT 1").Scan(&firstLocationID)
-			if err == nil {
-				_, err = engine.db.Exec(ctx, "UPDATE players SET current_location_id = $1 WHERE id = 1", firstLocationID)
-				if err == nil {
-					fmt.Printf("Set player's location to first available location\n")
-				}
-			}
-		}
-	}
-}
 
-func (engine *Engine) recreateTables() {
-	ctx := context.Background()
-	
-	// Drop tables in reverse order of dependencies
-	dropQueries := []string{
-		"DROP TABLE IF EXISTS npc_player_interactions",
-		"DROP TABLE IF EXISTS player_notes",
-		"DROP TABLE IF EXISTS player_items",
-		"DROP TABLE IF EXISTS npcs",
-		"DROP TABLE IF EXISTS items",
-		"DROP TABLE IF EXISTS locations",
-		"DROP TABLE IF EXISTS players",
-	}
-	
-	for _, query := range dropQueries {
-		_, err := engine.db.Exec(ctx, query)
-		if err != nil {
-			fmt.Printf("Warning: Error dropping table: %v\n", err)
-		}
-	}
-	
-	// Recreate tables with correct schema
-	createQueries := []string{
-		"CREATE TABLE players (id SERIAL PRIMARY KEY, name VARCHAR(255), current_location_id INT REFERENCES locations(id) ON DELETE SET NULL)",
-		"CREATE TABLE locations (id SERIAL PRIMARY KEY, name VARCHAR(255), description TEXT)",
-		"CREATE TABLE items (id SERIAL PRIMARY KEY, name VARCHAR(255), description TEXT, location_id INT REFERENCES locations(id))",
-		"CREATE TABLE npcs (id SERIAL PRIMARY KEY, name VARCHAR(255), description TEXT, location_id INT REFERENCES locations(id))",
-		"CREATE TABLE player_items (id SERIAL PRIMARY KEY, player_id INT REFERENCES players(id), item_id INT REFERENCES items(id))",
-		"CREATE TABLE player_notes (id SERIAL PRIMARY KEY, player_id INT REFERENCES players(id), note TEXT)",
-		"CREATE TABLE npc_player_interactions (id SERIAL PRIMARY KEY, npc_id INT REFERENCES npcs(id) ON DELETE CASCADE, player_id INT REFERENCES players(id) ON DELETE CASCADE, interaction TEXT, sentiment VARCHAR(20), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)",
-	}
-	
-	for _, query := range createQueries {
-		_, err := engine.db.Exec(ctx, query)
-		if err != nil {
-			fmt.Printf("Error recreating table: %v\n", err)
-			return
-		}
+	// Ensure player has a location if one exists but player doesn't have one set
+	_, err = engine.db.Exec(ctx, `
+		UPDATE players SET current_location_id = (SELECT id FROM locations ORDER BY id LIMIT 1)
+		WHERE id = $1 AND current_location_id IS NULL
+	`, playerID)
+	if err != nil {
+		fmt.Printf("Warning: Could not set location for player %d: %v\n", playerID, err)
 	}
-	fmt.Printf("Tables recreated with correct schema.\n")
+
+	return playerID, nil
 }
 
-func (engine *Engine) seedDefaultData() {
-	ctx := context.Background()
+func seedDefaultData(ctx context.Context, db *pgxpool.Pool) {
 
 	// Insert default location
 	var locationID int
-	err := engine.db.QueryRow(
+	err := db.QueryRow(
 		ctx,
 		"INSERT INTO locations (name, description) VALUES ($1, $2) RETURNING id",
 		"The Old Tavern",
@@ -1335,15 +977,15 @@ func (engine *Engine) seedDefaultData() {
 	}
 	fmt.Printf("Created default location: The Old Tavern (ID: %d)\n", locationID)
 	
-	// Set player's initial location to the default location
-	_, err = engine.db.Exec(ctx,
-		"UPDATE players SET current_location_id = $1 WHERE id = 1",
+	// Place any players without a location at the default location
+	_, err = db.Exec(ctx,
+		"UPDATE players SET current_location_id = $1 WHERE current_location_id IS NULL",
 		locationID,
 	)
 	if err != nil {
-		fmt.Printf("Warning: Could not set player's initial location: %v\n", err)
+		fmt.Printf("Warning: Could not set players' initial location: %v\n", err)
 	} else {
-		fmt.Printf("Set player's initial location to The Old Tavern\n")
+		fmt.Printf("Set players' initial location to The Old Tavern\n")
 	}
 
 	// Insert default items at this location
@@ -1371,7 +1013,7 @@ func (engine *Engine) seedDefaultData() {
 
 	for _, item := range items {
 		var itemID int
-		err := engine.db.QueryRow(
+		err := db.QueryRow(
 			ctx,
 			"INSERT INTO items (name, description, location_id) VALUES ($1, $2, $3) RETURNING id",
 			item.name,
@@ -1402,7 +1044,7 @@ func (engine *Engine) seedDefaultData() {
 
 	for _, npc := range npcs {
 		var npcID int
-		err := engine.db.QueryRow(
+		err := db.QueryRow(
 			ctx,
 			"INSERT INTO npcs (name, description, location_id) VALUES ($1, $2, $3) RETURNING id",
 			npc.name,
@@ -1419,8 +1061,10 @@ func (engine *Engine) seedDefaultData() {
 	fmt.Printf("Default data seeding completed!\n")
 }
 
+// Close releases the engine's session state. The database pool is shared and stays open.
 func (engine *Engine) Close() {
-	if engine.db != nil {
-		engine.db.Close()
-	}
+	cancelTargets.unregister(engine)
+	engine.stopIdle()
+	// Actions never committed are undone when the player leaves
+	engine.endTransaction()
 }
\ No newline at end of file
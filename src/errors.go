@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// SQLSTATE codes reported for actions that fail.
+const (
+	sqlStateQueryCanceled       = "57014"
+	sqlStateQuotaExceeded       = "53400" // configuration_limit_exceeded
+	sqlStateConnectionFailure   = "08006"
+	sqlStateTransactionRollback = "40000"
+	sqlStateInternalError       = "XX000"
+)
+
+// errFizzled is returned when an action's changes to the world can't be saved, so the
+// whole turn is rolled back.
+var errFizzled = &sqlError{
+	Code:    sqlStateTransactionRollback,
+	Message: "your action fizzled",
+	Detail:  "The world shimmers for a moment, but nothing changes.",
+	Hint:    "Please try again.",
+}
+
+// narrationError explains why the dungeon master couldn't answer an action. narrated
+// says whether some of the narrative had already reached the player.
+func narrationError(err error, narrated bool) *sqlError {
+	var llmErr *LLMError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, context.Canceled) && narrated:
+		return &sqlError{Code: sqlStateQueryCanceled, Message: "canceling statement due to user request",
+			Detail: "Your action was cancelled - the world stays as it was."}
+	case errors.Is(err, context.Canceled):
+		return &sqlError{Code: sqlStateQueryCanceled, Message: "canceling statement due to user request",
+			Detail: "Your action was cancelled before the dungeon master could answer."}
+	case errors.Is(err, errNoNarration) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr):
+		return &sqlError{Code: sqlStateSyntaxError, Message: "the dungeon master could not make sense of that",
+			Detail: fmt.Sprintf("The reply could not be used: %v.", err), Hint: "Try that again, perhaps in other words."}
+	case errors.As(err, &llmErr) && llmErr.StatusCode == 429:
+		return &sqlError{Code: sqlStateQuotaExceeded, Message: "the dungeon master has run out of quota",
+			Detail: fmt.Sprintf("The %s API is refusing requests due to quota limits.", llmErr.Provider),
+			Hint:   fmt.Sprintf("Check your %s account billing and quota settings.", llmErr.Provider)}
+	case errors.As(err, &llmErr) && (llmErr.StatusCode == 401 || llmErr.StatusCode == 403):
+		return &sqlError{Code: sqlStateConnectionFailure, Message: "the dungeon master could not be reached",
+			Detail: fmt.Sprintf("The %s API rejected the server's credentials.", llmErr.Provider),
+			Hint:   "Check the API key in the .env file."}
+	default:
+		return &sqlError{Code: sqlStateConnectionFailure, Message: "the dungeon master could not be reached",
+			Detail: err.Error(), Hint: "Please try again later."}
+	}
+}
+
+// sendQueryError reports a failed query or action as an ErrorResponse. SQL errors, and
+// the errors of actions, explain themselves; anything else is logged and reported as
+// an internal error.
+func (engine *Engine) sendQueryError(query string, err error) {
+	var sqlErr *sqlError
+	if !errors.As(err, &sqlErr) {
+		fmt.Printf("Error answering query %q: %v\n", query, err)
+		sqlErr = &sqlError{Code: sqlStateInternalError, Message: "the game state could not be read, please try again"}
+	}
+	if engine.tx != nil {
+		engine.txFailed = true
+	}
+	engine.transport.Send(&pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                sqlErr.Code,
+		Message:             sqlErr.Message,
+		Detail:              sqlErr.Detail,
+		Hint:                sqlErr.Hint,
+		Position:            int32(sqlErr.Position),
+	})
+}
+
+// sendReadyForQuery ends a query, telling the client the server is ready for the next.
+func (engine *Engine) sendReadyForQuery() error {
+	engine.transport.Send(&pgproto3.ReadyForQuery{TxStatus: engine.txStatus()})
+	return engine.transport.Flush()
+}
+
+// txStatus is the transaction status ReadyForQuery reports: idle ('I'), in a
+// transaction block ('T'), or in one that has failed ('E').
+func (engine *Engine) txStatus() byte {
+	switch {
+	case engine.tx == nil:
+		return 'I'
+	case engine.txFailed:
+		return 'E'
+	default:
+		return 'T'
+	}
+}
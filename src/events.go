@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Kinds of GameEvent.
+const (
+	eventMoved           = "moved"
+	eventItemGained      = "item_gained"
+	eventItemLost        = "item_lost"
+	eventAttitudeChanged = "npc_attitude_changed"
+)
+
+// GameEvent is one change an action made to the player's world, sent to clients that
+// show the world beside the narrative.
+type GameEvent struct {
+	Kind       string `json:"kind"`
+	LocationID int    `json:"locationId,omitempty"`
+	ItemID     int    `json:"itemId,omitempty"`
+	NpcID      int    `json:"npcId,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Attitude   string `json:"attitude,omitempty"`
+	Previous   string `json:"previous,omitempty"`
+}
+
+// eventPublisher is implemented by transports whose clients want the events of each
+// action; psql only gets the narrative.
+type eventPublisher interface {
+	PublishEvents(events []GameEvent)
+}
+
+// worldSnapshot is the part of the world events are worked out from: where the player
+// is, what they carry, and how the NPCs they have met feel about them.
+type worldSnapshot struct {
+	LocationID   int
+	LocationName string
+	Items        map[int]string
+	NPCs         map[int]string
+	Attitudes    map[int]string
+}
+
+// act plays out a player's action like handleQuery, and publishes what it changed to
+// transports that want it.
+func (engine *Engine) act(ctx context.Context, action string) error {
+	publisher, ok := engine.transport.(eventPublisher)
+	if !ok {
+		return engine.handleQuery(ctx, action)
+	}
+	before, err := engine.snapshotWorld(ctx)
+	if err != nil {
+		fmt.Printf("Error reading world before action: %v\n", err)
+	}
+	if err := engine.handleQuery(ctx, action); err != nil {
+		return err
+	}
+	if before == nil {
+		return nil
+	}
+	after, err := engine.snapshotWorld(ctx)
+	if err != nil {
+		fmt.Printf("Error reading world after action: %v\n", err)
+		return nil
+	}
+	if events := diffSnapshots(before, after); len(events) > 0 {
+		publisher.PublishEvents(events)
+	}
+	return nil
+}
+
+// snapshotWorld reads the world as the player sees it now.
+func (engine *Engine) snapshotWorld(ctx context.Context) (*worldSnapshot, error) {
+	snapshot := &worldSnapshot{Items: map[int]string{}, NPCs: map[int]string{}, Attitudes: map[int]string{}}
+	err := engine.world().QueryRow(ctx, `
+		SELECT COALESCE(l.id, 0), COALESCE(l.name, '')
+		FROM players p
+		LEFT JOIN locations l ON l.id = p.current_location_id
+		WHERE p.id = $1
+	`, engine.playerID).Scan(&snapshot.LocationID, &snapshot.LocationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read player location: %w", err)
+	}
+
+	rows, err := engine.world().Query(ctx, `
+		SELECT i.id, i.name
+		FROM player_items pi
+		INNER JOIN items i ON i.id = pi.item_id
+		WHERE pi.player_id = $1
+	`, engine.playerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory: %w", err)
+	}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read inventory: %w", err)
+		}
+		snapshot.Items[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read inventory: %w", err)
+	}
+
+	// An NPC's attitude is the balance of the sentiments of everything that passed between them
+	rows, err = engine.world().Query(ctx, `
+		SELECT n.id, n.name, SUM(CASE i.sentiment WHEN 'positive' THEN 1 WHEN 'negative' THEN -1 ELSE 0 END)
+		FROM npc_player_interactions i
+		INNER JOIN npcs n ON n.id = i.npc_id
+		WHERE i.player_id = $1
+		GROUP BY n.id, n.name
+	`, engine.playerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read NPC attitudes: %w", err)
+	}
+	for rows.Next() {
+		var id, balance int
+		var name string
+		if err := rows.Scan(&id, &name, &balance); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read NPC attitudes: %w", err)
+		}
+		snapshot.NPCs[id] = name
+		snapshot.Attitudes[id] = attitude(balance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read NPC attitudes: %w", err)
+	}
+	return snapshot, nil
+}
+
+func attitude(balance int) string {
+	switch {
+	case balance > 0:
+		return "friendly"
+	case balance < 0:
+		return "hostile"
+	default:
+		return "neutral"
+	}
+}
+
+// diffSnapshots lists the changes from before to after: a move first, then items
+// gained and lost, then attitudes, each in ID order. An NPC met for the first time was
+// neutral before.
+func diffSnapshots(before, after *worldSnapshot) []GameEvent {
+	var events []GameEvent
+	if after.LocationID != before.LocationID && after.LocationID != 0 {
+		events = append(events, GameEvent{Kind: eventMoved, LocationID: after.LocationID, Name: after.LocationName})
+	}
+	for _, id := range slices.Sorted(maps.Keys(after.Items)) {
+		if _, held := before.Items[id]; !held {
+			events = append(events, GameEvent{Kind: eventItemGained, ItemID: id, Name: after.Items[id]})
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(before.Items)) {
+		if _, held := after.Items[id]; !held {
+			events = append(events, GameEvent{Kind: eventItemLost, ItemID: id, Name: before.Items[id]})
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(after.Attitudes)) {
+		previous, met := before.Attitudes[id]
+		if !met {
+			previous = attitude(0)
+		}
+		if after.Attitudes[id] != previous {
+			events = append(events, GameEvent{Kind: eventAttitudeChanged, NpcID: id, Name: after.NPCs[id], Attitude: after.Attitudes[id], Previous: previous})
+		}
+	}
+	return events
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// dbQuerier is satisfied by both the pool and a transaction.
+type dbQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// directionAliases maps what players type to the direction names stored on exits.
+var directionAliases = map[string]string{
+	"n": "north", "s": "south", "e": "east", "w": "west",
+	"ne": "northeast", "nw": "northwest", "se": "southeast", "sw": "southwest",
+	"u": "up", "d": "down", "upstairs": "up", "downstairs": "down",
+	"inside": "in", "outside": "out",
+	"north": "north", "south": "south", "east": "east", "west": "west",
+	"northeast": "northeast", "northwest": "northwest", "southeast": "southeast", "southwest": "southwest",
+	"up": "up", "down": "down", "in": "in", "out": "out",
+}
+
+// movementVerbs introduce a movement command, as in "go north" or "walk to the cellar".
+var movementVerbs = map[string]bool{
+	"go": true, "walk": true, "run": true, "head": true, "move": true, "climb": true, "travel": true, "enter": true,
+}
+
+// canonicalDirection normalises a direction, spelling out abbreviations like "n" and "u".
+func canonicalDirection(direction string) string {
+	direction = strings.ToLower(strings.Join(strings.Fields(direction), " "))
+	if alias, ok := directionAliases[direction]; ok {
+		return alias
+	}
+	return direction
+}
+
+// parseMovement recognises movement commands, returning where the player wants to go:
+// a direction, or the name of a place or exit. A bare word only counts as movement
+// when it is a known direction, so "north" moves but "dance" doesn't.
+func parseMovement(query string) (string, bool) {
+	words := strings.Fields(strings.ToLower(strings.Trim(query, " .!")))
+	if len(words) == 1 {
+		_, ok := directionAliases[words[0]]
+		return canonicalDirection(words[0]), ok
+	}
+	if len(words) < 2 || !movementVerbs[words[0]] {
+		return "", false
+	}
+	words = words[1:]
+	for len(words) > 1 && (words[0] == "to" || words[0] == "the" || words[0] == "through" || words[0] == "towards") {
+		words = words[1:]
+	}
+	return canonicalDirection(strings.Join(words, " ")), true
+}
+
+// exitInfo describes one exit out of a location.
+type exitInfo struct {
+	ID           int
+	Direction    string
+	ToID         int
+	ToName       string
+	Description  string
+	Locked       bool
+	Hidden       bool
+	RequiredItem string
+}
+
+// String renders the exit for the dungeon master's view of the world.
+func (exit exitInfo) String() string {
+	text := fmt.Sprintf("ID %d: %s to %s (ID %d)", exit.ID, exit.Direction, exit.ToName, exit.ToID)
+	if exit.Description != "" {
+		text += ": " + exit.Description
+	}
+	var flags []string
+	if exit.Locked {
+		flags = append(flags, "locked")
+	}
+	if exit.Hidden {
+		flags = append(flags, "hidden - the player hasn't found it")
+	}
+	if exit.RequiredItem != "" {
+		flags = append(flags, "needs "+exit.RequiredItem)
+	}
+	if len(flags) > 0 {
+		text += " [" + strings.Join(flags, ", ") + "]"
+	}
+	return text
+}
+
+// getExits lists the exits out of a location, leaving out hidden ones unless includeHidden.
+func getExits(ctx context.Context, q dbQuerier, locationID int, includeHidden bool) ([]exitInfo, error) {
+	rows, err := q.Query(ctx, `
+		SELECT e.id, e.direction, e.to_location_id, COALESCE(l.name, ''), e.description, e.locked, e.hidden, COALESCE(i.name, '')
+		FROM location_exits e
+		JOIN locations l ON l.id = e.to_location_id
+		LEFT JOIN items i ON i.id = e.required_item_id
+		WHERE e.from_location_id = $1 AND (NOT e.hidden OR $2)
+		ORDER BY e.id
+	`, locationID, includeHidden)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query exits of location %d: %w", locationID, err)
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[exitInfo])
+}
+
+// errNoExit means a movement command names no exit, so the dungeon master has to handle it.
+var errNoExit = errors.New("no exit that way")
+
+// followExit takes the exit matching target out of the player's location, if they can,
+// and returns what the player sees. target is a direction or the destination's name.
+func (engine *Engine) followExit(ctx context.Context, tx pgx.Tx, target string) ([]string, error) {
+	locationID, err := engine.lockPlayer(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var exitID, toID, requiredItemID int
+	var direction, requiredItem string
+	var locked, carrying bool
+	err = tx.QueryRow(ctx, `
+		SELECT e.id, e.to_location_id, e.direction, e.locked,
+			COALESCE(e.required_item_id, 0), COALESCE(i.name, ''),
+			EXISTS(SELECT 1 FROM player_items pi WHERE pi.player_id = $3 AND pi.item_id = e.required_item_id)
+		FROM location_exits e
+		JOIN locations l ON l.id = e.to_location_id
+		LEFT JOIN items i ON i.id = e.required_item_id
+		WHERE e.from_location_id = $1 AND NOT e.hidden
+		  AND (e.direction = $2 OR lower(l.name) = $2 OR lower(l.name) = 'the ' || $2)
+		ORDER BY e.direction = $2 DESC, e.id
+		LIMIT 1
+	`, locationID, target, engine.playerID).Scan(&exitID, &toID, &direction, &locked, &requiredItemID, &requiredItem, &carrying)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errNoExit
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up exit: %w", err)
+	}
+
+	var narrative []string
+	switch {
+	case locked && requiredItemID > 0 && carrying:
+		if _, err := tx.Exec(ctx, "UPDATE location_exits SET locked = FALSE WHERE id = $1", exitID); err != nil {
+			return nil, fmt.Errorf("failed to unlock exit %d: %w", exitID, err)
+		}
+		narrative = append(narrative, fmt.Sprintf("You unlock the way %s with the %s.", direction, requiredItem))
+	case locked:
+		return []string{fmt.Sprintf("The way %s is locked.", direction)}, nil
+	case requiredItemID > 0 && !carrying:
+		return []string{fmt.Sprintf("You can't go %s without the %s.", direction, requiredItem)}, nil
+	}
+
+	if err := engine.movePlayer(ctx, tx, toID); err != nil {
+		return nil, err
+	}
+	arrival, err := describeLocation(ctx, tx, toID)
+	if err != nil {
+		return nil, err
+	}
+	narrative = append(narrative, fmt.Sprintf("You go %s.", direction))
+	return append(narrative, arrival...), nil
+}
+
+// describeLocation is what a player sees on arriving somewhere: the place, what is
+// lying about, who is there and the ways out.
+func describeLocation(ctx context.Context, q dbQuerier, locationID int) ([]string, error) {
+	var name, description, items, npcs string
+	err := q.QueryRow(ctx, `
+		SELECT COALESCE(l.name, ''), COALESCE(l.description, ''),
+			COALESCE((SELECT string_agg(i.name, ', ' ORDER BY i.id) FROM items i WHERE i.location_id = l.id), ''),
+			COALESCE((SELECT string_agg(n.name, ', ' ORDER BY n.id) FROM npcs n WHERE n.location_id = l.id), '')
+		FROM locations l WHERE l.id = $1
+	`, locationID).Scan(&name, &description, &items, &npcs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe location %d: %w", locationID, err)
+	}
+
+	paragraphs := []string{name, description}
+	if items != "" {
+		paragraphs = append(paragraphs, fmt.Sprintf("You see: %s.", items))
+	}
+	if npcs != "" {
+		paragraphs = append(paragraphs, fmt.Sprintf("Here: %s.", npcs))
+	}
+	exits, err := getExits(ctx, q, locationID, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(exits) > 0 {
+		directions := make([]string, len(exits))
+		for i, exit := range exits {
+			directions[i] = exit.Direction
+		}
+		paragraphs = append(paragraphs, fmt.Sprintf("Exits: %s.", strings.Join(directions, ", ")))
+	}
+	return paragraphs, nil
+}
+
+// applyExitUpdates creates, unlocks and reveals exits as the LLM asked. Locations can be
+// given by name when they were created this turn (newLocationIDs); exits starting
+// nowhere in particular start at the player's current location.
+func (engine *Engine) applyExitUpdates(ctx context.Context, tx pgx.Tx, response *GameResponse, newLocationIDs map[string]int) error {
+	var currentLocationID int
+	err := tx.QueryRow(ctx, "SELECT COALESCE(current_location_id, 0) FROM players WHERE id = $1", engine.playerID).Scan(&currentLocationID)
+	if err != nil {
+		return fmt.Errorf("failed to get player location: %w", err)
+	}
+
+	for _, exit := range response.ExitsToAdd {
+		fromID := exit.FromLocationID
+		if fromID == 0 {
+			fromID = currentLocationID
+		}
+		toID := exit.ToLocationID
+		if toID == 0 && exit.ToLocationName != "" {
+			toID = newLocationIDs[strings.ToLower(exit.ToLocationName)]
+			if toID == 0 {
+				err := tx.QueryRow(ctx, "SELECT id FROM locations WHERE LOWER(name) = LOWER($1) LIMIT 1", exit.ToLocationName).Scan(&toID)
+				if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+					return fmt.Errorf("failed to look up location %q: %w", exit.ToLocationName, err)
+				}
+			}
+		}
+		direction := canonicalDirection(exit.Direction)
+
+		from, err := existingLocation(ctx, tx, fromID)
+		if err != nil {
+			return err
+		}
+		to, err := existingLocation(ctx, tx, toID)
+		if err != nil {
+			return err
+		}
+		if from == nil || to == nil || direction == "" || fromID == toID {
+			fmt.Printf("Warning: skipping exit %q from %d to %d (%q)\n", direction, fromID, toID, exit.ToLocationName)
+			continue
+		}
+
+		var requiredItemID interface{}
+		if exit.RequiredItemID > 0 {
+			requiredItemID = exit.RequiredItemID
+		}
+		if err := upsertExit(ctx, tx, fromID, toID, direction, exit.Description, exit.Locked, exit.Hidden, requiredItemID); err != nil {
+			return err
+		}
+		if back := canonicalDirection(exit.ReturnDirection); back != "" {
+			// The way back shares the lock: a door is locked from both sides
+			if err := upsertExit(ctx, tx, toID, fromID, back, exit.Description, exit.Locked, exit.Hidden, requiredItemID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, exitID := range response.ExitsToUnlock {
+		if _, err := tx.Exec(ctx, "UPDATE location_exits SET locked = FALSE WHERE id = $1", exitID); err != nil {
+			return fmt.Errorf("failed to unlock exit %d: %w", exitID, err)
+		}
+		fmt.Printf("Unlocked exit %d\n", exitID)
+	}
+	for _, exitID := range response.ExitsToReveal {
+		if _, err := tx.Exec(ctx, "UPDATE location_exits SET hidden = FALSE WHERE id = $1", exitID); err != nil {
+			return fmt.Errorf("failed to reveal exit %d: %w", exitID, err)
+		}
+		fmt.Printf("Revealed exit %d\n", exitID)
+	}
+	return nil
+}
+
+func upsertExit(ctx context.Context, tx pgx.Tx, fromID, toID int, direction, description string, locked, hidden bool, requiredItemID interface{}) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO location_exits (from_location_id, to_location_id, direction, description, locked, hidden, required_item_id)
+		VALUES ($1, $2, $3, $4, $5, $6, CASE WHEN EXISTS(SELECT 1 FROM items WHERE id = $7) THEN $7::int ELSE NULL END)
+		ON CONFLICT (from_location_id, direction) DO UPDATE SET
+			to_location_id = EXCLUDED.to_location_id,
+			description = EXCLUDED.description,
+			locked = EXCLUDED.locked,
+			hidden = EXCLUDED.hidden,
+			required_item_id = EXCLUDED.required_item_id`,
+		fromID, toID, direction, description, locked, hidden, requiredItemID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add exit %s from %d: %w", direction, fromID, err)
+	}
+	fmt.Printf("Added exit %s from location %d to %d\n", direction, fromID, toID)
+	return nil
+}
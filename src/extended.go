@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// SQLSTATE codes of the extended query protocol's errors.
+const (
+	sqlStateProtocolViolation    = "08P01"
+	sqlStateInvalidStatementName = "26000"
+	sqlStateInvalidCursorName    = "34000"
+	sqlStateDuplicateStatement   = "42P05"
+	sqlStateDuplicateCursor      = "42P03"
+	sqlStateInvalidBinaryFormat  = "22P03"
+)
+
+// preparedStatement is a query parsed with Parse. SQL queries are planned when parsed,
+// so their columns and parameter types are known; anything else is a player action,
+// which returns no rows and whose parameters are text spliced into the action.
+type preparedStatement struct {
+	Query      string
+	ParamTypes []uint32
+	Columns    []sqlColumn // nil when the statement returns no rows
+	sql        bool
+}
+
+// portal is a prepared statement bound to parameter values with Bind. A SQL portal's
+// rows are fetched by its first Execute and sent over as many as the client asks for.
+type portal struct {
+	statement *preparedStatement
+	params    *sqlParams
+	formats   []int16 // result format codes; see formatCode
+	result    *resultSet
+	sent      int
+}
+
+// handleExtendedQuery handles a message of the extended query protocol, used by most
+// drivers: Parse, Bind, Describe, Execute, Close or Flush. After an error, messages are
+// skipped until the client's Sync (see Run).
+func (engine *Engine) handleExtendedQuery(msg pgproto3.FrontendMessage) error {
+	switch m := msg.(type) {
+	case *pgproto3.Parse:
+		engine.handleParse(m)
+	case *pgproto3.Bind:
+		engine.handleBind(m)
+	case *pgproto3.Describe:
+		engine.handleDescribe(m)
+	case *pgproto3.Execute:
+		engine.handleExecute(m)
+	case *pgproto3.Close:
+		if m.ObjectType == 'S' {
+			delete(engine.statements, m.Name)
+		} else {
+			delete(engine.portals, m.Name)
+		}
+		engine.transport.Send(&pgproto3.CloseComplete{})
+	case *pgproto3.Flush:
+		return engine.transport.Flush()
+	}
+	return nil
+}
+
+// failExtendedQuery reports an error in an extended query, whose remaining messages are
+// then skipped until Sync.
+func (engine *Engine) failExtendedQuery(query string, err error) {
+	engine.sendQueryError(query, err)
+	engine.skipTillSync = true
+}
+
+func (engine *Engine) handleParse(m *pgproto3.Parse) {
+	if _, exists := engine.statements[m.Name]; exists && m.Name != "" {
+		engine.failExtendedQuery(m.Query, newSQLError(sqlStateDuplicateStatement, 0, "prepared statement \"%s\" already exists", m.Name))
+		return
+	}
+	if err := engine.checkTransaction(m.Query); err != nil {
+		engine.failExtendedQuery(m.Query, err)
+		return
+	}
+	if len(splitStatements(m.Query)) > 1 {
+		engine.failExtendedQuery(m.Query, newSQLError(sqlStateSyntaxError, 0, "cannot insert multiple commands into a prepared statement"))
+		return
+	}
+	statement := &preparedStatement{Query: m.Query, sql: isSQLQuery(m.Query)}
+	_, count := substituteParams(m.Query, nil)
+	statement.ParamTypes = make([]uint32, max(count, len(m.ParameterOIDs)))
+	copy(statement.ParamTypes, m.ParameterOIDs)
+	for _, oid := range statement.ParamTypes {
+		if _, ok := evalType(oid); !ok {
+			engine.failExtendedQuery(m.Query, newSQLError(sqlStateNotSupported, 0, "parameters of type %d are not supported", oid))
+			return
+		}
+	}
+
+	if statement.sql {
+		// Planning the query infers the types of its untyped parameters
+		params := &sqlParams{Values: make([]any, len(statement.ParamTypes)), Types: statement.ParamTypes}
+		columns, err := engine.describeQuery(m.Query, params)
+		if err != nil {
+			engine.failExtendedQuery(m.Query, err)
+			return
+		}
+		statement.Columns = columns
+	}
+	// Whatever is still untyped is text, as PostgreSQL resolves unknown-type literals
+	for i, oid := range statement.ParamTypes {
+		if oid == 0 || oid == oidUnknown {
+			statement.ParamTypes[i] = oidText
+		}
+	}
+	engine.statements[m.Name] = statement
+	engine.transport.Send(&pgproto3.ParseComplete{})
+}
+
+func (engine *Engine) handleBind(m *pgproto3.Bind) {
+	statement, ok := engine.statements[m.PreparedStatement]
+	if !ok {
+		engine.failExtendedQuery("", newSQLError(sqlStateInvalidStatementName, 0, "prepared statement \"%s\" does not exist", m.PreparedStatement))
+		return
+	}
+	if err := engine.checkTransaction(statement.Query); err != nil {
+		engine.failExtendedQuery(statement.Query, err)
+		return
+	}
+	if _, exists := engine.portals[m.DestinationPortal]; exists && m.DestinationPortal != "" {
+		engine.failExtendedQuery(statement.Query, newSQLError(sqlStateDuplicateCursor, 0, "cursor \"%s\" already exists", m.DestinationPortal))
+		return
+	}
+	if len(m.Parameters) != len(statement.ParamTypes) {
+		engine.failExtendedQuery(statement.Query, newSQLError(sqlStateProtocolViolation, 0,
+			"bind message supplies %d parameters, but prepared statement \"%s\" requires %d", len(m.Parameters), m.PreparedStatement, len(statement.ParamTypes)))
+		return
+	}
+	if err := checkFormatCodes(m.ParameterFormatCodes, len(m.Parameters), "parameter formats", "parameters"); err != nil {
+		engine.failExtendedQuery(statement.Query, err)
+		return
+	}
+	if err := checkFormatCodes(m.ResultFormatCodes, len(statement.Columns), "result formats", "columns"); err != nil {
+		engine.failExtendedQuery(statement.Query, err)
+		return
+	}
+
+	params := &sqlParams{Values: make([]any, len(m.Parameters)), Types: slices.Clone(statement.ParamTypes)}
+	for i, value := range m.Parameters {
+		switch {
+		case value == nil:
+		case formatCode(m.ParameterFormatCodes, i) == pgproto3.BinaryFormat:
+			text, err := decodeBinary(value, params.Types[i])
+			if err != nil {
+				engine.failExtendedQuery(statement.Query, newSQLError(sqlStateInvalidBinaryFormat, 0, "incorrect binary data format in bind parameter %d", i+1))
+				return
+			}
+			params.Values[i] = text
+		default:
+			params.Values[i] = string(value)
+		}
+	}
+	if statement.sql {
+		// Values that don't fit their parameter's type are rejected now, as PostgreSQL does
+		if _, err := engine.describeQuery(statement.Query, params); err != nil {
+			engine.failExtendedQuery(statement.Query, err)
+			return
+		}
+	}
+
+	// The message is reused by the next Receive, so its slices are copied
+	engine.portals[m.DestinationPortal] = &portal{statement: statement, params: params, formats: slices.Clone(m.ResultFormatCodes)}
+	engine.transport.Send(&pgproto3.BindComplete{})
+}
+
+func (engine *Engine) handleDescribe(m *pgproto3.Describe) {
+	var columns []sqlColumn
+	var formats []int16
+	if m.ObjectType == 'S' {
+		statement, ok := engine.statements[m.Name]
+		if !ok {
+			engine.failExtendedQuery("", newSQLError(sqlStateInvalidStatementName, 0, "prepared statement \"%s\" does not exist", m.Name))
+			return
+		}
+		engine.transport.Send(&pgproto3.ParameterDescription{ParameterOIDs: statement.ParamTypes})
+		columns = statement.Columns
+	} else {
+		portal, ok := engine.portals[m.Name]
+		if !ok {
+			engine.failExtendedQuery("", newSQLError(sqlStateInvalidCursorName, 0, "portal \"%s\" does not exist", m.Name))
+			return
+		}
+		columns, formats = portal.statement.Columns, portal.formats
+	}
+	if columns == nil {
+		engine.transport.Send(&pgproto3.NoData{})
+		return
+	}
+	engine.transport.Send(rowDescription(columns, formats))
+}
+
+func (engine *Engine) handleExecute(m *pgproto3.Execute) {
+	portal, ok := engine.portals[m.Portal]
+	if !ok {
+		engine.failExtendedQuery("", newSQLError(sqlStateInvalidCursorName, 0, "portal \"%s\" does not exist", m.Portal))
+		return
+	}
+	statement := portal.statement
+	fmt.Printf("Received (extended): %s\n", statement.Query)
+
+	switch {
+	case strings.Trim(statement.Query, " \t\r\n;") == "":
+		engine.transport.Send(&pgproto3.EmptyQueryResponse{})
+	case isTransactionCommand(statement.Query) || engine.txFailed:
+		tag, err := engine.runTransactionCommand(statement.Query)
+		if err != nil {
+			engine.failExtendedQuery(statement.Query, err)
+			return
+		}
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+	case statement.sql:
+		if portal.result == nil {
+			ctx, done := engine.startQuery()
+			result, err := engine.runQuery(ctx, statement.Query, portal.params)
+			done()
+			if err != nil {
+				engine.failExtendedQuery(statement.Query, err)
+				return
+			}
+			portal.result = result
+		}
+		rows := portal.result.Rows[portal.sent:]
+		if m.MaxRows > 0 && len(rows) > int(m.MaxRows) {
+			rows = rows[:m.MaxRows]
+		}
+		for _, row := range rows {
+			engine.transport.Send(dataRow(statement.Columns, row, portal.formats))
+		}
+		portal.sent += len(rows)
+		if portal.sent < len(portal.result.Rows) {
+			engine.transport.Send(&pgproto3.PortalSuspended{})
+			return
+		}
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT " + strconv.Itoa(len(rows)))})
+	case isSetQuery(statement.Query):
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte("SET")})
+	default:
+		// The parameters are spliced into the action as plain text: "go $1" with "north"
+		action, _ := substituteParams(statement.Query, func(n int) string {
+			if v := portal.params.Values[n-1]; v != nil {
+				return v.(string)
+			}
+			return ""
+		})
+		ctx, done := engine.startQuery()
+		err := engine.act(ctx, playerAction(action))
+		done()
+		if err != nil {
+			engine.failExtendedQuery(statement.Query, err)
+			return
+		}
+		// An action returns no rows, like a DO block
+		engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte("DO")})
+	}
+}
+
+// resetUnnamed drops the unnamed statement and every portal, as a simple query or the
+// end of an extended one does.
+func (engine *Engine) resetUnnamed(statement bool) {
+	if statement {
+		delete(engine.statements, "")
+	}
+	clear(engine.portals)
+}
+
+// formatCode is the format of the i-th value given a Bind message's format codes: none
+// means all text, one applies to all values, otherwise there is one per value.
+func formatCode(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return pgproto3.TextFormat
+	case 1:
+		return formats[0]
+	default:
+		return formats[i]
+	}
+}
+
+func checkFormatCodes(formats []int16, count int, what, of string) error {
+	if len(formats) > 1 && len(formats) != count {
+		return newSQLError(sqlStateProtocolViolation, 0, "bind message has %d %s but %d %s", len(formats), what, count, of)
+	}
+	for _, format := range formats {
+		if format != pgproto3.TextFormat && format != pgproto3.BinaryFormat {
+			return newSQLError(sqlStateProtocolViolation, 0, "unsupported format code: %d", format)
+		}
+	}
+	return nil
+}
+
+// isSetQuery matches SET commands, which are accepted and ignored.
+func isSetQuery(query string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SET ")
+}
+
+// substituteParams replaces the $n placeholders of a query, outside quotes and
+// comments, with value(n), and returns the highest n. With a nil value it only counts
+// them. Quotes are found as splitStatements finds them, so the apostrophe of "the
+// captain's $1" doesn't hide the placeholder.
+func substituteParams(query string, value func(n int) string) (string, int) {
+	var out strings.Builder
+	highest := 0
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		if end := skipQuoted(runes, i); end > i {
+			out.WriteString(string(runes[i:end]))
+			i = end - 1
+			continue
+		}
+		r := runes[i]
+		if r == '$' && i+1 < len(runes) && runes[i+1] >= '0' && runes[i+1] <= '9' {
+			end := i + 1
+			for end < len(runes) && runes[end] >= '0' && runes[end] <= '9' {
+				end++
+			}
+			if n, err := strconv.Atoi(string(runes[i+1 : end])); err == nil && n > 0 {
+				highest = max(highest, n)
+				if value != nil {
+					out.WriteString(value(n))
+					i = end - 1
+					continue
+				}
+			}
+		}
+		out.WriteRune(r)
+	}
+	return out.String(), highest
+}
+
+// bindLiterals writes a statement's parameter values into its query as SQL literals.
+func bindLiterals(query string, params *sqlParams) string {
+	if params == nil {
+		return query
+	}
+	bound, _ := substituteParams(query, func(n int) string {
+		if n > len(params.Values) || params.Values[n-1] == nil {
+			return "NULL"
+		}
+		return "'" + strings.ReplaceAll(params.Values[n-1].(string), "'", "''") + "'"
+	})
+	return bound
+}
+
+// postgresEpoch is the zero of binary timestamps.
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// encodeBinary encodes a value of the given type in PostgreSQL's binary format. Types
+// with no binary encoding here are sent as text, which is their binary format anyway.
+func encodeBinary(v any, oid uint32) []byte {
+	cast, err := castValue(v, oid)
+	if err != nil {
+		return []byte(formatValue(v))
+	}
+	switch v := cast.(type) {
+	case bool:
+		if v {
+			return []byte{1}
+		}
+		return []byte{0}
+	case int64:
+		if oid == oidInt4 {
+			return binary.BigEndian.AppendUint32(nil, uint32(int32(v)))
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(v))
+	case float64:
+		return encodeNumeric(v)
+	case time.Time:
+		return binary.BigEndian.AppendUint64(nil, uint64(v.UnixMicro()-postgresEpoch.UnixMicro()))
+	}
+	return []byte(formatValue(v))
+}
+
+// decodeBinary decodes a binary-format parameter value of the given type to text.
+func decodeBinary(data []byte, oid uint32) (string, error) {
+	wrongSize := fmt.Errorf("invalid binary value of %d bytes for type %d", len(data), oid)
+	switch oid {
+	case oidBool:
+		if len(data) != 1 {
+			return "", wrongSize
+		}
+		return formatValue(data[0] != 0), nil
+	case oidInt2, oidInt4, oidInt8:
+		switch len(data) {
+		case 2:
+			return strconv.Itoa(int(int16(binary.BigEndian.Uint16(data)))), nil
+		case 4:
+			return strconv.Itoa(int(int32(binary.BigEndian.Uint32(data)))), nil
+		case 8:
+			return strconv.FormatInt(int64(binary.BigEndian.Uint64(data)), 10), nil
+		}
+		return "", wrongSize
+	case oidFloat4:
+		if len(data) != 4 {
+			return "", wrongSize
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(data))), 'g', -1, 32), nil
+	case oidFloat8:
+		if len(data) != 8 {
+			return "", wrongSize
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(data)), 'g', -1, 64), nil
+	case oidNumeric:
+		return decodeNumeric(data)
+	case oidTimestamp, oidTimestamptz:
+		if len(data) != 8 {
+			return "", wrongSize
+		}
+		micros := int64(binary.BigEndian.Uint64(data))
+		return formatValue(time.UnixMicro(postgresEpoch.UnixMicro() + micros).UTC()), nil
+	}
+	return string(data), nil
+}
+
+// Signs of binary numerics.
+const (
+	numericPositive    = 0x0000
+	numericNegative    = 0x4000
+	numericNaN         = 0xC000
+	numericInfinity    = 0xD000
+	numericNegInfinity = 0xF000
+)
+
+// encodeNumeric encodes a number as a binary numeric: base-10000 digits, the weight of
+// the first digit, a sign and the number of decimal places.
+func encodeNumeric(f float64) []byte {
+	sign := uint16(numericPositive)
+	switch {
+	case math.IsNaN(f):
+		sign = numericNaN
+	case math.IsInf(f, 1):
+		sign = numericInfinity
+	case math.IsInf(f, -1):
+		sign = numericNegInfinity
+	case f < 0:
+		sign = numericNegative
+	}
+	var digits []uint16
+	weight, scale := 0, 0
+	if sign == numericPositive || sign == numericNegative {
+		whole, fraction, _ := strings.Cut(strconv.FormatFloat(math.Abs(f), 'f', -1, 64), ".")
+		scale = len(fraction)
+		whole = strings.Repeat("0", (4-len(whole)%4)%4) + whole
+		fraction += strings.Repeat("0", (4-len(fraction)%4)%4)
+		all := whole + fraction
+		for i := 0; i < len(all); i += 4 {
+			n, _ := strconv.Atoi(all[i : i+4])
+			digits = append(digits, uint16(n))
+		}
+		weight = len(whole)/4 - 1
+		for len(digits) > 0 && digits[0] == 0 {
+			digits = digits[1:]
+			weight--
+		}
+		for len(digits) > 0 && digits[len(digits)-1] == 0 {
+			digits = digits[:len(digits)-1]
+		}
+		if len(digits) == 0 {
+			weight = 0
+		}
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(digits)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(int16(weight)))
+	buf = binary.BigEndian.AppendUint16(buf, sign)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(scale))
+	for _, digit := range digits {
+		buf = binary.BigEndian.AppendUint16(buf, digit)
+	}
+	return buf
+}
+
+// decodeNumeric decodes a binary numeric to its text form.
+func decodeNumeric(data []byte) (string, error) {
+	if len(data) < 8 {
+		return "", fmt.Errorf("invalid binary numeric of %d bytes", len(data))
+	}
+	count := int(binary.BigEndian.Uint16(data))
+	weight := int(int16(binary.BigEndian.Uint16(data[2:])))
+	sign := binary.BigEndian.Uint16(data[4:])
+	scale := int(binary.BigEndian.Uint16(data[6:]))
+	if len(data) != 8+2*count {
+		return "", fmt.Errorf("invalid binary numeric of %d bytes for %d digits", len(data), count)
+	}
+	switch sign {
+	case numericNaN:
+		return "NaN", nil
+	case numericInfinity:
+		return "Infinity", nil
+	case numericNegInfinity:
+		return "-Infinity", nil
+	}
+	digit := func(i int) int {
+		if i < 0 || i >= count {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(data[8+2*i:]))
+	}
+
+	var text strings.Builder
+	if sign == numericNegative {
+		text.WriteByte('-')
+	}
+	if weight < 0 {
+		text.WriteByte('0')
+	}
+	for i := 0; i <= weight; i++ {
+		if i == 0 {
+			text.WriteString(strconv.Itoa(digit(i)))
+		} else {
+			fmt.Fprintf(&text, "%04d", digit(i))
+		}
+	}
+	if scale > 0 {
+		var fraction strings.Builder
+		for i := weight + 1; fraction.Len() < scale; i++ {
+			fmt.Fprintf(&fraction, "%04d", digit(i))
+		}
+		text.WriteByte('.')
+		text.WriteString(fraction.String()[:scale])
+	}
+	return text.String(), nil
+}
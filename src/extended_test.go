@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSubstituteParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		highest int
+	}{
+		{"no placeholders", "look around", "look around", 0},
+		{"placeholders", "give $1 to $2", "give <1> to <2>", 2},
+		{"highest, not count", "select $3, $1", "select <3>, <1>", 3},
+		{"repeated", "$1 and $1", "<1> and <1>", 1},
+		{"multi-digit", "$10", "<10>", 10},
+		{"zero isn't a placeholder", "$0", "$0", 0},
+		{"dollar without digits", "pay $ 5", "pay $ 5", 0},
+		{"inside a string", "say '$1' to $2", "say '$1' to <2>", 2},
+		{"inside a quoted identifier", `select "$1", $2`, `select "$1", <2>`, 2},
+		{"after an apostrophe in a word", "take the captain's $1", "take the captain's <1>", 1},
+		{"after an unclosed quote", "it's $1", "it's <1>", 1},
+		{"doubled quotes", "select 'it''s $1', $2", "select 'it''s $1', <2>", 2},
+		{"escape string", `select E'\' $1', $2`, `select E'\' $1', <2>`, 2},
+		{"line comment", "select $1 -- $2\n, $3", "select <1> -- $2\n, <3>", 3},
+		{"block comment", "select /* $1 */ $2", "select /* $1 */ <2>", 2},
+		{"dollar quotes", "select $$ $1 $$, $tag$ $2 $tag$, $3", "select $$ $1 $$, $tag$ $2 $tag$, <3>", 3},
+		{"multibyte text", "donne le café à $1", "donne le café à <1>", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, highest := substituteParams(tt.query, func(n int) string { return "<" + strconv.Itoa(n) + ">" })
+			if got != tt.want || highest != tt.highest {
+				t.Errorf("substituteParams(%q) = %q, %d, want %q, %d", tt.query, got, highest, tt.want, tt.highest)
+			}
+			if query, counted := substituteParams(tt.query, nil); query != tt.query || counted != tt.highest {
+				t.Errorf("substituteParams(%q, nil) = %q, %d, want the query unchanged and %d", tt.query, query, counted, tt.highest)
+			}
+		})
+	}
+}
+
+func TestBindLiterals(t *testing.T) {
+	params := &sqlParams{Values: []any{"the captain's hat", nil}}
+	got := bindLiterals("give $1 to $2, not '$1'", params)
+	if want := "give 'the captain''s hat' to NULL, not '$1'"; got != want {
+		t.Errorf("bindLiterals = %q, want %q", got, want)
+	}
+}
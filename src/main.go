@@ -1,16 +1,81 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"expvar"
 	"fmt"
-	"github.com/jackc/pgx/v5/pgproto3"
 	"log"
 	"net"
 	"net/http"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func main() {
+	// Only the database settings are read before `migrate`, which needs nothing else
+	dbConfig, err := LoadDBConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	// One pool serves every connection; its size caps our share of max_connections
+	poolConfig, err := pgxpool.ParseConfig(dbConfig.DatabaseURL)
+	if err != nil {
+		log.Fatalf("invalid DATABASE_URL: %v", err)
+	}
+	poolConfig.MaxConns = dbConfig.DBMaxConns
+	poolConfig.MinConns = dbConfig.DBMinConns
+	db, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	// `server migrate up|down|status` manages the schema without accepting connections
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		code := runMigrateCommand(context.Background(), db, os.Args[2:])
+		db.Close()
+		os.Exit(code)
+	}
+
+	config, err := LoadConfig(dbConfig)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	if err := initDatabase(context.Background(), db, config.DBAutoMigrate); err != nil {
+		log.Fatalf("failed to initialize database: %v", err)
+	}
+
+	narrator, err := newNarrator(config)
+	if err != nil {
+		log.Fatalf("failed to set up %s narrator: %v", config.LLMProvider, err)
+	}
+	log.Printf("Dungeon master: %s %s", config.LLMProvider, config.LLMModel)
+
+	sessions, err := newWSSessions(config)
+	if err != nil {
+		log.Fatalf("failed to set up web sessions: %v", err)
+	}
+	tts, err := newTTSService(config)
+	if err != nil {
+		log.Fatalf("failed to set up text-to-speech: %v", err)
+	}
+	server := &Server{config: config, db: db, narrator: narrator, sessions: sessions, tts: tts}
+	if config.TLSMode != tlsModeDisable {
+		certs, err := newCertificateStore(config)
+		if err != nil {
+			log.Fatalf("failed to set up TLS: %v", err)
+		}
+		server.tlsConfig = certs.TLSConfig()
+	}
+
 	go func() {
-		http.HandleFunc("/healthz/ready", func(w http.ResponseWriter, r *http.Request) {
+		// Its own mux: the default one has expvar's /debug/vars, which isn't for players
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz/ready", func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 			_, err := w.Write([]byte("OK"))
 			if err != nil {
@@ -21,15 +86,26 @@ func main() {
 
 		addr := "0.0.0.0:80"
 		log.Printf("HTTP %s\n", addr)
-		err := http.ListenAndServe(addr, nil)
+		err := http.ListenAndServe(addr, mux)
 		if err != nil {
 			fmt.Printf("error listening to healthcheck: %v", err)
 			return
 		}
 	}()
 
-	// WebSocket server (same container, connects to localhost:5432)
-	go StartWebSocketServer("0.0.0.0:8080")
+	if config.MetricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/debug/vars", expvar.Handler())
+			log.Printf("Metrics %s", config.MetricsAddr)
+			if err := http.ListenAndServe(config.MetricsAddr, mux); err != nil {
+				log.Printf("metrics server error: %v", err)
+			}
+		}()
+	}
+
+	// WebSocket server for the web client, whose sessions run in-process
+	go server.StartWebSocketServer("0.0.0.0:8080")
 
 	listenAddr := "0.0.0.0:5432"
 	ln, err := net.Listen("tcp", listenAddr)
@@ -44,26 +120,34 @@ func main() {
 			log.Printf("accept error: %v", err)
 			continue
 		}
-		go handleConnection(conn)
+		go server.handleConnection(conn)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+// Server holds the state shared by every psql connection.
+type Server struct {
+	config    *Config
+	tlsConfig *tls.Config
+	db        *pgxpool.Pool
+	narrator  Narrator
+	sessions  *wsSessions
+	tts       *ttsService
+}
+
+func (server *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	fmt.Printf("New connection from %s\n", conn.RemoteAddr())
-	backend := pgproto3.NewBackend(conn, conn)
-	backend, err := upgradeBackendToTls(*backend, conn)
+	backend, startup, err := negotiateStartup(conn, server.config, server.tlsConfig)
 	if err != nil {
-		fmt.Printf("Error upgrading to TLS: %v\n", err)
+		fmt.Printf("Error negotiating startup: %v\n", err)
 		return
 	}
-	_, err = backend.ReceiveStartupMessage()
-	if err != nil {
-		fmt.Printf("Error receiving startup message: %v\n", err)
+	if startup == nil {
+		// CancelRequest connections carry no session
 		return
 	}
 
-	engine := NewEngine(backend)
+	engine := NewEngine(backend, server.db, server.narrator, server.config, startup.Parameters, conn.RemoteAddr())
 	defer engine.Close()
 	err = engine.Run()
 	if err != nil {
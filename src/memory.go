@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// summaryTimeout bounds the background call that folds old turns into the story so far.
+const summaryTimeout = 2 * time.Minute
+
+// storySummarySystem instructs the narrator when it is asked to summarise turns.
+const storySummarySystem = `You keep the record of a text adventure. Rewrite the story so far to include the new turns. Keep every fact the dungeon master may need later: places visited, items gained or lost, promises, debts, enemies and open quests. Write in the second person, past tense, as a few short paragraphs. Reply with the summary only.`
+
+// NarrationTurn is one earlier turn of the player's conversation with the dungeon master.
+type NarrationTurn struct {
+	ID        int
+	Action    string
+	Narrative string
+}
+
+// estimateTokens approximates how many tokens text costs, at about four characters a token.
+func estimateTokens(text string) int {
+	return len(text)/4 + 1
+}
+
+func turnTokens(turns []NarrationTurn) int {
+	total := 0
+	for _, turn := range turns {
+		total += estimateTokens(turn.Action) + estimateTokens(turn.Narrative)
+	}
+	return total
+}
+
+// recordTurn logs a completed turn, inside the same transaction as its state changes so
+// the log never mentions changes that were rolled back.
+func (engine *Engine) recordTurn(ctx context.Context, tx pgx.Tx, action string, response *GameResponse) error {
+	changes := *response
+	changes.DungeonMasterResponse = ""
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode turn changes: %w", err)
+	}
+	_, err = tx.Exec(ctx,
+		"INSERT INTO player_turns (player_id, action, narrative, changes) VALUES ($1, $2, $3, $4)",
+		engine.playerID, action, response.DungeonMasterResponse, changesJSON,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record turn: %w", err)
+	}
+	return nil
+}
+
+// loadMemory returns the player's story so far and the turns since it was written,
+// trimmed to the most recent MemoryTurns that fit in the token budget.
+func (engine *Engine) loadMemory(ctx context.Context) (string, []NarrationTurn, error) {
+	story, throughTurnID, err := engine.loadStory(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rows, err := engine.world().Query(ctx,
+		"SELECT id, action, narrative FROM player_turns WHERE player_id = $1 AND id > $2 ORDER BY id DESC LIMIT $3",
+		engine.playerID, throughTurnID, engine.config.MemoryTurns,
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load recent turns: %w", err)
+	}
+	turns, err := pgx.CollectRows(rows, pgx.RowToStructByPos[NarrationTurn])
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load recent turns: %w", err)
+	}
+	slices.Reverse(turns)
+
+	// Until the summary catches up, drop the oldest turns rather than overflow the budget
+	for len(turns) > 0 && turnTokens(turns) > engine.config.MemoryTokenBudget {
+		turns = turns[1:]
+	}
+	return story, turns, nil
+}
+
+func (engine *Engine) loadStory(ctx context.Context) (string, int, error) {
+	var story string
+	var throughTurnID int
+	err := engine.db.QueryRow(ctx,
+		"SELECT summary, through_turn_id FROM player_story WHERE player_id = $1",
+		engine.playerID,
+	).Scan(&story, &throughTurnID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", 0, fmt.Errorf("failed to load story so far: %w", err)
+	}
+	return story, throughTurnID, nil
+}
+
+// compactMemory folds the oldest unsummarised turns into the story so far once they no
+// longer fit in MemoryTurns or the token budget. It leaves half of each limit free, so
+// summarising happens every few turns rather than after every one.
+func (engine *Engine) compactMemory(ctx context.Context) error {
+	story, throughTurnID, err := engine.loadStory(ctx)
+	if err != nil {
+		return err
+	}
+	rows, err := engine.db.Query(ctx,
+		"SELECT id, action, narrative FROM player_turns WHERE player_id = $1 AND id > $2 ORDER BY id",
+		engine.playerID, throughTurnID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to load unsummarised turns: %w", err)
+	}
+	turns, err := pgx.CollectRows(rows, pgx.RowToStructByPos[NarrationTurn])
+	if err != nil {
+		return fmt.Errorf("failed to load unsummarised turns: %w", err)
+	}
+	if len(turns) <= engine.config.MemoryTurns && turnTokens(turns) <= engine.config.MemoryTokenBudget {
+		return nil
+	}
+
+	fold := 0
+	for fold < len(turns) && (len(turns)-fold > engine.config.MemoryTurns/2 || turnTokens(turns[fold:]) > engine.config.MemoryTokenBudget/2) {
+		fold++
+	}
+	summary, err := engine.narrator.Summarize(ctx, story, turns[:fold])
+	if err != nil {
+		return fmt.Errorf("failed to summarise turns: %w", err)
+	}
+
+	// Another session of the same player may have summarised first; keep whichever got there
+	_, err = engine.db.Exec(ctx, `
+		INSERT INTO player_story (player_id, summary, through_turn_id) VALUES ($1, $2, $3)
+		ON CONFLICT (player_id) DO UPDATE
+		SET summary = EXCLUDED.summary, through_turn_id = EXCLUDED.through_turn_id, updated_at = CURRENT_TIMESTAMP
+		WHERE player_story.through_turn_id = $4`,
+		engine.playerID, strings.TrimSpace(summary), turns[fold-1].ID, throughTurnID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save story so far: %w", err)
+	}
+	fmt.Printf("Summarised %d turns for player %d\n", fold, engine.playerID)
+	return nil
+}
+
+// compactMemoryInBackground runs compactMemory after a turn. Summarising takes another
+// LLM call, so the player isn't kept waiting for it. Turns in a transaction block
+// aren't summarised until COMMIT.
+func (engine *Engine) compactMemoryInBackground() {
+	if engine.tx != nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		defer cancel()
+		if err := engine.compactMemory(ctx); err != nil {
+			fmt.Printf("Error summarising story so far: %v\n", err)
+		}
+	}()
+}
+
+// summaryRequest is the user message asking for the story so far to be brought up to date.
+func summaryRequest(story string, turns []NarrationTurn) string {
+	var request strings.Builder
+	if story != "" {
+		fmt.Fprintf(&request, "# Story so far\n%s\n\n", story)
+	}
+	request.WriteString("# New turns\n")
+	for _, turn := range turns {
+		fmt.Fprintf(&request, "Player action: %s\nDungeon master: %s\n\n", turn.Action, turn.Narrative)
+	}
+	return request.String()
+}
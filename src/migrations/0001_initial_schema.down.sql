@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS npc_player_interactions;
+DROP TABLE IF EXISTS player_notes;
+DROP TABLE IF EXISTS player_items;
+DROP TABLE IF EXISTS npcs;
+DROP TABLE IF EXISTS items;
+DROP TABLE IF EXISTS players;
+DROP TABLE IF EXISTS locations;
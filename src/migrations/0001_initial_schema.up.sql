@@ -0,0 +1,51 @@
+-- The original schema. Written to also adopt databases created before migrations
+-- existed, so every statement is a no-op when the object is already there.
+CREATE TABLE IF NOT EXISTS locations (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255),
+    description TEXT
+);
+
+CREATE TABLE IF NOT EXISTS players (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255),
+    current_location_id INT REFERENCES locations(id) ON DELETE SET NULL
+);
+ALTER TABLE players ADD COLUMN IF NOT EXISTS current_location_id INT REFERENCES locations(id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS items (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255),
+    description TEXT,
+    location_id INT REFERENCES locations(id) ON DELETE SET NULL
+);
+ALTER TABLE items ALTER COLUMN location_id DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS npcs (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255),
+    description TEXT,
+    location_id INT REFERENCES locations(id) ON DELETE SET NULL
+);
+ALTER TABLE npcs ALTER COLUMN location_id DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS player_items (
+    id SERIAL PRIMARY KEY,
+    player_id INT REFERENCES players(id),
+    item_id INT REFERENCES items(id)
+);
+
+CREATE TABLE IF NOT EXISTS player_notes (
+    id SERIAL PRIMARY KEY,
+    player_id INT REFERENCES players(id),
+    note TEXT
+);
+
+CREATE TABLE IF NOT EXISTS npc_player_interactions (
+    id SERIAL PRIMARY KEY,
+    npc_id INT REFERENCES npcs(id) ON DELETE CASCADE,
+    player_id INT REFERENCES players(id) ON DELETE CASCADE,
+    interaction TEXT,
+    sentiment VARCHAR(20),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS player_credentials;
+DROP INDEX IF EXISTS players_username_key;
+ALTER TABLE players DROP COLUMN IF EXISTS username;
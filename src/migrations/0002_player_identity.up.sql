@@ -0,0 +1,17 @@
+-- Players are resolved by their login name (the StartupMessage "user") and
+-- authenticate against the secrets stored in player_credentials.
+ALTER TABLE players ADD COLUMN IF NOT EXISTS username VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS players_username_key ON players (username);
+
+-- Before per-connection identities everyone shared player 1 and connected as "postgres";
+-- hand that character to the postgres login so existing worlds keep their hero.
+UPDATE players SET username = 'postgres'
+WHERE id = 1 AND username IS NULL
+  AND NOT EXISTS (SELECT 1 FROM players WHERE username = 'postgres');
+
+CREATE TABLE IF NOT EXISTS player_credentials (
+    player_id INT PRIMARY KEY REFERENCES players(id) ON DELETE CASCADE,
+    scram_verifier TEXT NOT NULL,
+    md5_hash TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
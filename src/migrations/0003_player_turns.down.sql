@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS player_story;
+DROP TABLE IF EXISTS player_turns;
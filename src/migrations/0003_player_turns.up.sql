@@ -0,0 +1,19 @@
+-- Every completed turn is logged so the dungeon master can be reminded of recent
+-- events; older turns are folded into a per-player "story so far".
+CREATE TABLE IF NOT EXISTS player_turns (
+    id SERIAL PRIMARY KEY,
+    player_id INT NOT NULL REFERENCES players(id) ON DELETE CASCADE,
+    action TEXT NOT NULL,
+    narrative TEXT NOT NULL,
+    changes JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS player_turns_player_id_idx ON player_turns (player_id, id);
+
+CREATE TABLE IF NOT EXISTS player_story (
+    player_id INT PRIMARY KEY REFERENCES players(id) ON DELETE CASCADE,
+    summary TEXT NOT NULL,
+    -- the last player_turns id folded into summary
+    through_turn_id INT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,16 @@
+-- Exits connect locations, so moving around follows a map rather than the LLM's memory.
+-- Each exit is one-way; a passage that can be walked both ways is a pair of exits.
+CREATE TABLE IF NOT EXISTS location_exits (
+    id SERIAL PRIMARY KEY,
+    from_location_id INT NOT NULL REFERENCES locations(id) ON DELETE CASCADE,
+    to_location_id INT NOT NULL REFERENCES locations(id) ON DELETE CASCADE,
+    -- lower case; the compass points, up, down, in and out are spelled out in full
+    direction VARCHAR(64) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    locked BOOLEAN NOT NULL DEFAULT FALSE,
+    hidden BOOLEAN NOT NULL DEFAULT FALSE,
+    -- carrying this item lets the player through (unlocking the exit if it is locked)
+    required_item_id INT REFERENCES items(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (from_location_id, direction)
+);
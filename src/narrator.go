@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// LLM providers selectable with LLM_PROVIDER.
+const (
+	llmProviderAnthropic = "anthropic" // Anthropic Messages API
+	llmProviderOpenAI    = "openai"    // any OpenAI-compatible chat completions server (llama.cpp, Ollama, vLLM...)
+	llmProviderStub      = "stub"      // canned responses from a fixture file, no network
+)
+
+// narratorMaxTokens caps the length of one turn's reply.
+const narratorMaxTokens = 2048
+
+// errNoNarration is returned when a reply tells the player nothing, which makes the
+// turn unusable even if it carried state changes.
+var errNoNarration = errors.New("reply contained no narration")
+
+// Narrator plays the dungeon master: given the world state and the player's action it
+// tells the player what happens and decides how the world changes.
+type Narrator interface {
+	// Narrate runs one turn. The narrative is passed to onText as it is generated; the
+	// returned GameResponse holds the full narrative and every state change, and is only
+	// available once the turn is complete.
+	Narrate(ctx context.Context, request NarrationRequest, onText func(string)) (*GameResponse, error)
+	// Summarize folds turns into the story so far, returning the updated story.
+	Summarize(ctx context.Context, story string, turns []NarrationTurn) (string, error)
+}
+
+// NarrationRequest is the provider-neutral input for one turn.
+type NarrationRequest struct {
+	System  string          // instructions, the story so far and the current world state
+	History []NarrationTurn // the player's most recent turns, oldest first
+	Action  string          // what the player typed
+}
+
+// playerActionMessage is how a player's action is put to the narrator, now or in history.
+func playerActionMessage(action string) string {
+	return fmt.Sprintf("Player action: %s", action)
+}
+
+// LLMError is returned by a Narrator when its provider rejects a request, so the engine
+// can tell the player about quota and credential problems without knowing the provider.
+type LLMError struct {
+	Provider   string
+	StatusCode int
+	Err        error
+}
+
+func (e *LLMError) Error() string {
+	return fmt.Sprintf("%s request failed with status %d: %v", e.Provider, e.StatusCode, e.Err)
+}
+
+func (e *LLMError) Unwrap() error {
+	return e.Err
+}
+
+// newNarrator builds the Narrator selected by the configuration.
+func newNarrator(config *Config) (Narrator, error) {
+	switch config.LLMProvider {
+	case llmProviderAnthropic:
+		return newAnthropicNarrator(config), nil
+	case llmProviderOpenAI:
+		return newOpenAINarrator(config), nil
+	case llmProviderStub:
+		return newStubNarrator(config.LLMStubFixtures)
+	default:
+		return nil, fmt.Errorf("unsupported LLM_PROVIDER %q", config.LLMProvider)
+	}
+}
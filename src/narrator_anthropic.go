@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// anthropicNarrator runs turns against the Anthropic Messages API.
+type anthropicNarrator struct {
+	client anthropic.Client
+	model  string
+}
+
+func newAnthropicNarrator(config *Config) *anthropicNarrator {
+	if config.AnthropicAPIKey == "" {
+		fmt.Printf("Warning: ANTHROPIC_API_KEY not set\n")
+	}
+	return &anthropicNarrator{
+		client: anthropic.NewClient(option.WithAPIKey(config.AnthropicAPIKey)),
+		model:  config.LLMModel,
+	}
+}
+
+func (narrator *anthropicNarrator) Narrate(ctx context.Context, request NarrationRequest, onText func(string)) (*GameResponse, error) {
+	// Earlier turns are replayed as the conversation so far
+	var messages []anthropic.MessageParam
+	for _, turn := range request.History {
+		messages = append(messages,
+			anthropic.NewUserMessage(anthropic.NewTextBlock(playerActionMessage(turn.Action))),
+			anthropic.NewAssistantMessage(anthropic.NewTextBlock(turn.Narrative)),
+		)
+	}
+	messages = append(messages, anthropic.NewUserMessage(anthropic.NewTextBlock(playerActionMessage(request.Action))))
+
+	message, err := streamMessage(ctx, narrator.client, anthropic.MessageNewParams{
+		Model:     anthropic.Model(narrator.model),
+		MaxTokens: narratorMaxTokens,
+		System: []anthropic.TextBlockParam{
+			{Text: request.System},
+		},
+		Messages: messages,
+		Tools:    anthropicTools(),
+	}, onText)
+	if err != nil {
+		return nil, anthropicError(err)
+	}
+	return gameResponseFromMessage(message)
+}
+
+func (narrator *anthropicNarrator) Summarize(ctx context.Context, story string, turns []NarrationTurn) (string, error) {
+	message, err := narrator.client.Messages.New(ctx, anthropic.MessageNewParams{
+		Model:     anthropic.Model(narrator.model),
+		MaxTokens: narratorMaxTokens,
+		System: []anthropic.TextBlockParam{
+			{Text: storySummarySystem},
+		},
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock(summaryRequest(story, turns))),
+		},
+	})
+	if err != nil {
+		return "", anthropicError(err)
+	}
+
+	var summary strings.Builder
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			summary.WriteString(block.Text)
+		}
+	}
+	if strings.TrimSpace(summary.String()) == "" {
+		return "", fmt.Errorf("empty summary (stop reason %q)", message.StopReason)
+	}
+	return summary.String(), nil
+}
+
+// anthropicError wraps API errors as LLMError so the engine can explain them.
+func anthropicError(err error) error {
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		return &LLMError{Provider: "Anthropic", StatusCode: apiErr.StatusCode, Err: err}
+	}
+	return err
+}
+
+// streamMessage sends a Messages request using the streaming API, passing the reply's
+// prose to onText as it arrives. It returns the complete message once the stream ends,
+// so tool calls are only ever seen whole.
+func streamMessage(ctx context.Context, client anthropic.Client, params anthropic.MessageNewParams, onText func(string)) (*anthropic.Message, error) {
+	stream := client.Messages.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	message := &anthropic.Message{}
+	for stream.Next() {
+		event := stream.Current()
+		if err := message.Accumulate(event); err != nil {
+			return nil, fmt.Errorf("failed to accumulate stream event: %w", err)
+		}
+		if event.Type == "content_block_delta" && event.Delta.Type == "text_delta" {
+			onText(event.Delta.Text)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// anthropicTools converts gameTools into Anthropic tool definitions.
+func anthropicTools() []anthropic.ToolUnionParam {
+	tools := make([]anthropic.ToolUnionParam, 0, len(gameTools))
+	for _, tool := range gameTools {
+		schema := tool.InputSchema()
+		tools = append(tools, anthropic.ToolUnionParam{OfTool: &anthropic.ToolParam{
+			Name:        tool.Name,
+			Description: anthropic.String(tool.Description),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties:  schema["properties"],
+				Required:    tool.Required,
+				ExtraFields: map[string]any{"additionalProperties": false},
+			},
+		}})
+	}
+	return tools
+}
+
+// gameResponseFromMessage assembles a GameResponse from a Messages API reply: its prose
+// is the narrative and its tool calls are the state changes. Invalid calls are logged
+// and skipped; a reply with no narration at all is an error.
+func gameResponseFromMessage(message *anthropic.Message) (*GameResponse, error) {
+	response := &GameResponse{}
+	var text strings.Builder
+	for _, block := range message.Content {
+		switch block.Type {
+		case "tool_use":
+			toolUse := block.AsToolUse()
+			if err := applyToolCall(response, toolUse.Name, toolUse.Input); err != nil {
+				fmt.Printf("Ignoring invalid tool call: %v\n", err)
+			}
+		case "text":
+			text.WriteString(block.Text)
+		}
+	}
+
+	response.DungeonMasterResponse = strings.TrimSpace(text.String())
+	if response.DungeonMasterResponse == "" {
+		return nil, fmt.Errorf("%w (stop reason %q)", errNoNarration, message.StopReason)
+	}
+	return response, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// openAINarrator runs turns against an OpenAI-compatible chat completions endpoint,
+// which local model servers such as llama.cpp and Ollama expose.
+type openAINarrator struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+func newOpenAINarrator(config *Config) *openAINarrator {
+	return &openAINarrator{
+		baseURL: strings.TrimSuffix(config.OpenAIBaseURL, "/"),
+		apiKey:  config.OpenAIAPIKey,
+		model:   config.LLMModel,
+		client:  &http.Client{},
+	}
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIToolFunction `json:"function"`
+}
+
+type openAIToolFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+type openAIChatRequest struct {
+	Model     string          `json:"model"`
+	Messages  []openAIMessage `json:"messages"`
+	Tools     []openAITool    `json:"tools,omitempty"`
+	MaxTokens int             `json:"max_tokens"`
+	Stream    bool            `json:"stream"`
+}
+
+// openAIChunk is one server-sent event of a streamed chat completion.
+type openAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int `json:"index"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// openAITools converts gameTools into function definitions.
+func openAITools() []openAITool {
+	tools := make([]openAITool, 0, len(gameTools))
+	for _, tool := range gameTools {
+		tools = append(tools, openAITool{
+			Type: "function",
+			Function: openAIToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema(),
+			},
+		})
+	}
+	return tools
+}
+
+func (narrator *openAINarrator) Narrate(ctx context.Context, request NarrationRequest, onText func(string)) (*GameResponse, error) {
+	// Earlier turns are replayed as the conversation so far
+	messages := []openAIMessage{{Role: "system", Content: request.System}}
+	for _, turn := range request.History {
+		messages = append(messages,
+			openAIMessage{Role: "user", Content: playerActionMessage(turn.Action)},
+			openAIMessage{Role: "assistant", Content: turn.Narrative},
+		)
+	}
+	messages = append(messages, openAIMessage{Role: "user", Content: playerActionMessage(request.Action)})
+
+	httpResponse, err := narrator.post(ctx, openAIChatRequest{
+		Model:     narrator.model,
+		Messages:  messages,
+		Tools:     openAITools(),
+		MaxTokens: narratorMaxTokens,
+		Stream:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	// Tool call arguments arrive in fragments, keyed by the call's index in the reply
+	var text strings.Builder
+	var toolNames []string
+	var toolArguments []string
+
+	scanner := bufio.NewScanner(httpResponse.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode stream chunk: %w", err)
+		}
+		if chunk.Error != nil {
+			return nil, fmt.Errorf("stream error: %s", chunk.Error.Message)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				text.WriteString(choice.Delta.Content)
+				onText(choice.Delta.Content)
+			}
+			for _, call := range choice.Delta.ToolCalls {
+				for len(toolNames) <= call.Index {
+					toolNames = append(toolNames, "")
+					toolArguments = append(toolArguments, "")
+				}
+				toolNames[call.Index] += call.Function.Name
+				toolArguments[call.Index] += call.Function.Arguments
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chat stream: %w", err)
+	}
+
+	response := &GameResponse{DungeonMasterResponse: strings.TrimSpace(text.String())}
+	for i, name := range toolNames {
+		if err := applyToolCall(response, name, json.RawMessage(toolArguments[i])); err != nil {
+			fmt.Printf("Ignoring invalid tool call: %v\n", err)
+		}
+	}
+	if response.DungeonMasterResponse == "" {
+		return nil, errNoNarration
+	}
+	return response, nil
+}
+
+func (narrator *openAINarrator) Summarize(ctx context.Context, story string, turns []NarrationTurn) (string, error) {
+	httpResponse, err := narrator.post(ctx, openAIChatRequest{
+		Model: narrator.model,
+		Messages: []openAIMessage{
+			{Role: "system", Content: storySummarySystem},
+			{Role: "user", Content: summaryRequest(story, turns)},
+		},
+		MaxTokens: narratorMaxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer httpResponse.Body.Close()
+
+	var completion struct {
+		Choices []struct {
+			Message openAIMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(httpResponse.Body).Decode(&completion); err != nil {
+		return "", fmt.Errorf("failed to decode chat completion: %w", err)
+	}
+	if len(completion.Choices) == 0 || strings.TrimSpace(completion.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+// post sends a chat completion request, turning error statuses into LLMError.
+func (narrator *openAINarrator) post(ctx context.Context, request openAIChatRequest) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chat request: %w", err)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, narrator.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chat request: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if request.Stream {
+		httpRequest.Header.Set("Accept", "text/event-stream")
+	}
+	if narrator.apiKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+narrator.apiKey)
+	}
+
+	httpResponse, err := narrator.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		defer httpResponse.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+		return nil, &LLMError{
+			Provider:   "OpenAI-compatible",
+			StatusCode: httpResponse.StatusCode,
+			Err:        fmt.Errorf("%s", strings.TrimSpace(string(detail))),
+		}
+	}
+	return httpResponse, nil
+}
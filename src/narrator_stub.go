@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultStubFixtures is used when LLM_STUB_FIXTURES doesn't name a file. Its IDs match
+// the world seedDefaultData creates in an empty database.
+//
+//go:embed fixtures/stub_turns.json
+var defaultStubFixtures []byte
+
+// stubTurn is one fixture entry: the response to give when the player's action matches.
+type stubTurn struct {
+	Match    string       `json:"match"` // regular expression; empty matches every action
+	Response GameResponse `json:"response"`
+
+	pattern *regexp.Regexp
+}
+
+// stubNarrator answers every turn from a fixture file instead of a model, so the whole
+// game loop can run in CI or offline. The first turn whose pattern matches the action
+// wins, which keeps a given action's outcome the same on every run.
+type stubNarrator struct {
+	turns []stubTurn
+}
+
+func newStubNarrator(path string) (*stubNarrator, error) {
+	contents := defaultStubFixtures
+	if path != "" {
+		var err error
+		if contents, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read stub fixtures: %w", err)
+		}
+	}
+
+	var turns []stubTurn
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&turns); err != nil {
+		return nil, fmt.Errorf("failed to parse stub fixtures: %w", err)
+	}
+	for i := range turns {
+		pattern, err := regexp.Compile("(?i)" + turns[i].Match)
+		if err != nil {
+			return nil, fmt.Errorf("stub fixture %d: invalid match: %w", i, err)
+		}
+		turns[i].pattern = pattern
+		if turns[i].Response.DungeonMasterResponse == "" {
+			return nil, fmt.Errorf("stub fixture %d: %w", i, errNoNarration)
+		}
+	}
+	return &stubNarrator{turns: turns}, nil
+}
+
+func (narrator *stubNarrator) Narrate(ctx context.Context, request NarrationRequest, onText func(string)) (*GameResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, turn := range narrator.turns {
+		if turn.pattern.MatchString(request.Action) {
+			response := turn.Response
+			onText(response.DungeonMasterResponse)
+			return &response, nil
+		}
+	}
+	return nil, fmt.Errorf("no stub fixture matches %q", request.Action)
+}
+
+// Summarize lists the turns one line each, so the stub needs no model to keep a story.
+func (narrator *stubNarrator) Summarize(ctx context.Context, story string, turns []NarrationTurn) (string, error) {
+	lines := []string{}
+	if story != "" {
+		lines = append(lines, story)
+	}
+	for _, turn := range turns {
+		lines = append(lines, fmt.Sprintf("You tried %q. %s", turn.Action, turn.Narrative))
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// virtualTable is a read-only table of the game schema: part of the world as the
+// connected player sees it. Player SQL is only ever evaluated against these tables,
+// never run on the game database.
+type virtualTable struct {
+	Schema      string // "" for the game schema, "public"
+	Name        string
+	Description string
+	Columns     []sqlColumn
+	// Query loads the table's rows for the player $1, in Columns order
+	Query string
+	// catalogRows lists a system catalog's rows; see catalog.go
+	catalogRows func(session *sqlSession) []catalogRow
+}
+
+var virtualTables = []*virtualTable{
+	{
+		Name:        "inventory",
+		Description: "Items you are carrying",
+		Columns:     []sqlColumn{{"id", oidInt4}, {"name", oidText}, {"description", oidText}},
+		Query: `
+			SELECT i.id, i.name, i.description
+			FROM items i
+			JOIN player_items pi ON pi.item_id = i.id
+			WHERE pi.player_id = $1
+			ORDER BY i.id`,
+	},
+	{
+		Name:        "here",
+		Description: "Items lying where you are",
+		Columns:     []sqlColumn{{"id", oidInt4}, {"name", oidText}, {"description", oidText}},
+		Query: `
+			SELECT i.id, i.name, i.description
+			FROM items i
+			JOIN players p ON i.location_id = p.current_location_id
+			WHERE p.id = $1
+			ORDER BY i.id`,
+	},
+	{
+		Name:        "npcs_here",
+		Description: "Characters where you are, and how often you have dealt with them",
+		Columns:     []sqlColumn{{"id", oidInt4}, {"name", oidText}, {"description", oidText}, {"interactions", oidInt8}},
+		Query: `
+			SELECT n.id, n.name, n.description,
+				(SELECT count(*) FROM npc_player_interactions npi WHERE npi.npc_id = n.id AND npi.player_id = p.id)
+			FROM npcs n
+			JOIN players p ON n.location_id = p.current_location_id
+			WHERE p.id = $1
+			ORDER BY n.id`,
+	},
+	{
+		Name:        "exits",
+		Description: "The ways out of where you are",
+		Columns: []sqlColumn{
+			{"id", oidInt4}, {"direction", oidText}, {"destination", oidText}, {"destination_id", oidInt4},
+			{"description", oidText}, {"locked", oidBool}, {"requires", oidText},
+		},
+		Query: `
+			SELECT e.id, e.direction, l.name, e.to_location_id, e.description, e.locked, i.name
+			FROM location_exits e
+			JOIN players p ON e.from_location_id = p.current_location_id
+			JOIN locations l ON l.id = e.to_location_id
+			LEFT JOIN items i ON i.id = e.required_item_id
+			WHERE p.id = $1 AND NOT e.hidden
+			ORDER BY e.id`,
+	},
+	{
+		Name:        "journal",
+		Description: "Everything you have done, turn by turn",
+		Columns:     []sqlColumn{{"turn", oidInt4}, {"action", oidText}, {"narrative", oidText}, {"created_at", oidTimestamptz}},
+		// The columns are TIMESTAMP, in the server's time zone; AT TIME ZONE makes them the
+		// instants their timestamptz type promises
+		Query: `
+			SELECT id, action, narrative, created_at AT TIME ZONE current_setting('TimeZone')
+			FROM player_turns
+			WHERE player_id = $1
+			ORDER BY id`,
+	},
+}
+
+// lookupVirtualTable finds the table a FROM clause names. The game schema is "public";
+// unqualified names are looked for there and then in pg_catalog, as with PostgreSQL's
+// default search_path.
+func lookupVirtualTable(ref *tableRef) (*virtualTable, error) {
+	if ref.Schema == "" || ref.Schema == "public" {
+		for _, table := range virtualTables {
+			if table.Name == ref.Name {
+				return table, nil
+			}
+		}
+	}
+	for _, table := range catalogTables {
+		if table.Name == ref.Name && (ref.Schema == table.Schema || (ref.Schema == "" && table.Schema == "pg_catalog")) {
+			return table, nil
+		}
+	}
+	name := ref.Name
+	if ref.Schema != "" {
+		name = ref.Schema + "." + name
+	}
+	return nil, newSQLError(sqlStateUndefinedTable, ref.pos, "relation \"%s\" does not exist", name)
+}
+
+// selectQuery matches queries answered from the game schema rather than by the dungeon master.
+var selectQuery = regexp.MustCompile(`(?is)^\s*select\b`)
+
+func isSelectQuery(query string) bool {
+	return selectQuery.MatchString(query)
+}
+
+// isSQLQuery reports whether a query is answered as SQL: a SELECT, or SHOW of a setting.
+func isSQLQuery(query string) bool {
+	return isSelectQuery(query) || isShowQuery(query)
+}
+
+// sqlSession describes the connection to queries that ask about it, e.g. current_user.
+func (engine *Engine) sqlSession() *sqlSession {
+	database := engine.database
+	if database == "" {
+		database = engine.username
+	}
+	return &sqlSession{User: engine.username, Database: database, ApplicationName: engine.clientName, Now: time.Now()}
+}
+
+// runQuery answers a query isSQLQuery accepts. params are a prepared statement's, nil
+// for a simple query.
+func (engine *Engine) runQuery(ctx context.Context, query string, params *sqlParams) (*resultSet, error) {
+	return engine.answerQuery(ctx, query, params, true)
+}
+
+// describeQuery works out the columns a query isSQLQuery accepts returns, without
+// reading the game state. Parameters of unspecified type are given the types they are
+// used as.
+func (engine *Engine) describeQuery(query string, params *sqlParams) ([]sqlColumn, error) {
+	result, err := engine.answerQuery(context.Background(), query, params, false)
+	if err != nil {
+		return nil, err
+	}
+	return result.Columns, nil
+}
+
+// answerQuery runs a query, or with load unset only plans it, returning no rows.
+func (engine *Engine) answerQuery(ctx context.Context, query string, params *sqlParams, load bool) (*resultSet, error) {
+	session := engine.sqlSession()
+	if isShowQuery(query) {
+		return runShow(query, session), nil
+	}
+	result, err := engine.runSelect(ctx, query, session, params, load)
+	var sqlErr *sqlError
+	if errors.As(err, &sqlErr) && isCatalogQuery(query) {
+		// Clients' catalog queries go beyond what the evaluator supports
+		return answerCatalogQuery(bindLiterals(query, params), session), nil
+	}
+	return result, err
+}
+
+// runSelect evaluates a SELECT against the game schema for the connected player.
+func (engine *Engine) runSelect(ctx context.Context, query string, session *sqlSession, params *sqlParams, load bool) (*resultSet, error) {
+	stmt, err := parseSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planSelect(stmt, session, params)
+	if err != nil {
+		return nil, err
+	}
+	if !load {
+		return &resultSet{Columns: plan.Columns}, nil
+	}
+	var rows [][]any
+	switch {
+	case plan.Table == nil:
+	case plan.Table.catalogRows != nil:
+		rows = catalogTableRows(plan.Table, session)
+	default:
+		if rows, err = engine.loadVirtualTable(ctx, plan.Table); err != nil {
+			return nil, err
+		}
+	}
+	return plan.run(rows)
+}
+
+// loadVirtualTable reads a table's rows for the connected player.
+func (engine *Engine) loadVirtualTable(ctx context.Context, table *virtualTable) ([][]any, error) {
+	rows, err := engine.world().Query(ctx, table.Query, engine.playerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", table.Name, err)
+	}
+	defer rows.Close()
+
+	var result [][]any
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", table.Name, err)
+		}
+		// The evaluator only deals in int64 integers
+		for i, v := range values {
+			switch v := v.(type) {
+			case int32:
+				values[i] = int64(v)
+			case int16:
+				values[i] = int64(v)
+			}
+		}
+		result = append(result, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", table.Name, err)
+	}
+	return result, nil
+}
+
+// sendResultSet sends a query's rows, ending with its CommandComplete.
+func (engine *Engine) sendResultSet(result *resultSet) {
+	engine.transport.Send(rowDescription(result.Columns, nil))
+	for _, row := range result.Rows {
+		engine.transport.Send(dataRow(result.Columns, row, nil))
+	}
+	engine.transport.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT " + strconv.Itoa(len(result.Rows)))})
+}
+
+// rowDescription describes result columns sent in the given format codes (see formatCode).
+func rowDescription(columns []sqlColumn, formats []int16) *pgproto3.RowDescription {
+	fields := make([]pgproto3.FieldDescription, len(columns))
+	for i, column := range columns {
+		fields[i] = pgproto3.FieldDescription{
+			Name:         []byte(column.Name),
+			DataTypeOID:  column.Type,
+			DataTypeSize: typeSize(column.Type),
+			TypeModifier: -1,
+			Format:       formatCode(formats, i),
+		}
+	}
+	return &pgproto3.RowDescription{Fields: fields}
+}
+
+// dataRow encodes a result row in the given format codes.
+func dataRow(columns []sqlColumn, row []any, formats []int16) *pgproto3.DataRow {
+	values := make([][]byte, len(row))
+	for i, v := range row {
+		if v == nil {
+			continue
+		}
+		if formatCode(formats, i) == pgproto3.BinaryFormat {
+			values[i] = encodeBinary(v, columns[i].Type)
+		} else {
+			values[i] = []byte(formatValue(v))
+		}
+	}
+	return &pgproto3.DataRow{Values: values}
+}
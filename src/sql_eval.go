@@ -0,0 +1,1527 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type OIDs of the values the game schema returns.
+const (
+	oidBool        uint32 = 16
+	oidInt8        uint32 = 20
+	oidInt4        uint32 = 23
+	oidText        uint32 = 25
+	oidUnknown     uint32 = 705
+	oidTimestamptz uint32 = 1184
+	oidNumeric     uint32 = 1700
+)
+
+// OIDs of the other types clients may give parameters.
+const (
+	oidName      uint32 = 19
+	oidInt2      uint32 = 21
+	oidFloat4    uint32 = 700
+	oidFloat8    uint32 = 701
+	oidBpchar    uint32 = 1042
+	oidVarchar   uint32 = 1043
+	oidTimestamp uint32 = 1114
+)
+
+// typeNames are the SQL names of the types, as used in error messages.
+var typeNames = map[uint32]string{
+	oidBool: "boolean", oidInt8: "bigint", oidInt4: "integer", oidText: "text",
+	oidUnknown: "unknown", oidTimestamptz: "timestamp with time zone", oidNumeric: "numeric",
+}
+
+// shortTypeNames are the names PostgreSQL uses internally, as in pg_type.typname.
+var shortTypeNames = map[uint32]string{
+	oidBool: "bool", oidInt8: "int8", oidInt4: "int4", oidText: "text",
+	oidUnknown: "unknown", oidTimestamptz: "timestamptz", oidNumeric: "numeric",
+}
+
+// typeSize is the RowDescription data type size of a type; -1 means variable length.
+func typeSize(oid uint32) int16 {
+	switch oid {
+	case oidBool:
+		return 1
+	case oidInt4:
+		return 4
+	case oidInt8, oidTimestamptz:
+		return 8
+	default:
+		return -1
+	}
+}
+
+// typeCategory groups the types that can be compared with each other.
+func typeCategory(oid uint32) string {
+	switch oid {
+	case oidInt4, oidInt8, oidNumeric:
+		return "numeric"
+	case oidText, oidUnknown:
+		return "text"
+	case oidBool:
+		return "bool"
+	default:
+		return "timestamp"
+	}
+}
+
+// sqlColumn is a column of a virtual table or of a result set.
+type sqlColumn struct {
+	Name string
+	Type uint32
+}
+
+// resultSet is the answer to a SELECT. Values are nil (NULL), int64, float64, string,
+// bool or time.Time.
+type resultSet struct {
+	Columns []sqlColumn
+	Rows    [][]any
+}
+
+// sqlSession is what a query can find out about the connection it runs on.
+type sqlSession struct {
+	User            string
+	Database        string
+	ApplicationName string
+	Now             time.Time
+}
+
+// formatValue renders a value in PostgreSQL's text format.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999-07")
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// castValue converts a value to the given type, as ::type would.
+func castValue(v any, to uint32) (any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	invalid := func() error {
+		return newSQLError(sqlStateInvalidText, 0, "invalid input syntax for type %s: \"%s\"", typeNames[to], formatValue(v))
+	}
+	switch to {
+	case oidText, oidUnknown:
+		return formatValue(v), nil
+	case oidInt4, oidInt8:
+		switch v := v.(type) {
+		case int64:
+			return checkIntRange(v, to)
+		case float64:
+			// float64(math.MaxInt64) rounds up to 2^63, itself out of range
+			rounded := math.RoundToEven(v)
+			if math.IsNaN(rounded) || rounded < math.MinInt64 || rounded >= math.MaxInt64 {
+				return nil, errIntOutOfRange(to)
+			}
+			return checkIntRange(int64(rounded), to)
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if errors.Is(err, strconv.ErrRange) || (err == nil && to == oidInt4 && int64(int32(n)) != n) {
+				return nil, newSQLError(sqlStateOutOfRange, 0, "value \"%s\" is out of range for type %s", v, typeNames[to])
+			}
+			if err != nil {
+				return nil, invalid()
+			}
+			return n, nil
+		}
+	case oidNumeric:
+		switch v := v.(type) {
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, invalid()
+			}
+			return n, nil
+		}
+	case oidBool:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "t", "true", "y", "yes", "on", "1":
+				return true, nil
+			case "f", "false", "n", "no", "off", "0":
+				return false, nil
+			}
+			return nil, invalid()
+		}
+	case oidTimestamptz:
+		switch v := v.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999", "2006-01-02 15:04:05", "2006-01-02"} {
+				if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+					return t, nil
+				}
+			}
+			return nil, invalid()
+		}
+	}
+	return nil, newSQLError(sqlStateDatatypeMismatch, 0, "cannot cast type %s to %s", typeNames[valueType(v)], typeNames[to])
+}
+
+func valueType(v any) uint32 {
+	switch v.(type) {
+	case int64:
+		return oidInt8
+	case float64:
+		return oidNumeric
+	case bool:
+		return oidBool
+	case time.Time:
+		return oidTimestamptz
+	default:
+		return oidText
+	}
+}
+
+// compareValues orders two non-NULL values of comparable types.
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return compareOrdered(a, b)
+		case float64:
+			return compareOrdered(float64(a), b)
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return compareOrdered(a, float64(b))
+		case float64:
+			return compareOrdered(a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0
+			case b:
+				return -1
+			default:
+				return 1
+			}
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b)
+		}
+	}
+	return strings.Compare(formatValue(a), formatValue(b))
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// evalRow is what a compiled expression is evaluated against: a row of the table, or
+// for an aggregate query, the aggregate results.
+type evalRow struct {
+	values     []any
+	aggregates []any
+}
+
+// compiledExpr is an expression resolved against a table: its result type is known and
+// it can be evaluated without looking anything up.
+type compiledExpr struct {
+	Type     uint32
+	Name     string // the column name it gets in a result set
+	constant bool   // a literal, which may still be coerced to the type it is compared with
+	param    int    // for a parameter of unknown type, its number, so its type can be inferred
+	eval     func(row *evalRow) (any, error)
+}
+
+func constantExpr(value any, typ uint32) *compiledExpr {
+	return &compiledExpr{Type: typ, Name: "?column?", constant: true, eval: func(*evalRow) (any, error) { return value, nil }}
+}
+
+// aggregate is one aggregate function call of a query.
+type aggregate struct {
+	Name     string
+	Arg      *compiledExpr // nil for count(*)
+	Distinct bool
+	Extra    *compiledExpr // string_agg's delimiter
+}
+
+// sqlParams are the parameters of a prepared statement. Values are in text format, nil
+// for NULL; before binding they are all nil. Types are the parameters' OIDs, 0 where
+// the client left a type unspecified, in which case it is inferred from how the
+// parameter is used, like a quoted literal's.
+type sqlParams struct {
+	Values []any
+	Types  []uint32
+}
+
+// evalType maps a parameter type to the evaluator type its values take.
+func evalType(oid uint32) (uint32, bool) {
+	switch oid {
+	case 0, oidUnknown:
+		return oidUnknown, true
+	case oidBool, oidInt8, oidInt4, oidText, oidTimestamptz, oidNumeric:
+		return oid, true
+	case oidInt2:
+		return oidInt4, true
+	case oidFloat4, oidFloat8:
+		return oidNumeric, true
+	case oidName, oidBpchar, oidVarchar:
+		return oidText, true
+	case oidTimestamp:
+		return oidTimestamptz, true
+	}
+	return 0, false
+}
+
+// compileScope is what expressions are compiled against.
+type compileScope struct {
+	table       *virtualTable
+	alias       string // name the table is referred to by in the query
+	session     *sqlSession
+	params      *sqlParams
+	aggregates  *[]*aggregate // nil where aggregates aren't allowed (WHERE, LIMIT)
+	clause      string        // for error messages, e.g. "WHERE"
+	inAggregate bool
+	// firstColumn is the first column referenced outside an aggregate, which is an
+	// error once the query turns out to aggregate
+	firstColumn *columnExpr
+}
+
+func (scope *compileScope) compile(expr sqlExpr) (*compiledExpr, error) {
+	switch e := expr.(type) {
+	case literalExpr:
+		return constantExpr(e.Value, e.Type), nil
+
+	case columnExpr:
+		return scope.compileColumn(e)
+
+	case paramExpr:
+		return scope.compileParam(e)
+
+	case castExpr:
+		operand, err := scope.compile(e.Operand)
+		if err != nil {
+			return nil, err
+		}
+		if operand.param > 0 {
+			// $1::int makes the parameter an integer
+			scope.params.Types[operand.param-1] = e.Type
+		}
+		compiled := &compiledExpr{Type: e.Type, Name: operand.Name, eval: func(row *evalRow) (any, error) {
+			v, err := operand.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			return castValue(v, e.Type)
+		}}
+		if operand.constant {
+			// A cast literal is named after its type, like 'abc'::text is "text"
+			compiled.Name = shortTypeNames[e.Type]
+		}
+		return compiled, nil
+
+	case unaryExpr:
+		operand, err := scope.compile(e.Operand)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "not" {
+			if err := scope.coerce(operand, oidBool, "argument of NOT"); err != nil {
+				return nil, err
+			}
+			return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+				v, err := operand.eval(row)
+				if v == nil || err != nil {
+					return nil, err
+				}
+				return !v.(bool), nil
+			}}, nil
+		}
+		if err := scope.coerce(operand, oidNumeric, "operand of unary minus"); err != nil {
+			return nil, err
+		}
+		return &compiledExpr{Type: operand.Type, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			v, err := operand.eval(row)
+			switch v := v.(type) {
+			case int64:
+				if v == math.MinInt64 {
+					return nil, errBigintOutOfRange()
+				}
+				return checkIntRange(-v, operand.Type)
+			case float64:
+				return -v, err
+			}
+			return nil, err
+		}}, nil
+
+	case binaryExpr:
+		return scope.compileBinary(e)
+
+	case likeExpr:
+		operand, err := scope.compile(e.Operand)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := scope.compile(e.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if typeCategory(operand.Type) != "text" || typeCategory(pattern.Type) != "text" {
+			return nil, newSQLError(sqlStateUndefinedFunction, 0, "operator does not exist: %s ~~ %s", typeNames[operand.Type], typeNames[pattern.Type])
+		}
+		matcher := &patternCache{}
+		return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			v, p, err := evalPair(row, operand, pattern)
+			if v == nil || p == nil || err != nil {
+				return nil, err
+			}
+			re, err := matcher.get(likePattern(p.(string), e.Insensitive))
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(v.(string)) != e.Not, nil
+		}}, nil
+
+	case isExpr:
+		operand, err := scope.compile(e.Operand)
+		if err != nil {
+			return nil, err
+		}
+		if e.Value != nil {
+			if err := scope.coerce(operand, oidBool, "argument of IS "+strings.ToUpper(fmt.Sprint(e.Value))); err != nil {
+				return nil, err
+			}
+		}
+		return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			v, err := operand.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			return (v == e.Value) != e.Not, nil
+		}}, nil
+
+	case inExpr:
+		operand, err := scope.compile(e.Operand)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]*compiledExpr, len(e.List))
+		for i, item := range e.List {
+			if list[i], err = scope.compile(item); err != nil {
+				return nil, err
+			}
+			if err := scope.unify(operand, list[i], "IN"); err != nil {
+				return nil, err
+			}
+		}
+		return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			v, err := operand.eval(row)
+			if v == nil || err != nil {
+				return nil, err
+			}
+			var result any = false
+			for _, item := range list {
+				candidate, err := item.eval(row)
+				if err != nil {
+					return nil, err
+				}
+				if candidate == nil {
+					result = nil
+				} else if compareValues(v, candidate) == 0 {
+					return !e.Not, nil
+				}
+			}
+			if result == nil {
+				return nil, nil
+			}
+			return e.Not, nil
+		}}, nil
+
+	case betweenExpr:
+		low := binaryExpr{Op: ">=", Left: e.Operand, Right: e.Low}
+		high := binaryExpr{Op: "<=", Left: e.Operand, Right: e.High}
+		var between sqlExpr = binaryExpr{Op: "and", Left: low, Right: high}
+		if e.Not {
+			between = unaryExpr{Op: "not", Operand: between}
+		}
+		compiled, err := scope.compile(between)
+		if err != nil {
+			return nil, err
+		}
+		compiled.Name = "?column?"
+		return compiled, nil
+
+	case caseExpr:
+		return scope.compileCase(e)
+
+	case funcExpr:
+		if aggregateFunctions[e.Name] {
+			return scope.compileAggregate(e)
+		}
+		return scope.compileFunction(e)
+	}
+	return nil, fmt.Errorf("unexpected expression %T", expr)
+}
+
+func (scope *compileScope) compileParam(e paramExpr) (*compiledExpr, error) {
+	if scope.params == nil || e.Index > len(scope.params.Values) {
+		return nil, newSQLError(sqlStateUndefinedParam, e.pos, "there is no parameter $%d", e.Index)
+	}
+	typ, _ := evalType(scope.params.Types[e.Index-1])
+	value, err := castValue(scope.params.Values[e.Index-1], typ)
+	if err != nil {
+		return nil, err
+	}
+	compiled := constantExpr(value, typ)
+	compiled.Name = "?column?"
+	if typ == oidUnknown {
+		compiled.param = e.Index
+	}
+	return compiled, nil
+}
+
+func (scope *compileScope) compileColumn(e columnExpr) (*compiledExpr, error) {
+	name := e.Name
+	if e.Qualifier != "" {
+		name = e.Qualifier + "." + e.Name
+	}
+	if scope.table == nil {
+		if e.Qualifier != "" {
+			return nil, newSQLError(sqlStateUndefinedTable, e.pos, "missing FROM-clause entry for table \"%s\"", e.Qualifier)
+		}
+		return nil, newSQLError(sqlStateUndefinedColumn, e.pos, "column \"%s\" does not exist", name)
+	}
+	if e.Qualifier != "" && e.Qualifier != scope.alias {
+		return nil, newSQLError(sqlStateUndefinedTable, e.pos, "missing FROM-clause entry for table \"%s\"", e.Qualifier)
+	}
+	index := slices.IndexFunc(scope.table.Columns, func(c sqlColumn) bool { return c.Name == e.Name })
+	if index < 0 {
+		return nil, newSQLError(sqlStateUndefinedColumn, e.pos, "column \"%s\" does not exist", name)
+	}
+	if !scope.inAggregate && scope.firstColumn == nil {
+		scope.firstColumn = &e
+	}
+	return &compiledExpr{Type: scope.table.Columns[index].Type, Name: e.Name, eval: func(row *evalRow) (any, error) {
+		if row.values == nil {
+			return nil, newSQLError(sqlStateGroupingError, e.pos, "column \"%s\" must appear in the GROUP BY clause or be used in an aggregate function", name)
+		}
+		return row.values[index], nil
+	}}, nil
+}
+
+// coerce checks that expr can be used where a value of type want is needed, converting
+// an untyped literal to it.
+func (scope *compileScope) coerce(expr *compiledExpr, want uint32, context string) error {
+	if expr.param > 0 {
+		scope.params.Types[expr.param-1] = want
+	}
+	if expr.constant && expr.Type == oidUnknown {
+		v, err := expr.eval(nil)
+		if err != nil {
+			return err
+		}
+		if v, err = castValue(v, want); err != nil {
+			return err
+		}
+		*expr = *constantExpr(v, want)
+		return nil
+	}
+	if expr.Type == oidUnknown || typeCategory(expr.Type) == typeCategory(want) {
+		return nil
+	}
+	return newSQLError(sqlStateDatatypeMismatch, 0, "%s must be type %s, not type %s", context, typeNames[want], typeNames[expr.Type])
+}
+
+// unify makes two operands comparable, giving an untyped literal the other side's type.
+func (scope *compileScope) unify(left, right *compiledExpr, op string) error {
+	switch {
+	case left.Type == oidUnknown && right.Type != oidUnknown:
+		return scope.coerce(left, right.Type, "")
+	case right.Type == oidUnknown && left.Type != oidUnknown:
+		return scope.coerce(right, left.Type, "")
+	case typeCategory(left.Type) != typeCategory(right.Type):
+		return newSQLError(sqlStateUndefinedFunction, 0, "operator does not exist: %s %s %s", typeNames[left.Type], op, typeNames[right.Type])
+	}
+	return nil
+}
+
+func evalPair(row *evalRow, left, right *compiledExpr) (any, any, error) {
+	l, err := left.eval(row)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := right.eval(row)
+	return l, r, err
+}
+
+func (scope *compileScope) compileBinary(e binaryExpr) (*compiledExpr, error) {
+	left, err := scope.compile(e.Left)
+	if err != nil {
+		return nil, err
+	}
+	right, err := scope.compile(e.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.Op {
+	case "and", "or":
+		for _, operand := range []*compiledExpr{left, right} {
+			if err := scope.coerce(operand, oidBool, "argument of "+strings.ToUpper(e.Op)); err != nil {
+				return nil, err
+			}
+		}
+		return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			l, r, err := evalPair(row, left, right)
+			if err != nil {
+				return nil, err
+			}
+			// Three-valued logic: NULL only when the known side doesn't decide it
+			decisive := e.Op == "or"
+			if l == decisive || r == decisive {
+				return decisive, nil
+			}
+			if l == nil || r == nil {
+				return nil, nil
+			}
+			return !decisive, nil
+		}}, nil
+
+	case "=", "<>", "<", ">", "<=", ">=":
+		if err := scope.unify(left, right, e.Op); err != nil {
+			return nil, err
+		}
+		return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			l, r, err := evalPair(row, left, right)
+			if l == nil || r == nil || err != nil {
+				return nil, err
+			}
+			c := compareValues(l, r)
+			switch e.Op {
+			case "=":
+				return c == 0, nil
+			case "<>":
+				return c != 0, nil
+			case "<":
+				return c < 0, nil
+			case ">":
+				return c > 0, nil
+			case "<=":
+				return c <= 0, nil
+			default:
+				return c >= 0, nil
+			}
+		}}, nil
+
+	case "||":
+		return &compiledExpr{Type: oidText, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			l, r, err := evalPair(row, left, right)
+			if l == nil || r == nil || err != nil {
+				return nil, err
+			}
+			return formatValue(l) + formatValue(r), nil
+		}}, nil
+
+	case "~", "~*", "!~":
+		for _, operand := range []*compiledExpr{left, right} {
+			if typeCategory(operand.Type) != "text" {
+				return nil, newSQLError(sqlStateUndefinedFunction, e.pos, "operator does not exist: %s %s %s", typeNames[left.Type], e.Op, typeNames[right.Type])
+			}
+		}
+		matcher := &patternCache{}
+		return &compiledExpr{Type: oidBool, Name: "?column?", eval: func(row *evalRow) (any, error) {
+			l, r, err := evalPair(row, left, right)
+			if l == nil || r == nil || err != nil {
+				return nil, err
+			}
+			pattern := r.(string)
+			if e.Op == "~*" {
+				pattern = "(?i)" + pattern
+			}
+			re, err := matcher.get(pattern)
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(l.(string)) != (e.Op == "!~"), nil
+		}}, nil
+	}
+
+	// Arithmetic
+	for _, operand := range []*compiledExpr{left, right} {
+		if operand.Type == oidUnknown {
+			if err := scope.coerce(operand, oidNumeric, ""); err != nil {
+				return nil, err
+			}
+		}
+		if typeCategory(operand.Type) != "numeric" {
+			return nil, newSQLError(sqlStateUndefinedFunction, e.pos, "operator does not exist: %s %s %s", typeNames[left.Type], e.Op, typeNames[right.Type])
+		}
+	}
+	resultType := oidInt4
+	switch {
+	case left.Type == oidNumeric || right.Type == oidNumeric:
+		resultType = oidNumeric
+	case left.Type == oidInt8 || right.Type == oidInt8:
+		resultType = oidInt8
+	}
+	return &compiledExpr{Type: resultType, Name: "?column?", eval: func(row *evalRow) (any, error) {
+		l, r, err := evalPair(row, left, right)
+		if l == nil || r == nil || err != nil {
+			return nil, err
+		}
+		v, err := arithmetic(e.Op, l, r)
+		if n, ok := v.(int64); ok {
+			return checkIntRange(n, resultType)
+		}
+		return v, err
+	}}, nil
+}
+
+// errBigintOutOfRange is PostgreSQL's error for integer arithmetic that overflows,
+// where Go's would wrap around.
+func errBigintOutOfRange() *sqlError {
+	return newSQLError(sqlStateOutOfRange, 0, "bigint out of range")
+}
+
+// errIntOutOfRange is the overflow error of the given integer type.
+func errIntOutOfRange(oid uint32) *sqlError {
+	if oid == oidInt4 {
+		return newSQLError(sqlStateOutOfRange, 0, "integer out of range")
+	}
+	return errBigintOutOfRange()
+}
+
+// checkIntRange returns v, or an error if it doesn't fit the given integer type.
+// Integers are evaluated as int64, so int4 results are checked here.
+func checkIntRange(v int64, oid uint32) (any, error) {
+	if oid == oidInt4 && int64(int32(v)) != v {
+		return nil, errIntOutOfRange(oid)
+	}
+	return v, nil
+}
+
+func arithmetic(op string, l, r any) (any, error) {
+	li, lInt := l.(int64)
+	ri, rInt := r.(int64)
+	if lInt && rInt {
+		switch op {
+		case "+":
+			sum := li + ri
+			if (ri > 0 && sum < li) || (ri < 0 && sum > li) {
+				return nil, errBigintOutOfRange()
+			}
+			return sum, nil
+		case "-":
+			difference := li - ri
+			if (ri < 0 && difference < li) || (ri > 0 && difference > li) {
+				return nil, errBigintOutOfRange()
+			}
+			return difference, nil
+		case "*":
+			product := li * ri
+			if li != 0 && (product/li != ri || (li == -1 && ri == math.MinInt64)) {
+				return nil, errBigintOutOfRange()
+			}
+			return product, nil
+		}
+		if ri == 0 {
+			return nil, newSQLError(sqlStateDivisionByZero, 0, "division by zero")
+		}
+		if op == "/" {
+			if li == math.MinInt64 && ri == -1 {
+				return nil, errBigintOutOfRange()
+			}
+			return li / ri, nil
+		}
+		return li % ri, nil
+	}
+
+	lf, _ := castValue(l, oidNumeric)
+	rf, _ := castValue(r, oidNumeric)
+	a, b := lf.(float64), rf.(float64)
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	}
+	if b == 0 {
+		return nil, newSQLError(sqlStateDivisionByZero, 0, "division by zero")
+	}
+	if op == "/" {
+		return a / b, nil
+	}
+	return math.Mod(a, b), nil
+}
+
+func (scope *compileScope) compileCase(e caseExpr) (*compiledExpr, error) {
+	var operand *compiledExpr
+	var err error
+	if e.Operand != nil {
+		if operand, err = scope.compile(e.Operand); err != nil {
+			return nil, err
+		}
+	}
+	type branch struct{ when, then *compiledExpr }
+	branches := make([]branch, len(e.Whens))
+	resultType := oidUnknown
+	for i, w := range e.Whens {
+		if branches[i].when, err = scope.compile(w.When); err != nil {
+			return nil, err
+		}
+		if operand != nil {
+			err = scope.unify(operand, branches[i].when, "=")
+		} else {
+			err = scope.coerce(branches[i].when, oidBool, "argument of CASE/WHEN")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if branches[i].then, err = scope.compile(w.Then); err != nil {
+			return nil, err
+		}
+		if resultType == oidUnknown {
+			resultType = branches[i].then.Type
+		}
+	}
+	var elseExpr *compiledExpr
+	if e.Else != nil {
+		if elseExpr, err = scope.compile(e.Else); err != nil {
+			return nil, err
+		}
+		if resultType == oidUnknown {
+			resultType = elseExpr.Type
+		}
+	}
+	if resultType == oidUnknown {
+		resultType = oidText
+	}
+	for _, b := range branches {
+		if err := scope.coerce(b.then, resultType, "CASE result"); err != nil {
+			return nil, err
+		}
+	}
+	if elseExpr != nil {
+		if err := scope.coerce(elseExpr, resultType, "CASE result"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &compiledExpr{Type: resultType, Name: "case", eval: func(row *evalRow) (any, error) {
+		var subject any
+		if operand != nil {
+			var err error
+			if subject, err = operand.eval(row); err != nil {
+				return nil, err
+			}
+		}
+		for _, b := range branches {
+			v, err := b.when.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			matched := v == true
+			if operand != nil {
+				matched = subject != nil && v != nil && compareValues(subject, v) == 0
+			}
+			if matched {
+				return b.then.eval(row)
+			}
+		}
+		if elseExpr == nil {
+			return nil, nil
+		}
+		return elseExpr.eval(row)
+	}}, nil
+}
+
+// sqlFunction is a scalar function the game schema supports.
+type sqlFunction struct {
+	MinArgs, MaxArgs int // MaxArgs -1 takes any number
+	// Type is the result type given the argument types; nil means text. Arguments of
+	// unknown type, such as quoted literals, take the result type if ArgsOfResultType.
+	Type             func(args []*compiledExpr) uint32
+	ArgsOfResultType bool
+	// Call computes the result; NULL arguments give a NULL result unless NullSafe
+	Call     func(session *sqlSession, args []any) (any, error)
+	NullSafe bool
+}
+
+func returnsInt(args []*compiledExpr) uint32      { return oidInt4 }
+func returnsFirstArg(args []*compiledExpr) uint32 { return args[0].Type }
+
+var sqlFunctions = map[string]sqlFunction{
+	"lower": {MinArgs: 1, MaxArgs: 1, Call: func(_ *sqlSession, args []any) (any, error) {
+		return strings.ToLower(formatValue(args[0])), nil
+	}},
+	"upper": {MinArgs: 1, MaxArgs: 1, Call: func(_ *sqlSession, args []any) (any, error) {
+		return strings.ToUpper(formatValue(args[0])), nil
+	}},
+	"length": {MinArgs: 1, MaxArgs: 1, Type: returnsInt, Call: func(_ *sqlSession, args []any) (any, error) {
+		return int64(len([]rune(formatValue(args[0])))), nil
+	}},
+	"trim": {MinArgs: 1, MaxArgs: 1, Call: func(_ *sqlSession, args []any) (any, error) {
+		return strings.TrimSpace(formatValue(args[0])), nil
+	}},
+	"left": {MinArgs: 2, MaxArgs: 2, Call: func(_ *sqlSession, args []any) (any, error) {
+		s, n := []rune(formatValue(args[0])), int(toInt(args[1]))
+		if n < 0 {
+			n = max(len(s)+n, 0)
+		}
+		return string(s[:min(n, len(s))]), nil
+	}},
+	"right": {MinArgs: 2, MaxArgs: 2, Call: func(_ *sqlSession, args []any) (any, error) {
+		s, n := []rune(formatValue(args[0])), int(toInt(args[1]))
+		if n < 0 {
+			n = max(len(s)+n, 0)
+		}
+		return string(s[len(s)-min(n, len(s)):]), nil
+	}},
+	"substr": {MinArgs: 2, MaxArgs: 3, Call: func(_ *sqlSession, args []any) (any, error) {
+		s := []rune(formatValue(args[0]))
+		start, end := int(toInt(args[1]))-1, len(s)
+		if len(args) == 3 {
+			end = start + int(toInt(args[2]))
+		}
+		start, end = max(start, 0), min(end, len(s))
+		if start >= end {
+			return "", nil
+		}
+		return string(s[start:end]), nil
+	}},
+	"replace": {MinArgs: 3, MaxArgs: 3, Call: func(_ *sqlSession, args []any) (any, error) {
+		return strings.ReplaceAll(formatValue(args[0]), formatValue(args[1]), formatValue(args[2])), nil
+	}},
+	"concat": {MinArgs: 1, MaxArgs: -1, NullSafe: true, Call: func(_ *sqlSession, args []any) (any, error) {
+		var s strings.Builder
+		for _, arg := range args {
+			if arg != nil {
+				s.WriteString(formatValue(arg))
+			}
+		}
+		return s.String(), nil
+	}},
+	"coalesce": {MinArgs: 1, MaxArgs: -1, NullSafe: true, Type: returnsFirstArg, ArgsOfResultType: true, Call: func(_ *sqlSession, args []any) (any, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+	"nullif": {MinArgs: 2, MaxArgs: 2, NullSafe: true, Type: returnsFirstArg, ArgsOfResultType: true, Call: func(_ *sqlSession, args []any) (any, error) {
+		if args[0] != nil && args[1] != nil && compareValues(args[0], args[1]) == 0 {
+			return nil, nil
+		}
+		return args[0], nil
+	}},
+	"abs": {MinArgs: 1, MaxArgs: 1, Type: returnsFirstArg, ArgsOfResultType: true, Call: func(_ *sqlSession, args []any) (any, error) {
+		if v, ok := args[0].(int64); ok {
+			if v == math.MinInt64 {
+				return nil, errBigintOutOfRange()
+			}
+			return max(v, -v), nil
+		}
+		return math.Abs(args[0].(float64)), nil
+	}},
+	"round": {MinArgs: 1, MaxArgs: 2, Type: func([]*compiledExpr) uint32 { return oidNumeric }, ArgsOfResultType: true, Call: func(_ *sqlSession, args []any) (any, error) {
+		v, _ := castValue(args[0], oidNumeric)
+		if len(args) == 1 {
+			return math.Round(v.(float64)), nil
+		}
+		// Past float64's exponents, the scale would be 0 or infinite: every digit is kept,
+		// or none is
+		scale := math.Pow(10, float64(max(min(toInt(args[1]), 308), -308)))
+		if scaled := v.(float64) * scale; !math.IsInf(scaled, 0) {
+			return math.Round(scaled) / scale, nil
+		}
+		return v, nil
+	}},
+	"now": {Type: func([]*compiledExpr) uint32 { return oidTimestamptz }, Call: func(session *sqlSession, _ []any) (any, error) {
+		return session.Now, nil
+	}},
+	"version": {Call: func(*sqlSession, []any) (any, error) {
+		return serverVersionBanner, nil
+	}},
+	"current_user": {Call: func(session *sqlSession, _ []any) (any, error) {
+		return session.User, nil
+	}},
+	"current_database": {Call: func(session *sqlSession, _ []any) (any, error) {
+		return session.Database, nil
+	}},
+	"current_schema": {Call: func(*sqlSession, []any) (any, error) {
+		return "public", nil
+	}},
+	"current_setting": {MinArgs: 1, MaxArgs: 2, Call: func(session *sqlSession, args []any) (any, error) {
+		name := formatValue(args[0])
+		if _, ok := findSetting(name); !ok {
+			if len(args) == 2 && args[1] == true {
+				return nil, nil
+			}
+			return nil, newSQLError(sqlStateUndefinedObject, 0, "unrecognized configuration parameter \"%s\"", name)
+		}
+		return session.setting(name), nil
+	}},
+}
+
+func init() {
+	aliases := map[string]string{
+		"char_length": "length", "character_length": "length", "btrim": "trim", "substring": "substr",
+		"session_user": "current_user", "user": "current_user", "current_catalog": "current_database",
+		"current_timestamp": "now", "transaction_timestamp": "now", "statement_timestamp": "now",
+	}
+	for alias, name := range aliases {
+		sqlFunctions[alias] = sqlFunctions[name]
+	}
+}
+
+// serverVersionBanner is what version() returns.
+const serverVersionBanner = "PostgreSQL 16.8 (psql text-based adventure)"
+
+func toInt(v any) int64 {
+	n, _ := castValue(v, oidInt8)
+	i, _ := n.(int64)
+	return i
+}
+
+func (scope *compileScope) compileFunction(e funcExpr) (*compiledExpr, error) {
+	args := make([]*compiledExpr, len(e.Args))
+	argTypes := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		var err error
+		if args[i], err = scope.compile(arg); err != nil {
+			return nil, err
+		}
+		argTypes[i] = typeNames[args[i].Type]
+	}
+	function, ok := sqlFunctions[e.Name]
+	if !ok || e.Star || e.Distinct || len(e.Args) < function.MinArgs || (function.MaxArgs >= 0 && len(e.Args) > function.MaxArgs) {
+		return nil, newSQLError(sqlStateUndefinedFunction, e.pos, "function %s(%s) does not exist", e.Name, strings.Join(argTypes, ", "))
+	}
+	resultType := oidText
+	if function.Type != nil {
+		resultType = function.Type(args)
+		if resultType == oidUnknown {
+			resultType = oidText
+		}
+	}
+	for _, arg := range args {
+		if function.ArgsOfResultType && arg.Type == oidUnknown && resultType != oidText {
+			if err := scope.coerce(arg, resultType, "argument of "+e.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &compiledExpr{Type: resultType, Name: e.Name, eval: func(row *evalRow) (any, error) {
+		values := make([]any, len(args))
+		for i, arg := range args {
+			v, err := arg.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil && !function.NullSafe {
+				return nil, nil
+			}
+			values[i] = v
+		}
+		return function.Call(scope.session, values)
+	}}, nil
+}
+
+var aggregateFunctions = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true, "string_agg": true}
+
+func (scope *compileScope) compileAggregate(e funcExpr) (*compiledExpr, error) {
+	if scope.aggregates == nil {
+		return nil, newSQLError(sqlStateGroupingError, e.pos, "aggregate functions are not allowed in %s", scope.clause)
+	}
+	if scope.inAggregate {
+		return nil, newSQLError(sqlStateGroupingError, e.pos, "aggregate function calls cannot be nested")
+	}
+	wantArgs := 1
+	if e.Name == "string_agg" {
+		wantArgs = 2
+	}
+	if (e.Star && e.Name != "count") || (!e.Star && len(e.Args) != wantArgs) {
+		return nil, newSQLError(sqlStateUndefinedFunction, e.pos, "function %s does not exist with those arguments", e.Name)
+	}
+
+	agg := &aggregate{Name: e.Name, Distinct: e.Distinct}
+	resultType := oidInt8
+	if !e.Star {
+		scope.inAggregate = true
+		arg, err := scope.compile(e.Args[0])
+		if err == nil && e.Name == "string_agg" {
+			agg.Extra, err = scope.compile(e.Args[1])
+		}
+		scope.inAggregate = false
+		if err != nil {
+			return nil, err
+		}
+		agg.Arg = arg
+		switch e.Name {
+		case "sum":
+			if typeCategory(arg.Type) != "numeric" {
+				return nil, newSQLError(sqlStateUndefinedFunction, e.pos, "function sum(%s) does not exist", typeNames[arg.Type])
+			}
+			resultType = oidInt8
+			if arg.Type == oidNumeric {
+				resultType = oidNumeric
+			}
+		case "avg":
+			if typeCategory(arg.Type) != "numeric" {
+				return nil, newSQLError(sqlStateUndefinedFunction, e.pos, "function avg(%s) does not exist", typeNames[arg.Type])
+			}
+			resultType = oidNumeric
+		case "min", "max":
+			resultType = arg.Type
+			if resultType == oidUnknown {
+				resultType = oidText
+			}
+		case "string_agg":
+			resultType = oidText
+		}
+	}
+
+	*scope.aggregates = append(*scope.aggregates, agg)
+	index := len(*scope.aggregates) - 1
+	return &compiledExpr{Type: resultType, Name: e.Name, eval: func(row *evalRow) (any, error) {
+		if row.aggregates == nil {
+			return nil, newSQLError(sqlStateGroupingError, e.pos, "aggregate functions are not allowed here")
+		}
+		return row.aggregates[index], nil
+	}}, nil
+}
+
+// compute runs the aggregate over rows.
+func (agg *aggregate) compute(rows []*evalRow) (any, error) {
+	var values []any
+	seen := map[string]bool{}
+	for _, row := range rows {
+		var v any = true
+		if agg.Arg != nil {
+			var err error
+			if v, err = agg.Arg.eval(row); err != nil {
+				return nil, err
+			}
+		}
+		if v == nil {
+			continue
+		}
+		if agg.Distinct {
+			key := formatValue(v)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		values = append(values, v)
+	}
+
+	if agg.Name == "count" {
+		return int64(len(values)), nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	switch agg.Name {
+	case "min", "max":
+		best := values[0]
+		for _, v := range values[1:] {
+			if c := compareValues(v, best); (agg.Name == "min" && c < 0) || (agg.Name == "max" && c > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "string_agg":
+		delimiter := ""
+		if d, err := agg.Extra.eval(rows[0]); err == nil && d != nil {
+			delimiter = formatValue(d)
+		}
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = formatValue(v)
+		}
+		return strings.Join(parts, delimiter), nil
+	}
+	var sum any = int64(0)
+	for _, v := range values {
+		var err error
+		if sum, err = arithmetic("+", sum, v); err != nil {
+			return nil, err
+		}
+	}
+	if agg.Name == "avg" {
+		total, _ := castValue(sum, oidNumeric)
+		return total.(float64) / float64(len(values)), nil
+	}
+	return sum, nil
+}
+
+// patternCache keeps the last regular expression compiled for a LIKE or ~ operator,
+// since the pattern is nearly always a constant.
+type patternCache struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (cache *patternCache) get(pattern string) (*regexp.Regexp, error) {
+	if cache.re != nil && cache.pattern == pattern {
+		return cache.re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, newSQLError("2201B", 0, "invalid regular expression: %v", err)
+	}
+	cache.pattern, cache.re = pattern, re
+	return re, nil
+}
+
+// likePattern translates a LIKE pattern into a regular expression.
+func likePattern(pattern string, insensitive bool) string {
+	var re strings.Builder
+	re.WriteString("(?s)")
+	if insensitive {
+		re.WriteString("(?i)")
+	}
+	re.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			re.WriteString(".*")
+		case r == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// selectPlan is a SELECT compiled against the game schema. Its columns are known before
+// it runs, which is what Describe needs.
+type selectPlan struct {
+	Table      *virtualTable // nil for a SELECT without FROM
+	Columns    []sqlColumn
+	outputs    []*compiledExpr
+	where      *compiledExpr
+	order      []compiledOrder
+	aggregates []*aggregate
+	distinct   bool
+	limit      int64 // -1 for no limit
+	offset     int64
+}
+
+type compiledOrder struct {
+	output     int // index into the outputs, or -1 to evaluate expr
+	expr       *compiledExpr
+	desc       bool
+	nullsFirst bool
+}
+
+// planSelect resolves a SELECT's table, columns and functions.
+func planSelect(stmt *selectStatement, session *sqlSession, params *sqlParams) (*selectPlan, error) {
+	plan := &selectPlan{distinct: stmt.Distinct, limit: -1}
+	scope := &compileScope{session: session, params: params, aggregates: &plan.aggregates}
+	if stmt.From != nil {
+		table, err := lookupVirtualTable(stmt.From)
+		if err != nil {
+			return nil, err
+		}
+		plan.Table = table
+		scope.table = table
+		scope.alias = stmt.From.Name
+		if stmt.From.Alias != "" {
+			scope.alias = stmt.From.Alias
+		}
+	}
+
+	for _, item := range stmt.Items {
+		if item.Star {
+			if plan.Table == nil {
+				return nil, newSQLError(sqlStateSyntaxError, 0, "SELECT * with no tables specified is not valid")
+			}
+			if item.Qualifier != "" && item.Qualifier != scope.alias {
+				return nil, newSQLError(sqlStateUndefinedTable, 0, "missing FROM-clause entry for table \"%s\"", item.Qualifier)
+			}
+			for _, column := range plan.Table.Columns {
+				compiled, err := scope.compile(columnExpr{Name: column.Name})
+				if err != nil {
+					return nil, err
+				}
+				plan.outputs = append(plan.outputs, compiled)
+				plan.Columns = append(plan.Columns, column)
+			}
+			continue
+		}
+		compiled, err := scope.compile(item.Expr)
+		if err != nil {
+			return nil, err
+		}
+		column := sqlColumn{Name: compiled.Name, Type: compiled.Type}
+		if item.Alias != "" {
+			column.Name = item.Alias
+		}
+		if column.Type == oidUnknown {
+			column.Type = oidText
+		}
+		plan.outputs = append(plan.outputs, compiled)
+		plan.Columns = append(plan.Columns, column)
+	}
+
+	for _, item := range stmt.OrderBy {
+		order := compiledOrder{output: -1, desc: item.Desc, nullsFirst: item.NullsFirst}
+		switch e := item.Expr.(type) {
+		case literalExpr:
+			// ORDER BY 2 sorts by the second output column
+			position, ok := e.Value.(int64)
+			if !ok || position < 1 || int(position) > len(plan.outputs) {
+				return nil, newSQLError(sqlStateInvalidColumnReference, 0, "ORDER BY position %v is not in select list", e.Value)
+			}
+			order.output = int(position) - 1
+		case columnExpr:
+			// An output column's name wins over an input column's
+			if e.Qualifier == "" {
+				order.output = slices.IndexFunc(plan.Columns, func(c sqlColumn) bool { return c.Name == e.Name })
+			}
+		}
+		if order.output < 0 {
+			var err error
+			if order.expr, err = scope.compile(item.Expr); err != nil {
+				return nil, err
+			}
+		}
+		plan.order = append(plan.order, order)
+	}
+	if len(plan.aggregates) > 0 && scope.firstColumn != nil {
+		column := scope.firstColumn
+		name := column.Name
+		if column.Qualifier != "" {
+			name = column.Qualifier + "." + name
+		}
+		return nil, newSQLError(sqlStateGroupingError, column.pos, "column \"%s\" must appear in the GROUP BY clause or be used in an aggregate function", name)
+	}
+
+	scope.aggregates = nil
+	if stmt.Where != nil {
+		scope.clause = "WHERE"
+		where, err := scope.compile(stmt.Where)
+		if err != nil {
+			return nil, err
+		}
+		if err := scope.coerce(where, oidBool, "argument of WHERE"); err != nil {
+			return nil, err
+		}
+		plan.where = where
+	}
+
+	// LIMIT and OFFSET are constants
+	scope.table = nil
+	for _, clause := range []struct {
+		name   string
+		expr   sqlExpr
+		target *int64
+	}{{"LIMIT", stmt.Limit, &plan.limit}, {"OFFSET", stmt.Offset, &plan.offset}} {
+		if clause.expr == nil {
+			continue
+		}
+		scope.clause = clause.name
+		compiled, err := scope.compile(clause.expr)
+		if err != nil {
+			return nil, err
+		}
+		if err := scope.coerce(compiled, oidInt8, "argument of "+clause.name); err != nil {
+			return nil, err
+		}
+		v, err := compiled.eval(&evalRow{})
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue // LIMIT ALL or LIMIT NULL
+		}
+		n := toInt(v)
+		if n < 0 {
+			return nil, newSQLError("2201W", 0, "%s must not be negative", clause.name)
+		}
+		*clause.target = n
+	}
+	return plan, nil
+}
+
+// sqlStateInvalidColumnReference is reported for an ORDER BY position out of range.
+const sqlStateInvalidColumnReference = "42P10"
+
+// run evaluates the plan over the rows of its table (ignored for a SELECT without FROM).
+func (plan *selectPlan) run(tableRows [][]any) (*resultSet, error) {
+	var rows []*evalRow
+	if plan.Table == nil {
+		rows = []*evalRow{{values: []any{}}}
+	} else {
+		for _, values := range tableRows {
+			row := &evalRow{values: values}
+			if plan.where != nil {
+				keep, err := plan.where.eval(row)
+				if err != nil {
+					return nil, err
+				}
+				if keep != true {
+					continue
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	if len(plan.aggregates) > 0 {
+		group := &evalRow{aggregates: make([]any, len(plan.aggregates))}
+		for i, agg := range plan.aggregates {
+			var err error
+			if group.aggregates[i], err = agg.compute(rows); err != nil {
+				return nil, err
+			}
+		}
+		rows = []*evalRow{group}
+	}
+
+	type outputRow struct {
+		values []any
+		keys   []any
+	}
+	var output []outputRow
+	seen := map[string]bool{}
+	for _, row := range rows {
+		out := outputRow{values: make([]any, len(plan.outputs)), keys: make([]any, len(plan.order))}
+		for i, expr := range plan.outputs {
+			var err error
+			if out.values[i], err = expr.eval(row); err != nil {
+				return nil, err
+			}
+		}
+		if plan.distinct {
+			key := distinctKey(out.values)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		for i, order := range plan.order {
+			if order.output >= 0 {
+				out.keys[i] = out.values[order.output]
+				continue
+			}
+			var err error
+			if out.keys[i], err = order.expr.eval(row); err != nil {
+				return nil, err
+			}
+		}
+		output = append(output, out)
+	}
+
+	slices.SortStableFunc(output, func(a, b outputRow) int {
+		for i, order := range plan.order {
+			x, y := a.keys[i], b.keys[i]
+			c := 0
+			switch {
+			case x == nil && y == nil:
+			case x == nil:
+				c = 1
+				if order.nullsFirst {
+					c = -1
+				}
+			case y == nil:
+				c = -1
+				if order.nullsFirst {
+					c = 1
+				}
+			default:
+				c = compareValues(x, y)
+				if order.desc {
+					c = -c
+				}
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+
+	start := min(int(plan.offset), len(output))
+	end := len(output)
+	if plan.limit >= 0 {
+		end = min(start+int(plan.limit), end)
+	}
+	result := &resultSet{Columns: plan.Columns}
+	for _, out := range output[start:end] {
+		result.Rows = append(result.Rows, out.values)
+	}
+	return result, nil
+}
+
+func distinctKey(values []any) string {
+	var key strings.Builder
+	for _, v := range values {
+		if v == nil {
+			key.WriteString("\x00N")
+		} else {
+			key.WriteString("\x00V" + formatValue(v))
+		}
+	}
+	return key.String()
+}
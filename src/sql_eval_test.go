@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// evalQuery runs a SELECT over the given rows of the table it names.
+func evalQuery(query string, rows [][]any) (*resultSet, error) {
+	stmt, err := parseSelect(query)
+	if err != nil {
+		return nil, err
+	}
+	session := &sqlSession{User: "wanderer", Database: "postgres", Now: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	plan, err := planSelect(stmt, session, nil)
+	if err != nil {
+		return nil, err
+	}
+	return plan.run(rows)
+}
+
+func TestEvalExpressions(t *testing.T) {
+	tests := []struct {
+		expr string
+		want any
+	}{
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"7 / 2", int64(3)},
+		{"7 % 3", int64(1)},
+		{"-(2 - 5)", int64(3)},
+		{"7.0 / 2", 3.5},
+		{"'a' || 'b' || 1", "ab1"},
+		{"'abc' LIKE 'a%'", true},
+		{"'ABC' ILIKE 'a_c'", true},
+		{"'abc' NOT LIKE '%b'", true},
+		{"2 BETWEEN 1 AND 3", true},
+		{"2 IN (1, 3)", false},
+		{"NULL IS NULL", true},
+		{"NULL = NULL", nil},
+		{"NULL OR true", true},
+		{"NULL AND false", false},
+		{"CASE WHEN 1 > 2 THEN 'a' ELSE 'b' END", "b"},
+		{"CASE 2 WHEN 1 THEN 'one' WHEN 2 THEN 'two' END", "two"},
+		{"'42'::int + 1", int64(43)},
+		{"'t'::boolean", true},
+		{"coalesce(NULL, 'x')", "x"},
+		{"nullif(1, 1)", nil},
+		{"length('héllo')", int64(5)},
+		{"upper(substr('lantern', 2, 3))", "ANT"},
+		{"abs(-9223372036854775807)", int64(9223372036854775807)},
+		{"round(2.345, 2)", 2.35},
+		{"round(1.5, -400)", 0.0},
+		{"round(1.5, 400)", 1.5},
+		{"round(1e300, 100)", 1e300},
+		{"2147483647::bigint + 1", int64(2147483648)},
+		{"-2147483647 - 1", int64(-2147483648)},
+		{"2147483647.4::int", int64(2147483647)},
+		{"'9999999999'::bigint", int64(9999999999)},
+		{"current_user", "wanderer"},
+		{"now()", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			result, err := evalQuery("SELECT "+tt.expr, nil)
+			if err != nil {
+				t.Fatalf("SELECT %s failed: %v", tt.expr, err)
+			}
+			if got := result.Rows[0][0]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SELECT %s = %#v, want %#v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		code    string
+		message string
+	}{
+		{"SELECT 9223372036854775807 + 1", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT -9223372036854775807 - 2", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT 4611686018427387904 * 2", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT (-9223372036854775807 - 1) * -1", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT (-9223372036854775807 - 1) / -1", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT -(-9223372036854775807 - 1)", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT abs(-9223372036854775807 - 1)", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT 2147483647 + 1", sqlStateOutOfRange, "integer out of range"},
+		{"SELECT -2147483647 - 2", sqlStateOutOfRange, "integer out of range"},
+		{"SELECT 65536 * 65536", sqlStateOutOfRange, "integer out of range"},
+		{"SELECT -(-2147483647 - 1)", sqlStateOutOfRange, "integer out of range"},
+		{"SELECT 1e300::int", sqlStateOutOfRange, "integer out of range"},
+		{"SELECT 2147483647.5::int", sqlStateOutOfRange, "integer out of range"},
+		{"SELECT 1e300::bigint", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT 9223372036854775807.0::bigint", sqlStateOutOfRange, "bigint out of range"},
+		{"SELECT '9999999999'::int", sqlStateOutOfRange, `value "9999999999" is out of range for type integer`},
+		{"SELECT '99999999999999999999'::bigint", sqlStateOutOfRange, `value "99999999999999999999" is out of range for type bigint`},
+		{"SELECT 1 / 0", sqlStateDivisionByZero, "division by zero"},
+		{"SELECT 1 % 0", sqlStateDivisionByZero, "division by zero"},
+		{"SELECT sum(id) FROM inventory", sqlStateOutOfRange, "bigint out of range"},
+	}
+	rows := [][]any{{int64(9223372036854775807), "lantern", ""}, {int64(1), "rope", ""}}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := evalQuery(tt.query, rows)
+			var sqlErr *sqlError
+			if !errors.As(err, &sqlErr) {
+				t.Fatalf("%s error = %v, want an sqlError", tt.query, err)
+			}
+			if sqlErr.Code != tt.code || sqlErr.Message != tt.message {
+				t.Errorf("%s error = %s %q, want %s %q", tt.query, sqlErr.Code, sqlErr.Message, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestEvalTable(t *testing.T) {
+	rows := [][]any{
+		{int64(1), "lantern", "A brass lantern"},
+		{int64(2), "rope", nil},
+		{int64(3), "rusty key", "It opens something"},
+		{int64(4), "Rope ladder", nil},
+	}
+	tests := []struct {
+		query   string
+		columns []string
+		want    [][]any
+	}{
+		{
+			query:   "SELECT name FROM inventory WHERE id > 2 ORDER BY id",
+			columns: []string{"name"},
+			want:    [][]any{{"rusty key"}, {"Rope ladder"}},
+		},
+		{
+			query:   "SELECT i.id AS n FROM inventory i WHERE i.name ILIKE 'rope%' ORDER BY n DESC",
+			columns: []string{"n"},
+			want:    [][]any{{int64(4)}, {int64(2)}},
+		},
+		{
+			query:   "SELECT name FROM inventory WHERE description IS NULL ORDER BY name LIMIT 1",
+			columns: []string{"name"},
+			want:    [][]any{{"Rope ladder"}},
+		},
+		{
+			query:   "SELECT id FROM inventory ORDER BY id LIMIT 2 OFFSET 1",
+			columns: []string{"id"},
+			want:    [][]any{{int64(2)}, {int64(3)}},
+		},
+		{
+			query:   "SELECT count(*), count(description), sum(id), max(name) FROM inventory",
+			columns: []string{"count", "count", "sum", "max"},
+			want:    [][]any{{int64(4), int64(2), int64(10), "rusty key"}},
+		},
+		{
+			query:   "SELECT DISTINCT description IS NULL AS missing FROM inventory ORDER BY 1",
+			columns: []string{"missing"},
+			want:    [][]any{{false}, {true}},
+		},
+		{
+			query:   "SELECT * FROM inventory WHERE id = 1",
+			columns: []string{"id", "name", "description"},
+			want:    [][]any{{int64(1), "lantern", "A brass lantern"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := evalQuery(tt.query, rows)
+			if err != nil {
+				t.Fatalf("%s failed: %v", tt.query, err)
+			}
+			var columns []string
+			for _, column := range result.Columns {
+				columns = append(columns, column.Name)
+			}
+			if !reflect.DeepEqual(columns, tt.columns) {
+				t.Errorf("%s columns = %v, want %v", tt.query, columns, tt.columns)
+			}
+			if !reflect.DeepEqual(result.Rows, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.query, result.Rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalUndefinedColumn(t *testing.T) {
+	_, err := evalQuery("SELECT colour FROM inventory", nil)
+	var sqlErr *sqlError
+	if !errors.As(err, &sqlErr) || sqlErr.Code != sqlStateUndefinedColumn {
+		t.Fatalf("error = %v, want SQLSTATE %s", err, sqlStateUndefinedColumn)
+	}
+	if want := `column "colour" does not exist`; sqlErr.Message != want {
+		t.Errorf("message = %q, want %q", sqlErr.Message, want)
+	}
+}
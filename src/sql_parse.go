@@ -0,0 +1,1126 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SQLSTATE codes reported for queries against the game schema.
+const (
+	sqlStateSyntaxError       = "42601"
+	sqlStateUndefinedTable    = "42P01"
+	sqlStateUndefinedColumn   = "42703"
+	sqlStateUndefinedFunction = "42883"
+	sqlStateAmbiguousColumn   = "42702"
+	sqlStateGroupingError     = "42803"
+	sqlStateDatatypeMismatch  = "42804"
+	sqlStateInvalidText       = "22P02"
+	sqlStateDivisionByZero    = "22012"
+	sqlStateOutOfRange        = "22003"
+	sqlStateNotSupported      = "0A000"
+	sqlStateReadOnly          = "25006"
+	sqlStateUndefinedObject   = "42704"
+	sqlStateUndefinedParam    = "42P02"
+)
+
+// sqlError is a query error reported to the client as an ErrorResponse. Position, when
+// set, is the 1-based character offset in the query that psql points at; Detail and
+// Hint are optional.
+type sqlError struct {
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+	Position int
+}
+
+func (e *sqlError) Error() string {
+	return e.Message
+}
+
+func newSQLError(code string, position int, format string, a ...any) *sqlError {
+	return &sqlError{Code: code, Message: fmt.Sprintf(format, a...), Position: position}
+}
+
+type tokenKind int
+
+const (
+	tokEOF    tokenKind = iota
+	tokIdent            // unquoted identifier or keyword, lower-cased
+	tokQuoted           // "quoted" identifier, case preserved
+	tokNumber
+	tokString
+	tokSymbol
+	tokParam // $1, a parameter of a prepared statement
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	raw  string // text as written, for error messages
+	pos  int    // 1-based character offset in the query
+}
+
+// twoCharSymbols are the operators lexed as one token.
+var twoCharSymbols = []string{"<=", ">=", "<>", "!=", "||", "::", "!~", "~*"}
+
+// stringEscapes are the backslash escapes of E'...' strings; any other escaped
+// character stands for itself.
+var stringEscapes = map[rune]rune{'n': '\n', 't': '\t', 'r': '\r', 'b': '\b', 'f': '\f'}
+
+// lexSQL splits a query into tokens, dropping whitespace and comments.
+func lexSQL(query string) ([]token, error) {
+	runes := []rune(query)
+	var tokens []token
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+			}
+			if i+1 >= len(runes) {
+				return nil, newSQLError(sqlStateSyntaxError, start+1, "unterminated /* comment at or near \"%s\"", string(runes[start:]))
+			}
+			i += 2
+		case (r == 'e' || r == 'E') && i+1 < len(runes) && runes[i+1] == '\'':
+			// E'...' strings take C-style backslash escapes, as psql's \l query uses
+			var text strings.Builder
+			for i += 2; ; i++ {
+				if i >= len(runes) {
+					return nil, newSQLError(sqlStateSyntaxError, start+1, "unterminated quoted string at or near \"%s\"", string(runes[start:]))
+				}
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						text.WriteRune('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					if escaped, ok := stringEscapes[runes[i]]; ok {
+						text.WriteRune(escaped)
+					} else {
+						text.WriteRune(runes[i])
+					}
+					continue
+				}
+				text.WriteRune(runes[i])
+			}
+			tokens = append(tokens, token{kind: tokString, text: text.String(), pos: start + 1})
+		case r == '$' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			for i++; i < len(runes) && unicode.IsDigit(runes[i]); i++ {
+			}
+			tokens = append(tokens, token{kind: tokParam, text: string(runes[start+1 : i]), pos: start + 1})
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '$') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: strings.ToLower(string(runes[start:i])), raw: string(runes[start:i]), pos: start + 1})
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: string(runes[start:i]), pos: start + 1})
+		case r == '\'' || r == '"':
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					if r == '"' {
+						return nil, newSQLError(sqlStateSyntaxError, start+1, "unterminated quoted identifier at or near \"%s\"", string(runes[start:]))
+					}
+					return nil, newSQLError(sqlStateSyntaxError, start+1, "unterminated quoted string at or near \"%s\"", string(runes[start:]))
+				}
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						text.WriteRune(r)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteRune(runes[i])
+				i++
+			}
+			kind := tokString
+			if r == '"' {
+				kind = tokQuoted
+			}
+			tokens = append(tokens, token{kind: kind, text: text.String(), pos: start + 1})
+		default:
+			symbol := string(r)
+			for _, two := range twoCharSymbols {
+				if strings.HasPrefix(string(runes[i:min(i+2, len(runes))]), two) {
+					symbol = two
+					break
+				}
+			}
+			if !strings.Contains("=<>!|:~(),*.+-/%;", string(r)) || symbol == "!" || symbol == "|" || symbol == ":" {
+				return nil, newSQLError(sqlStateSyntaxError, start+1, "syntax error at or near \"%s\"", symbol)
+			}
+			i += len([]rune(symbol))
+			tokens = append(tokens, token{kind: tokSymbol, text: symbol, pos: start + 1})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(runes) + 1}), nil
+}
+
+// queryStatement is one statement of a simple query, and the offset in runes at which
+// it starts, so that error positions can point into the whole query.
+type queryStatement struct {
+	Text   string
+	Offset int
+}
+
+// dollarQuote matches the opening tag of a dollar-quoted string, $$ or $tag$.
+var dollarQuote = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z_0-9]*)?\$`)
+
+// splitStatements splits a simple query at the semicolons outside quotes and comments,
+// dropping empty statements. Players' actions are prose as often as SQL, so an
+// apostrophe inside a word ("the captain's hat") doesn't start a string, and nor does a
+// quote that is never closed.
+func splitStatements(query string) []queryStatement {
+	runes := []rune(query)
+	var statements []queryStatement
+	start := 0
+	add := func(end int) {
+		for start < end && unicode.IsSpace(runes[start]) {
+			start++
+		}
+		if text := strings.TrimRightFunc(string(runes[start:end]), unicode.IsSpace); text != "" {
+			statements = append(statements, queryStatement{Text: text, Offset: start})
+		}
+	}
+	for i := 0; i < len(runes); i++ {
+		if end := skipQuoted(runes, i); end > i {
+			i = end - 1
+		} else if runes[i] == ';' {
+			add(i)
+			start = i + 1
+		}
+	}
+	add(len(runes))
+	return statements
+}
+
+// skipQuoted returns the index just past the comment, quoted identifier or string that
+// starts at runes[i], or i if none does. A quote that is never closed starts nothing.
+func skipQuoted(runes []rune, i int) int {
+	r := runes[i]
+	switch {
+	case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+		for i < len(runes) && runes[i] != '\n' {
+			i++
+		}
+		return i
+	case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+		for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+		}
+		return min(i+2, len(runes))
+	case r == '"' || (r == '\'' && opensString(runes, i)):
+		escapes := r == '\'' && i > 0 && (runes[i-1] == 'e' || runes[i-1] == 'E')
+		if end := closingQuote(runes, i, escapes); end >= 0 {
+			return end + 1
+		}
+	case r == '$' && (i == 0 || !isWordRune(runes[i-1])):
+		if tag := dollarQuote.FindString(string(runes[i:])); tag != "" {
+			body := string(runes[i+len([]rune(tag)):])
+			if end := strings.Index(body, tag); end >= 0 {
+				return i + len([]rune(tag)) + len([]rune(body[:end])) + len([]rune(tag))
+			}
+		}
+	}
+	return i
+}
+
+// opensString reports whether the apostrophe at runes[i] starts a string literal: it
+// follows a non-word character, or a lone E, B, X or N prefix.
+func opensString(runes []rune, i int) bool {
+	if i == 0 || !isWordRune(runes[i-1]) {
+		return true
+	}
+	return strings.ContainsRune("eEbBxXnN", runes[i-1]) && (i == 1 || !isWordRune(runes[i-2]))
+}
+
+// closingQuote returns the index of the quote closing the one at runes[i], skipping
+// doubled quotes and, in E'...' strings, backslash escapes; -1 if there is none.
+func closingQuote(runes []rune, i int, escapes bool) int {
+	quote := runes[i]
+	for i++; i < len(runes); i++ {
+		switch {
+		case escapes && runes[i] == '\\':
+			i++
+		case runes[i] == quote && i+1 < len(runes) && runes[i+1] == quote:
+			i++
+		case runes[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// reservedWords can't be used as a column alias without AS, because they start the next clause.
+var reservedWords = map[string]bool{
+	"all": true, "and": true, "as": true, "asc": true, "between": true, "case": true, "desc": true,
+	"distinct": true, "else": true, "end": true, "except": true, "false": true, "fetch": true,
+	"for": true, "from": true, "group": true, "having": true, "ilike": true, "in": true,
+	"intersect": true, "is": true, "join": true, "left": true, "like": true, "limit": true,
+	"not": true, "null": true, "nulls": true, "offset": true, "on": true, "or": true,
+	"order": true, "right": true, "select": true, "then": true, "true": true, "union": true,
+	"when": true, "where": true, "window": true, "with": true, "inner": true, "cross": true,
+	"full": true, "natural": true,
+}
+
+// selectStatement is a parsed SELECT. Joins, grouping and set operations aren't supported.
+type selectStatement struct {
+	Distinct bool
+	Items    []selectItem
+	From     *tableRef // nil for a SELECT without FROM
+	Where    sqlExpr
+	OrderBy  []orderItem
+	Limit    sqlExpr
+	Offset   sqlExpr
+}
+
+type selectItem struct {
+	Star      bool   // * or qualifier.*
+	Qualifier string // table qualifier of a qualified *
+	Expr      sqlExpr
+	Alias     string
+}
+
+type tableRef struct {
+	Schema string
+	Name   string
+	Alias  string
+	pos    int
+}
+
+type orderItem struct {
+	Expr       sqlExpr
+	Desc       bool
+	NullsFirst bool
+}
+
+// sqlExpr is a node of a parsed expression; see the *Expr types below.
+type sqlExpr any
+
+type literalExpr struct {
+	Value any
+	Type  uint32
+}
+
+type columnExpr struct {
+	Qualifier string
+	Name      string
+	pos       int
+}
+
+type unaryExpr struct {
+	Op      string // "-" or "not"
+	Operand sqlExpr
+}
+
+type binaryExpr struct {
+	Op          string // and, or, comparison, arithmetic, || or a regular expression match
+	Left, Right sqlExpr
+	pos         int
+}
+
+type likeExpr struct {
+	Operand, Pattern sqlExpr
+	Not, Insensitive bool
+}
+
+type isExpr struct {
+	Operand sqlExpr
+	Not     bool
+	Value   any // nil for IS NULL, true or false for IS TRUE and IS FALSE
+}
+
+type inExpr struct {
+	Operand sqlExpr
+	List    []sqlExpr
+	Not     bool
+}
+
+type betweenExpr struct {
+	Operand, Low, High sqlExpr
+	Not                bool
+}
+
+type funcExpr struct {
+	Name     string
+	Args     []sqlExpr
+	Star     bool // count(*)
+	Distinct bool // count(DISTINCT x)
+	pos      int
+}
+
+type caseExpr struct {
+	Operand sqlExpr // nil for a searched CASE
+	Whens   []caseWhen
+	Else    sqlExpr
+}
+
+type caseWhen struct {
+	When, Then sqlExpr
+}
+
+type castExpr struct {
+	Operand sqlExpr
+	Type    uint32
+}
+
+// paramExpr is a parameter placeholder, $Index.
+type paramExpr struct {
+	Index int
+	pos   int
+}
+
+// parseSelect parses a single SELECT statement, with or without a trailing semicolon.
+func parseSelect(query string) (*selectStatement, error) {
+	tokens, err := lexSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{tokens: tokens}
+	stmt, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if p.peek().kind != tokEOF {
+		return nil, p.syntaxError()
+	}
+	return stmt, nil
+}
+
+type sqlParser struct {
+	tokens []token
+	i      int
+}
+
+func (p *sqlParser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *sqlParser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *sqlParser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && t.text == word
+}
+
+func (p *sqlParser) acceptKeyword(word string) bool {
+	if p.isKeyword(word) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectKeyword(word string) error {
+	if !p.acceptKeyword(word) {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *sqlParser) isSymbol(symbol string) bool {
+	t := p.peek()
+	return t.kind == tokSymbol && t.text == symbol
+}
+
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *sqlParser) syntaxError() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return newSQLError(sqlStateSyntaxError, t.pos, "syntax error at end of input")
+	}
+	text := t.text
+	switch t.kind {
+	case tokIdent:
+		text = t.raw
+	case tokString:
+		text = "'" + text + "'"
+	case tokQuoted:
+		text = `"` + text + `"`
+	case tokParam:
+		text = "$" + text
+	}
+	return newSQLError(sqlStateSyntaxError, t.pos, "syntax error at or near \"%s\"", text)
+}
+
+func (p *sqlParser) notSupported(feature string) error {
+	return newSQLError(sqlStateNotSupported, p.peek().pos, "%s is not supported in the game schema", feature)
+}
+
+// identifier accepts an unquoted or quoted identifier.
+func (p *sqlParser) identifier() (string, bool) {
+	t := p.peek()
+	if t.kind == tokQuoted || (t.kind == tokIdent && !reservedWords[t.text]) {
+		p.i++
+		return t.text, true
+	}
+	return "", false
+}
+
+func (p *sqlParser) parseSelect() (*selectStatement, error) {
+	if p.isKeyword("with") {
+		return nil, p.notSupported("WITH")
+	}
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+	stmt := &selectStatement{}
+	if p.acceptKeyword("distinct") {
+		stmt.Distinct = true
+		if p.isKeyword("on") {
+			return nil, p.notSupported("DISTINCT ON")
+		}
+	} else {
+		p.acceptKeyword("all")
+	}
+
+	for {
+		item, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Items = append(stmt.Items, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("from") {
+		from, err := p.parseTableRef()
+		if err != nil {
+			return nil, err
+		}
+		stmt.From = from
+		for _, word := range []string{"join", "inner", "left", "right", "full", "cross", "natural"} {
+			if p.isKeyword(word) {
+				return nil, p.notSupported("JOIN")
+			}
+		}
+		if p.isSymbol(",") {
+			return nil, p.notSupported("selecting from more than one table")
+		}
+	}
+
+	var err error
+	if p.acceptKeyword("where") {
+		if stmt.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isKeyword("group") || p.isKeyword("having") {
+		return nil, p.notSupported("GROUP BY")
+	}
+	if p.acceptKeyword("order") {
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			item, err := p.parseOrderItem()
+			if err != nil {
+				return nil, err
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	// LIMIT and OFFSET may come in either order
+	for range 2 {
+		switch {
+		case stmt.Limit == nil && p.acceptKeyword("limit"):
+			if p.acceptKeyword("all") {
+				stmt.Limit = literalExpr{Type: oidUnknown}
+			} else if stmt.Limit, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		case stmt.Offset == nil && p.acceptKeyword("offset"):
+			if stmt.Offset, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+			if !p.acceptKeyword("rows") {
+				p.acceptKeyword("row")
+			}
+		}
+	}
+	for _, word := range []string{"union", "intersect", "except"} {
+		if p.isKeyword(word) {
+			return nil, p.notSupported(strings.ToUpper(word))
+		}
+	}
+	if p.isKeyword("for") {
+		return nil, p.notSupported("SELECT ... FOR UPDATE")
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) parseSelectItem() (selectItem, error) {
+	if p.acceptSymbol("*") {
+		return selectItem{Star: true}, nil
+	}
+	// qualifier.*
+	if t := p.peek(); (t.kind == tokIdent || t.kind == tokQuoted) && p.i+2 < len(p.tokens) &&
+		p.tokens[p.i+1].text == "." && p.tokens[p.i+1].kind == tokSymbol &&
+		p.tokens[p.i+2].text == "*" && p.tokens[p.i+2].kind == tokSymbol {
+		p.i += 3
+		return selectItem{Star: true, Qualifier: t.text}, nil
+	}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		return selectItem{}, err
+	}
+	item := selectItem{Expr: expr}
+	if p.acceptKeyword("as") {
+		t := p.next()
+		if t.kind != tokIdent && t.kind != tokQuoted {
+			p.i--
+			return selectItem{}, p.syntaxError()
+		}
+		item.Alias = t.text
+	} else if alias, ok := p.identifier(); ok {
+		item.Alias = alias
+	}
+	return item, nil
+}
+
+func (p *sqlParser) parseTableRef() (*tableRef, error) {
+	pos := p.peek().pos
+	name, ok := p.identifier()
+	if !ok {
+		return nil, p.syntaxError()
+	}
+	ref := &tableRef{Name: name, pos: pos}
+	if p.acceptSymbol(".") {
+		if ref.Name, ok = p.identifier(); !ok {
+			return nil, p.syntaxError()
+		}
+		ref.Schema = name
+	}
+	if p.isSymbol("(") {
+		return nil, p.notSupported("selecting from a function")
+	}
+	if p.acceptKeyword("as") {
+		if ref.Alias, ok = p.identifier(); !ok {
+			return nil, p.syntaxError()
+		}
+	} else if alias, ok := p.identifier(); ok {
+		ref.Alias = alias
+	}
+	return ref, nil
+}
+
+func (p *sqlParser) parseOrderItem() (orderItem, error) {
+	expr, err := p.parseExpr()
+	if err != nil {
+		return orderItem{}, err
+	}
+	item := orderItem{Expr: expr}
+	if p.acceptKeyword("desc") {
+		item.Desc = true
+	} else {
+		p.acceptKeyword("asc")
+	}
+	// PostgreSQL sorts NULL above every value, so NULLs come first in descending order
+	item.NullsFirst = item.Desc
+	if p.acceptKeyword("nulls") {
+		switch {
+		case p.acceptKeyword("first"):
+			item.NullsFirst = true
+		case p.acceptKeyword("last"):
+			item.NullsFirst = false
+		default:
+			return orderItem{}, p.syntaxError()
+		}
+	}
+	return item, nil
+}
+
+// parseExpr parses an expression. Operator precedence follows PostgreSQL's, lowest first:
+// OR, AND, NOT, IS, comparison, LIKE/IN/BETWEEN, other operators (||, ~), + -, * / %,
+// unary minus, ::.
+func (p *sqlParser) parseExpr() (sqlExpr, error) {
+	return p.parseOr()
+}
+
+func (p *sqlParser) parseOr() (sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseAnd() (sqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseNot() (sqlExpr, error) {
+	if p.acceptKeyword("not") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{Op: "not", Operand: operand}, nil
+	}
+	return p.parseIs()
+}
+
+func (p *sqlParser) parseIs() (sqlExpr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("is") {
+		is := isExpr{Operand: left, Not: p.acceptKeyword("not")}
+		switch {
+		case p.acceptKeyword("null"):
+		case p.acceptKeyword("true"):
+			is.Value = true
+		case p.acceptKeyword("false"):
+			is.Value = false
+		default:
+			return nil, p.syntaxError()
+		}
+		left = is
+	}
+	return left, nil
+}
+
+var comparisonOperators = map[string]bool{"=": true, "<>": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true}
+
+func (p *sqlParser) parseComparison() (sqlExpr, error) {
+	left, err := p.parsePredicate()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokSymbol && comparisonOperators[t.text] {
+		p.i++
+		right, err := p.parsePredicate()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "!=" {
+			op = "<>"
+		}
+		return binaryExpr{Op: op, Left: left, Right: right, pos: t.pos}, nil
+	}
+	return left, nil
+}
+
+// parsePredicate parses LIKE, ILIKE, IN and BETWEEN, each optionally negated with NOT.
+func (p *sqlParser) parsePredicate() (sqlExpr, error) {
+	left, err := p.parseOther()
+	if err != nil {
+		return nil, err
+	}
+	not := false
+	if p.isKeyword("not") && p.i+1 < len(p.tokens) {
+		switch p.tokens[p.i+1].text {
+		case "like", "ilike", "in", "between":
+			p.i++
+			not = true
+		}
+	}
+	switch {
+	case p.isKeyword("like") || p.isKeyword("ilike"):
+		insensitive := p.next().text == "ilike"
+		pattern, err := p.parseOther()
+		if err != nil {
+			return nil, err
+		}
+		return likeExpr{Operand: left, Pattern: pattern, Not: not, Insensitive: insensitive}, nil
+	case p.acceptKeyword("in"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		if p.isKeyword("select") {
+			return nil, p.notSupported("a subquery")
+		}
+		in := inExpr{Operand: left, Not: not}
+		for {
+			item, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			in.List = append(in.List, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		return in, p.expectSymbol(")")
+	case p.acceptKeyword("between"):
+		low, err := p.parseOther()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseOther()
+		if err != nil {
+			return nil, err
+		}
+		return betweenExpr{Operand: left, Low: low, High: high, Not: not}, nil
+	}
+	return left, nil
+}
+
+// parseOther parses the operators PostgreSQL groups as "any other operator".
+func (p *sqlParser) parseOther() (sqlExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokSymbol || (t.text != "||" && t.text != "~" && t.text != "~*" && t.text != "!~") {
+			return left, nil
+		}
+		p.i++
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: t.text, Left: left, Right: right, pos: t.pos}
+	}
+}
+
+func (p *sqlParser) parseAdditive() (sqlExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("+") || p.isSymbol("-") {
+		t := p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: t.text, Left: left, Right: right, pos: t.pos}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseMultiplicative() (sqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("*") || p.isSymbol("/") || p.isSymbol("%") {
+		t := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: t.text, Left: left, Right: right, pos: t.pos}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseUnary() (sqlExpr, error) {
+	if p.acceptSymbol("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{Op: "-", Operand: operand}, nil
+	}
+	if p.acceptSymbol("+") {
+		return p.parseUnary()
+	}
+	return p.parseCast()
+}
+
+func (p *sqlParser) parseCast() (sqlExpr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptSymbol("::") {
+		typ, err := p.parseTypeName()
+		if err != nil {
+			return nil, err
+		}
+		expr = castExpr{Operand: expr, Type: typ}
+	}
+	return expr, nil
+}
+
+// castTypes maps the type names a value can be cast to onto their OIDs.
+var castTypes = map[string]uint32{
+	"text": oidText, "varchar": oidText, "name": oidText, "char": oidText, "bpchar": oidText,
+	"int": oidInt4, "integer": oidInt4, "int4": oidInt4, "smallint": oidInt4, "int2": oidInt4,
+	"bigint": oidInt8, "int8": oidInt8,
+	"numeric": oidNumeric, "decimal": oidNumeric, "real": oidNumeric, "float": oidNumeric, "float4": oidNumeric, "float8": oidNumeric,
+	"bool": oidBool, "boolean": oidBool,
+	"timestamptz": oidTimestamptz, "timestamp": oidTimestamptz,
+}
+
+func (p *sqlParser) parseTypeName() (uint32, error) {
+	pos := p.peek().pos
+	name, ok := p.identifier()
+	if !ok {
+		return 0, p.syntaxError()
+	}
+	if name == "pg_catalog" && p.acceptSymbol(".") {
+		if name, ok = p.identifier(); !ok {
+			return 0, p.syntaxError()
+		}
+	}
+	// "double precision", "character varying", "timestamp with time zone"
+	switch {
+	case name == "double" && p.acceptKeyword("precision"):
+		name = "float8"
+	case name == "character":
+		p.acceptKeyword("varying")
+		name = "varchar"
+	}
+	if p.acceptSymbol("(") {
+		for !p.acceptSymbol(")") {
+			if p.next().kind == tokEOF {
+				return 0, p.syntaxError()
+			}
+		}
+	}
+	if name == "timestamp" && (p.acceptKeyword("with") || p.acceptKeyword("without")) {
+		if err := p.expectKeyword("time"); err != nil {
+			return 0, err
+		}
+		if err := p.expectKeyword("zone"); err != nil {
+			return 0, err
+		}
+	}
+	typ, ok := castTypes[name]
+	if !ok {
+		return 0, newSQLError("42704", pos, "type \"%s\" does not exist", name)
+	}
+	return typ, nil
+}
+
+// niladicFunctions are the SQL functions called without parentheses.
+var niladicFunctions = map[string]bool{
+	"current_user": true, "session_user": true, "user": true, "current_timestamp": true,
+	"current_schema": true, "current_catalog": true,
+}
+
+func (p *sqlParser) parsePrimary() (sqlExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.i++
+		if value, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			if value > 1<<31-1 {
+				return literalExpr{Value: value, Type: oidInt8}, nil
+			}
+			return literalExpr{Value: value, Type: oidInt4}, nil
+		}
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, newSQLError(sqlStateSyntaxError, t.pos, "trailing junk after numeric literal at or near \"%s\"", t.text)
+		}
+		return literalExpr{Value: value, Type: oidNumeric}, nil
+	case tokString:
+		p.i++
+		return literalExpr{Value: t.text, Type: oidUnknown}, nil
+	case tokParam:
+		p.i++
+		index, err := strconv.Atoi(t.text)
+		if err != nil || index < 1 {
+			return nil, newSQLError(sqlStateUndefinedParam, t.pos, "there is no parameter $%s", t.text)
+		}
+		return paramExpr{Index: index, pos: t.pos}, nil
+	case tokSymbol:
+		if p.acceptSymbol("(") {
+			if p.isKeyword("select") {
+				return nil, p.notSupported("a subquery")
+			}
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expectSymbol(")")
+		}
+		return nil, p.syntaxError()
+	case tokQuoted:
+		return p.parseNameExpr()
+	case tokIdent:
+		switch t.text {
+		case "null":
+			p.i++
+			return literalExpr{Type: oidUnknown}, nil
+		case "true", "false":
+			p.i++
+			return literalExpr{Value: t.text == "true", Type: oidBool}, nil
+		case "case":
+			p.i++
+			return p.parseCase()
+		case "exists":
+			return nil, p.notSupported("a subquery")
+		}
+		if reservedWords[t.text] {
+			return nil, p.syntaxError()
+		}
+		return p.parseNameExpr()
+	}
+	return nil, p.syntaxError()
+}
+
+// parseNameExpr parses a column reference or function call, either of which may be qualified.
+func (p *sqlParser) parseNameExpr() (sqlExpr, error) {
+	first := p.next()
+	names := []string{first.text}
+	for p.acceptSymbol(".") {
+		name, ok := p.identifier()
+		if !ok {
+			return nil, p.syntaxError()
+		}
+		names = append(names, name)
+	}
+
+	if p.acceptSymbol("(") {
+		// Functions may be qualified with pg_catalog
+		if len(names) > 2 || (len(names) == 2 && names[0] != "pg_catalog") {
+			return nil, newSQLError(sqlStateUndefinedFunction, first.pos, "function %s() does not exist", strings.Join(names, "."))
+		}
+		call := funcExpr{Name: names[len(names)-1], pos: first.pos}
+		if p.acceptSymbol("*") {
+			call.Star = true
+			return call, p.expectSymbol(")")
+		}
+		if p.acceptSymbol(")") {
+			return call, nil
+		}
+		call.Distinct = p.acceptKeyword("distinct")
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		return call, p.expectSymbol(")")
+	}
+
+	if len(names) == 1 && first.kind == tokIdent && niladicFunctions[first.text] {
+		return funcExpr{Name: first.text, pos: first.pos}, nil
+	}
+	switch len(names) {
+	case 1:
+		return columnExpr{Name: names[0], pos: first.pos}, nil
+	case 2:
+		return columnExpr{Qualifier: names[0], Name: names[1], pos: first.pos}, nil
+	default:
+		return nil, newSQLError(sqlStateNotSupported, first.pos, "cross-database references are not implemented: %s", strings.Join(names, "."))
+	}
+}
+
+func (p *sqlParser) parseCase() (sqlExpr, error) {
+	expr := caseExpr{}
+	if !p.isKeyword("when") {
+		operand, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		expr.Operand = operand
+	}
+	for p.acceptKeyword("when") {
+		when, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("then"); err != nil {
+			return nil, err
+		}
+		then, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		expr.Whens = append(expr.Whens, caseWhen{When: when, Then: then})
+	}
+	if len(expr.Whens) == 0 {
+		return nil, p.syntaxError()
+	}
+	if p.acceptKeyword("else") {
+		elseExpr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		expr.Else = elseExpr
+	}
+	return expr, p.expectKeyword("end")
+}
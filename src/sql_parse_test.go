@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLexSQL(t *testing.T) {
+	type lexed struct {
+		kind tokenKind
+		text string
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []lexed
+	}{
+		{
+			name:  "keywords are lower-cased",
+			query: "SELECT Name FROM inventory",
+			want:  []lexed{{tokIdent, "select"}, {tokIdent, "name"}, {tokIdent, "from"}, {tokIdent, "inventory"}},
+		},
+		{
+			name:  "quoted identifiers keep their case",
+			query: `"Name"`,
+			want:  []lexed{{tokQuoted, "Name"}},
+		},
+		{
+			name:  "doubled quotes",
+			query: `'it''s' "a""b"`,
+			want:  []lexed{{tokString, "it's"}, {tokQuoted, `a"b`}},
+		},
+		{
+			name:  "escape strings",
+			query: `E'a\nb\'c'`,
+			want:  []lexed{{tokString, "a\nb'c"}},
+		},
+		{
+			name:  "numbers",
+			query: "1 2.5 .5 1e3 1.5E-2",
+			want:  []lexed{{tokNumber, "1"}, {tokNumber, "2.5"}, {tokNumber, ".5"}, {tokNumber, "1e3"}, {tokNumber, "1.5E-2"}},
+		},
+		{
+			name:  "parameters",
+			query: "$1 + $12",
+			want:  []lexed{{tokParam, "1"}, {tokSymbol, "+"}, {tokParam, "12"}},
+		},
+		{
+			name:  "two-character symbols",
+			query: "a<=b<>c||d::text!=e",
+			want: []lexed{
+				{tokIdent, "a"}, {tokSymbol, "<="}, {tokIdent, "b"}, {tokSymbol, "<>"}, {tokIdent, "c"},
+				{tokSymbol, "||"}, {tokIdent, "d"}, {tokSymbol, "::"}, {tokIdent, "text"}, {tokSymbol, "!="}, {tokIdent, "e"},
+			},
+		},
+		{
+			name:  "comments are dropped",
+			query: "a -- line\n/* block */ b",
+			want:  []lexed{{tokIdent, "a"}, {tokIdent, "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := lexSQL(tt.query)
+			if err != nil {
+				t.Fatalf("lexSQL(%q) failed: %v", tt.query, err)
+			}
+			if last := tokens[len(tokens)-1]; last.kind != tokEOF {
+				t.Fatalf("lexSQL(%q) doesn't end with EOF: %+v", tt.query, last)
+			}
+			var got []lexed
+			for _, tok := range tokens[:len(tokens)-1] {
+				got = append(got, lexed{tok.kind, tok.text})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lexSQL(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexSQLErrors(t *testing.T) {
+	tests := []struct {
+		query    string
+		message  string
+		position int
+	}{
+		{"select 'abc", `unterminated quoted string at or near "'abc"`, 8},
+		{`select "abc`, `unterminated quoted identifier at or near ""abc"`, 8},
+		{"select E'abc", `unterminated quoted string at or near "E'abc"`, 8},
+		{"select 1 /* never closed", `unterminated /* comment at or near "/* never closed"`, 10},
+		{"select 1 ? 2", `syntax error at or near "?"`, 10},
+		{"select a ! b", `syntax error at or near "!"`, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := lexSQL(tt.query)
+			var sqlErr *sqlError
+			if !errors.As(err, &sqlErr) {
+				t.Fatalf("lexSQL(%q) error = %v, want an sqlError", tt.query, err)
+			}
+			if sqlErr.Code != sqlStateSyntaxError || sqlErr.Message != tt.message || sqlErr.Position != tt.position {
+				t.Errorf("lexSQL(%q) error = %s %q at %d, want %s %q at %d",
+					tt.query, sqlErr.Code, sqlErr.Message, sqlErr.Position, sqlStateSyntaxError, tt.message, tt.position)
+			}
+		})
+	}
+}
+
+func TestParseSelect(t *testing.T) {
+	stmt, err := parseSelect("SELECT DISTINCT i.name AS item, count(*) FROM public.inventory i WHERE i.id > 1 ORDER BY 1 DESC NULLS FIRST LIMIT 5 OFFSET 2;")
+	if err != nil {
+		t.Fatalf("parseSelect failed: %v", err)
+	}
+	if !stmt.Distinct {
+		t.Error("DISTINCT wasn't parsed")
+	}
+	if len(stmt.Items) != 2 || stmt.Items[0].Alias != "item" {
+		t.Errorf("items = %+v, want two with the first aliased item", stmt.Items)
+	}
+	if column, ok := stmt.Items[0].Expr.(columnExpr); !ok || column.Qualifier != "i" || column.Name != "name" {
+		t.Errorf("first item = %#v, want column i.name", stmt.Items[0].Expr)
+	}
+	if stmt.From == nil || stmt.From.Schema != "public" || stmt.From.Name != "inventory" || stmt.From.Alias != "i" {
+		t.Errorf("FROM = %+v, want public.inventory aliased i", stmt.From)
+	}
+	if stmt.Where == nil {
+		t.Error("WHERE wasn't parsed")
+	}
+	if len(stmt.OrderBy) != 1 || !stmt.OrderBy[0].Desc || !stmt.OrderBy[0].NullsFirst {
+		t.Errorf("ORDER BY = %+v, want one DESC NULLS FIRST", stmt.OrderBy)
+	}
+	if stmt.Limit == nil || stmt.Offset == nil {
+		t.Error("LIMIT and OFFSET weren't parsed")
+	}
+}
+
+func TestParseSelectErrors(t *testing.T) {
+	tests := []struct {
+		query    string
+		code     string
+		position int
+	}{
+		{"select from", sqlStateSyntaxError, 8},
+		{"select 1 +", sqlStateSyntaxError, 11},
+		{"select (1", sqlStateSyntaxError, 10},
+		{"select 1 2", sqlStateSyntaxError, 10},
+		{"select * from inventory where", sqlStateSyntaxError, 30},
+		{"select 1; select 2", sqlStateSyntaxError, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := parseSelect(tt.query)
+			var sqlErr *sqlError
+			if !errors.As(err, &sqlErr) {
+				t.Fatalf("parseSelect(%q) error = %v, want an sqlError", tt.query, err)
+			}
+			if sqlErr.Code != tt.code || sqlErr.Position != tt.position {
+				t.Errorf("parseSelect(%q) error = %s %q at %d, want %s at %d",
+					tt.query, sqlErr.Code, sqlErr.Message, sqlErr.Position, tt.code, tt.position)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []queryStatement
+	}{
+		{"one statement", "look around", []queryStatement{{"look around", 0}}},
+		{"trailing semicolon", "look;", []queryStatement{{"look", 0}}},
+		{"offsets skip leading space", "look;  take key", []queryStatement{{"look", 0}, {"take key", 7}}},
+		{"empty statements are dropped", ";; look ;;", []queryStatement{{"look", 3}}},
+		{"semicolon in a string", "say 'a;b'; wave", []queryStatement{{"say 'a;b'", 0}, {"wave", 11}}},
+		{"semicolon in a quoted identifier", `select "a;b"; wave`, []queryStatement{{`select "a;b"`, 0}, {"wave", 14}}},
+		{"apostrophe inside a word", "take the captain's hat; go north", []queryStatement{{"take the captain's hat", 0}, {"go north", 24}}},
+		{"quote never closed", "it's; fine", []queryStatement{{"it's", 0}, {"fine", 6}}},
+		{"escape string", `select E'a\';b'; wave`, []queryStatement{{`select E'a\';b'`, 0}, {"wave", 17}}},
+		{"line comment", "look -- then; wave\n; go", []queryStatement{{"look -- then; wave", 0}, {"go", 21}}},
+		{"block comment", "look /* ; */; go", []queryStatement{{"look /* ; */", 0}, {"go", 14}}},
+		{"dollar quotes", "select $x$;$x$; go", []queryStatement{{"select $x$;$x$", 0}, {"go", 16}}},
+		{"offsets count runes", "dis le café; go", []queryStatement{{"dis le café", 0}, {"go", 13}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpensString(t *testing.T) {
+	tests := []struct {
+		text string
+		at   int
+		want bool
+	}{
+		{"'a'", 0, true},
+		{"say 'a'", 4, true},
+		{"(',')", 1, true},
+		{"captain's", 7, false},
+		{"E'a'", 1, true},
+		{"x'1f'", 1, true},
+		{"n'a'", 1, true},
+		{"see'", 3, false},
+		{"ne'", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := opensString([]rune(tt.text), tt.at); got != tt.want {
+				t.Errorf("opensString(%q, %d) = %v, want %v", tt.text, tt.at, got, tt.want)
+			}
+		})
+	}
+}
@@ -9,89 +9,243 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
-	"github.com/jackc/pgx/v5/pgproto3"
-	"log"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 )
 
-func GenerateSelfSignedCert() (*tls.Config, error) {
+// certReloadInterval bounds how often the certificate files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+// selfSignedRenewBefore is how long before it expires a self-signed certificate is
+// replaced.
+const selfSignedRenewBefore = 30 * 24 * time.Hour
+
+// tlsHandshakeTimeout bounds the TLS handshake, so a client that stalls in it doesn't
+// hold its connection open for ever.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// GenerateSelfSignedCert creates a PEM-encoded certificate and key valid for the given
+// DNS names and IP addresses.
+func GenerateSelfSignedCert(hosts []string) (certPEM, keyPEM []byte, err error) {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate private key: %w", err)
+		return nil, nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
 	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
 
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
-		Subject:      pkix.Name{CommonName: "localhost"},
-		NotBefore:    time.Now(),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
 		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
 		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create certificate: %w", err)
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 	privBytes, err := x509.MarshalECPrivateKey(priv)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode private key: %w", err)
+		return nil, nil, fmt.Errorf("failed to encode private key: %w", err)
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privBytes})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privBytes})
 
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create X509 key pair: %w", err)
+	return certPEM, keyPEM, nil
+}
+
+// certificateStore supplies the server certificate for TLS handshakes. It serves the
+// configured cert/key pair, reloading it when either file changes so renewed
+// certificates (e.g. from Let's Encrypt) are picked up without a restart.
+type certificateStore struct {
+	certFile string
+	keyFile  string
+	// selfSignedHosts are the names of the self-signed certificate, when no key pair
+	// is configured; it is replaced as it nears expiry.
+	selfSignedHosts []string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// newCertificateStore loads the configured certificate. Without one, it loads or creates
+// a self-signed certificate persisted under the self-signed directory, so every
+// connection (and every restart) presents the same certificate.
+func newCertificateStore(config *Config) (*certificateStore, error) {
+	store := &certificateStore{certFile: config.TLSCertFile, keyFile: config.TLSKeyFile}
+	if store.certFile == "" || store.keyFile == "" {
+		store.certFile = filepath.Join(config.TLSSelfSignedDir, "server.crt")
+		store.keyFile = filepath.Join(config.TLSSelfSignedDir, "server.key")
+		store.selfSignedHosts = tlsHostnames(config)
+	}
+	if err := store.reload(); err != nil {
+		return nil, err
 	}
+	return store, nil
+}
 
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-	return tlsConfig, nil
+// TLSConfig returns a server config that resolves the certificate per handshake.
+func (store *certificateStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.getCertificate,
+	}
 }
 
-func handleSSLRequest(conn net.Conn) (*tls.Conn, error) {
-	_, err := conn.Write([]byte("S"))
+func (store *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.mu.RLock()
+	cert, stale := store.cert, time.Since(store.checkedAt) > certReloadInterval
+	store.mu.RUnlock()
+
+	if stale {
+		if err := store.reload(); err != nil {
+			// Keep serving the previous certificate until the files are fixed
+			fmt.Printf("Error reloading TLS certificate: %v\n", err)
+		}
+		store.mu.RLock()
+		cert = store.cert
+		store.mu.RUnlock()
+	}
+	return cert, nil
+}
+
+// reload re-reads the key pair if either file was modified since the last load,
+// first replacing a self-signed certificate that is missing or nearing expiry.
+func (store *certificateStore) reload() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.checkedAt = time.Now()
+
+	if store.selfSignedHosts != nil && (store.cert == nil || time.Until(store.cert.Leaf.NotAfter) < selfSignedRenewBefore) {
+		if err := ensureSelfSignedCert(store.certFile, store.keyFile, store.selfSignedHosts); err != nil {
+			return err
+		}
+	}
+
+	modTime, err := latestModTime(store.certFile, store.keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write SSLResponse: %w", err)
+		return err
+	}
+	if store.cert != nil && !modTime.After(store.modTime) {
+		return nil
 	}
 
-	// Generate a self-signed cert
-	tlsConfig, err := GenerateSelfSignedCert()
+	cert, err := tls.LoadX509KeyPair(store.certFile, store.keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		fmt.Printf("Warning: TLS certificate %s expired on %s\n", store.certFile, cert.Leaf.NotAfter.Format(time.DateOnly))
 	}
+	store.cert = &cert
+	store.modTime = modTime
+	fmt.Printf("Loaded TLS certificate from %s\n", store.certFile)
+	return nil
+}
 
-	tlsConn := tls.Server(conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		return nil, fmt.Errorf("failed TLS handshake: %w", err)
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
 	}
-	return tlsConn, nil
+	return latest, nil
 }
 
-func upgradeBackendToTls(backend pgproto3.Backend, client net.Conn) (*pgproto3.Backend, error) {
-	msg, err := backend.ReceiveStartupMessage()
+// ensureSelfSignedCert writes a self-signed key pair to certFile/keyFile unless a
+// still-valid one covering the same hosts is already there.
+func ensureSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > selfSignedRenewBefore && coversHosts(leaf, hosts) {
+			return nil
+		}
+	}
+
+	certPEM, keyPEM, err := GenerateSelfSignedCert(hosts)
 	if err != nil {
-		log.Printf("failed to receive startup message: %v", err)
-		return nil, err
+		return err
 	}
-	switch msg.(type) {
-	case *pgproto3.SSLRequest:
-		tlsConn, err := handleSSLRequest(client)
-		if err != nil {
-			return nil, fmt.Errorf("failed to handle SSL request: %w", err)
+	if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	fmt.Printf("Generated self-signed TLS certificate for %v at %s\n", hosts, certFile)
+	return nil
+}
+
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+				return false
+			}
+		} else if !slices.Contains(cert.DNSNames, host) {
+			return false
 		}
-		newBackend := pgproto3.NewBackend(tlsConn, tlsConn)
-		return newBackend, nil
-	default:
-		fmt.Printf("Received unexpected message: %T\n", msg)
-		return nil, fmt.Errorf("unsupported message type: %T", msg)
 	}
+	return true
+}
+
+// tlsHostnames lists the names the self-signed certificate is issued for: the
+// configured hostnames followed by the loopback names.
+func tlsHostnames(config *Config) []string {
+	var hosts []string
+	for _, host := range slices.Concat(config.TLSHostnames, []string{"localhost", "127.0.0.1", "::1"}) {
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func handleSSLRequest(conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	_, err := conn.Write([]byte("S"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write SSLResponse: %w", err)
+	}
+
+	tlsConn := tls.Server(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("failed TLS handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
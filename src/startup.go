@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// TLS modes, controlling how SSLRequest is answered.
+const (
+	tlsModeDisable = "disable" // answer 'N' and continue in plaintext
+	tlsModePrefer  = "prefer"  // answer 'S', but also accept plaintext startups
+	tlsModeRequire = "require" // answer 'S' and reject plaintext startups
+)
+
+// negotiateStartup reads startup packets until the client sends its StartupMessage,
+// answering SSLRequest and GSSENCRequest along the way. It returns the backend to use
+// for the rest of the session, which is wrapped in TLS if the client asked for it and
+// tlsConfig is non-nil (it is nil when TLS is disabled).
+// A nil StartupMessage with a nil error means the connection was a CancelRequest,
+// which has already been handled.
+func negotiateStartup(conn net.Conn, config *Config, tlsConfig *tls.Config) (*pgproto3.Backend, *pgproto3.StartupMessage, error) {
+	backend := pgproto3.NewBackend(conn, conn)
+	encrypted := false
+
+	for {
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to receive startup message: %w", err)
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.SSLRequest:
+			if encrypted {
+				return nil, nil, fmt.Errorf("duplicate SSLRequest on encrypted connection")
+			}
+			if tlsConfig == nil {
+				if _, err := conn.Write([]byte("N")); err != nil {
+					return nil, nil, fmt.Errorf("failed to write SSLResponse: %w", err)
+				}
+				continue
+			}
+			tlsConn, err := handleSSLRequest(conn, tlsConfig)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to handle SSL request: %w", err)
+			}
+			backend = pgproto3.NewBackend(tlsConn, tlsConn)
+			encrypted = true
+		case *pgproto3.GSSEncRequest:
+			// We have no Kerberos; 'N' tells the client to fall back to SSLRequest or plaintext.
+			if _, err := conn.Write([]byte("N")); err != nil {
+				return nil, nil, fmt.Errorf("failed to write GSSENC response: %w", err)
+			}
+		case *pgproto3.CancelRequest:
+			cancelTargets.cancel(m.ProcessID, m.SecretKey)
+			return nil, nil, nil
+		case *pgproto3.StartupMessage:
+			if config.TLSMode == tlsModeRequire && !encrypted {
+				backend.Send(&pgproto3.ErrorResponse{
+					Severity:            "FATAL",
+					SeverityUnlocalized: "FATAL",
+					Code:                "28000",
+					Message:             "SSL connection is required",
+					Hint:                "Connect with sslmode=require.",
+				})
+				if err := backend.Flush(); err != nil {
+					fmt.Printf("Error flushing psql backend: %v\n", err)
+				}
+				return nil, nil, fmt.Errorf("rejected plaintext startup from %s", conn.RemoteAddr())
+			}
+			return backend, m, nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported startup message type: %T", msg)
+		}
+	}
+}
+
+// cancelRegistry maps the BackendKeyData handed to each session to its engine, so a
+// CancelRequest arriving on a separate connection can interrupt a running query.
+type cancelRegistry struct {
+	mu      sync.Mutex
+	engines map[uint32]*Engine
+}
+
+var cancelTargets = &cancelRegistry{engines: make(map[uint32]*Engine)}
+
+// register assigns the engine a unique process ID and a random secret key.
+func (r *cancelRegistry) register(engine *Engine) error {
+	var buf [8]byte
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return fmt.Errorf("failed to generate backend key: %w", err)
+		}
+		processID := binary.BigEndian.Uint32(buf[:4]) & 0x7fffffff
+		if _, taken := r.engines[processID]; processID == 0 || taken {
+			continue
+		}
+		engine.processID = processID
+		engine.secretKey = binary.BigEndian.Uint32(buf[4:])
+		r.engines[processID] = engine
+		return nil
+	}
+}
+
+func (r *cancelRegistry) unregister(engine *Engine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.engines[engine.processID] == engine {
+		delete(r.engines, engine.processID)
+	}
+}
+
+func (r *cancelRegistry) cancel(processID, secretKey uint32) {
+	r.mu.Lock()
+	engine := r.engines[processID]
+	r.mu.Unlock()
+
+	var want, got [4]byte
+	if engine != nil {
+		binary.BigEndian.PutUint32(want[:], engine.secretKey)
+	}
+	binary.BigEndian.PutUint32(got[:], secretKey)
+	if engine == nil || subtle.ConstantTimeCompare(want[:], got[:]) != 1 {
+		fmt.Printf("Ignoring CancelRequest for unknown backend %d\n", processID)
+		return
+	}
+	fmt.Printf("Cancelling running query for backend %d\n", processID)
+	engine.cancelRunningQuery()
+}
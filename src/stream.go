@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxNarrationChunk is how much narrative is held back waiting for the end of a
+// sentence before it is sent anyway, broken at a word boundary.
+const maxNarrationChunk = 240
+
+// narrationWriter turns a stream of text deltas into whole sentences, so psql shows
+// one readable NOTICE per sentence rather than one per token.
+type narrationWriter struct {
+	emit    func(string)
+	pending string
+	written bool
+}
+
+func (w *narrationWriter) Write(text string) {
+	w.pending += text
+	for {
+		end := sentenceEnd(w.pending)
+		if end < 0 && len(w.pending) > maxNarrationChunk {
+			end = strings.LastIndexFunc(w.pending[:maxNarrationChunk], unicode.IsSpace)
+		}
+		if end <= 0 {
+			return
+		}
+		w.send(w.pending[:end])
+		w.pending = w.pending[end:]
+	}
+}
+
+// Flush sends whatever is left once the stream has ended.
+func (w *narrationWriter) Flush() {
+	w.send(w.pending)
+	w.pending = ""
+}
+
+func (w *narrationWriter) send(text string) {
+	if text = strings.TrimSpace(text); text != "" {
+		w.emit(text)
+		w.written = true
+	}
+}
+
+// sentenceEnd returns the index just past the first complete sentence or paragraph in
+// text, or -1 if there isn't one yet. A sentence is only complete once the whitespace
+// after its punctuation has arrived, so a delta ending in "3." isn't cut before "14".
+func sentenceEnd(text string) int {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\n':
+			return i + 1
+		case '.', '!', '?':
+			j := i + 1
+			for j < len(text) && strings.ContainsRune(`"')]*`, rune(text[j])) {
+				j++
+			}
+			if j < len(text) && unicode.IsSpace(rune(text[j])) {
+				return j
+			}
+		}
+	}
+	return -1
+}
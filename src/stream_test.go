@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNarrationWriter(t *testing.T) {
+	long := strings.Repeat("word ", 60)
+	tests := []struct {
+		name   string
+		deltas []string
+		want   []string
+	}{
+		{"one sentence", []string{"The door creaks open."}, []string{"The door creaks open."}},
+		{"split across deltas", []string{"The do", "or creaks", " open. A draught", " blows."}, []string{"The door creaks open.", "A draught blows."}},
+		{"each kind of ending", []string{"Run! Where? Here. "}, []string{"Run!", "Where?", "Here."}},
+		{"closing quotes stay with their sentence", []string{`"Halt!" he cries. (Quietly.) Done`}, []string{`"Halt!"`, "he cries.", "(Quietly.)", "Done"}},
+		{"number not cut at its point", []string{"It costs 3.", "14 gold. Pay"}, []string{"It costs 3.14 gold.", "Pay"}},
+		{"paragraphs", []string{"First line\nSecond line"}, []string{"First line", "Second line"}},
+		{"blank lines dropped", []string{"One.\n\n\nTwo."}, []string{"One.", "Two."}},
+		{"ellipsis", []string{"Wait... then go. "}, []string{"Wait...", "then go."}},
+		{"long text without an end is broken at a space", []string{long}, []string{strings.TrimSpace(strings.Repeat("word ", 48)), strings.TrimSpace(strings.Repeat("word ", 12))}},
+		{"nothing but space", []string{"  ", "\n "}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			w := &narrationWriter{emit: func(s string) { got = append(got, s) }}
+			for _, delta := range tt.deltas {
+				w.Write(delta)
+			}
+			w.Flush()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sentences = %q, want %q", got, tt.want)
+			}
+			if w.written != (len(tt.want) > 0) {
+				t.Errorf("written = %v, want %v", w.written, len(tt.want) > 0)
+			}
+		})
+	}
+}
+
+func TestTTSSentences(t *testing.T) {
+	got := ttsSentences("The innkeeper\nlooks  up. \"Welcome!\"")
+	want := []string{"The innkeeper", "looks up.", `"Welcome!"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ttsSentences = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// gameTool exposes one GameResponse field to the LLM as a tool. Calling the tool adds
+// one entry to that field, so the tool's input schema is generated from the field's
+// element type and can't drift from the structs applyGameUpdates reads.
+type gameTool struct {
+	Name        string
+	Description string
+	Field       string   // GameResponse field the tool call is decoded into
+	Required    []string // JSON properties the call must provide
+	Omit        []string // properties of the field's type the tool doesn't accept
+}
+
+var gameTools = []gameTool{
+	{Name: "add_item", Omit: []string{"id"}, Field: "ItemsToAdd", Required: []string{"name", "description"},
+		Description: "Create a new item in the world."},
+	{Name: "update_item", Field: "ItemsToUpdate", Required: []string{"id"},
+		Description: "Change an existing item's name, description or location. Omit fields that don't change."},
+	{Name: "remove_item", Field: "ItemsToRemove", Required: []string{"id"},
+		Description: "Destroy an item so it no longer exists anywhere."},
+	{Name: "add_to_inventory", Field: "ItemsToAddToInventory", Required: []string{"id"},
+		Description: "Put an item in the player's inventory when they take or receive it. For an item created with add_item this turn, use id 0."},
+	{Name: "remove_from_inventory", Field: "ItemsToRemoveFromInventory", Required: []string{"id"},
+		Description: "Take an item out of the player's inventory when they drop, use up or give it away."},
+	{Name: "add_npc", Omit: []string{"id"}, Field: "NpcsToAdd", Required: []string{"name", "description"},
+		Description: "Create a new non-player character."},
+	{Name: "update_npc", Field: "NpcsToUpdate", Required: []string{"id"},
+		Description: "Change an existing NPC's name, description or location. Omit fields that don't change."},
+	{Name: "remove_npc", Field: "NpcsToRemove", Required: []string{"id"},
+		Description: "Remove an NPC from the world."},
+	{Name: "record_interaction", Field: "NpcInteractions", Required: []string{"npc_id", "interaction"},
+		Description: "Record what happened between the player and an NPC (talking, helping, threatening, gifts...) so the NPC remembers it."},
+	{Name: "add_location", Omit: []string{"id"}, Field: "LocationsToAdd", Required: []string{"name", "description"},
+		Description: "Create a new location in the world."},
+	{Name: "update_location", Field: "LocationsToUpdate", Required: []string{"id"},
+		Description: "Change an existing location's name or description. Omit fields that don't change."},
+	{Name: "add_exit", Field: "ExitsToAdd", Required: []string{"direction"},
+		Description: "Connect two locations with a way the player can take, such as a door, path or staircase. Give to_location_id for an existing location, or to_location_name for one created this turn."},
+	{Name: "unlock_exit", Field: "ExitsToUnlock", Required: []string{"id"},
+		Description: "Unlock a locked exit, e.g. when the player picks the lock or is given the key."},
+	{Name: "reveal_exit", Field: "ExitsToReveal", Required: []string{"id"},
+		Description: "Reveal a hidden exit the player has discovered."},
+	{Name: "move_player", Field: "PlayerStateUpdates",
+		Description: "Move the player to another location. Give current_location_id for an existing location, or current_location_name for one created this turn."},
+}
+
+// scalarToolInputs names the single property used when a tool's field holds plain values
+// rather than structs, e.g. remove_item takes {"id": 3} for an entry in ItemsToRemove.
+var scalarToolInputs = map[reflect.Kind]string{
+	reflect.Int: "id",
+}
+
+// toolInputType returns the type a single call of the tool decodes into.
+func (tool gameTool) toolInputType() reflect.Type {
+	field, ok := reflect.TypeOf(GameResponse{}).FieldByName(tool.Field)
+	if !ok {
+		panic(fmt.Sprintf("tool %s refers to unknown GameResponse field %s", tool.Name, tool.Field))
+	}
+	switch field.Type.Kind() {
+	case reflect.Slice, reflect.Pointer:
+		return field.Type.Elem()
+	default:
+		return field.Type
+	}
+}
+
+// InputSchema builds the tool's JSON schema from the Go type it decodes into.
+func (tool gameTool) InputSchema() map[string]any {
+	inputType := tool.toolInputType()
+	var properties map[string]any
+	if name, ok := scalarToolInputs[inputType.Kind()]; ok {
+		properties = map[string]any{name: jsonSchemaFor(inputType, "")}
+	} else {
+		properties = jsonSchemaFor(inputType, "")["properties"].(map[string]any)
+	}
+	for _, property := range tool.Omit {
+		delete(properties, property)
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             append([]string{}, tool.Required...),
+		"additionalProperties": false,
+	}
+}
+
+// jsonSchemaFor describes a Go type as JSON schema, reading property names from `json`
+// tags and documentation from `description` and `enum` tags.
+func jsonSchemaFor(t reflect.Type, description string) map[string]any {
+	schema := map[string]any{}
+	if description != "" {
+		schema["description"] = description
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		schema["type"] = "integer"
+	case reflect.String:
+		schema["type"] = "string"
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = jsonSchemaFor(t.Elem(), "")
+	case reflect.Pointer:
+		return jsonSchemaFor(t.Elem(), description)
+	case reflect.Struct:
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			property := jsonSchemaFor(field.Type, field.Tag.Get("description"))
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property["enum"] = strings.Split(enum, ",")
+			}
+			properties[name] = property
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+	default:
+		panic(fmt.Sprintf("no JSON schema mapping for %s", t))
+	}
+	return schema
+}
+
+// applyToolCall validates one tool call and records it in response.
+func applyToolCall(response *GameResponse, name string, input json.RawMessage) error {
+	var tool *gameTool
+	for i := range gameTools {
+		if gameTools[i].Name == name {
+			tool = &gameTools[i]
+			break
+		}
+	}
+	if tool == nil {
+		return fmt.Errorf("unknown tool %q", name)
+	}
+
+	// Check required properties are present before decoding drops the distinction
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(input, &raw); err != nil {
+		return fmt.Errorf("tool %s: input is not an object: %w", name, err)
+	}
+	for _, property := range tool.Required {
+		if _, ok := raw[property]; !ok {
+			return fmt.Errorf("tool %s: missing required property %q", name, property)
+		}
+	}
+	for _, property := range tool.Omit {
+		if _, ok := raw[property]; ok {
+			return fmt.Errorf("tool %s: unexpected property %q", name, property)
+		}
+	}
+
+	inputType := tool.toolInputType()
+	value := reflect.New(inputType)
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.DisallowUnknownFields()
+	if property, ok := scalarToolInputs[inputType.Kind()]; ok {
+		wrapper := reflect.New(reflect.StructOf([]reflect.StructField{{
+			Name: "Value",
+			Type: inputType,
+			Tag:  reflect.StructTag(fmt.Sprintf(`json:"%s"`, property)),
+		}}))
+		if err := decoder.Decode(wrapper.Interface()); err != nil {
+			return fmt.Errorf("tool %s: invalid input: %w", name, err)
+		}
+		value.Elem().Set(wrapper.Elem().Field(0))
+	} else if err := decoder.Decode(value.Interface()); err != nil {
+		return fmt.Errorf("tool %s: invalid input: %w", name, err)
+	}
+
+	field := reflect.ValueOf(response).Elem().FieldByName(tool.Field)
+	switch field.Kind() {
+	case reflect.Slice:
+		field.Set(reflect.Append(field, value.Elem()))
+	case reflect.Pointer:
+		field.Set(value)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// SQLSTATE codes of transaction blocks.
+const (
+	sqlStateActiveTransaction   = "25001"
+	sqlStateNoActiveTransaction = "25P01"
+	sqlStateInFailedTransaction = "25P02"
+	sqlStateIdleInTransaction   = "25P03"
+)
+
+// errTransactionAborted answers everything but COMMIT and ROLLBACK once an action in a
+// transaction block has failed.
+var errTransactionAborted = &sqlError{
+	Code:    sqlStateInFailedTransaction,
+	Message: "current transaction is aborted, commands ignored until end of transaction block",
+	Hint:    "ROLLBACK to return to the world as it was before BEGIN.",
+}
+
+// errCommitFailed is returned when the actions of a transaction block can't be saved.
+var errCommitFailed = &sqlError{
+	Code:    sqlStateTransactionRollback,
+	Message: "your actions fizzled",
+	Detail:  "The world shimmers for a moment, and is as it was before BEGIN.",
+	Hint:    "Please try again.",
+}
+
+// transactionCommand matches BEGIN, START TRANSACTION, COMMIT, END, ROLLBACK and ABORT.
+// BEGIN's isolation options are accepted and ignored.
+var transactionCommand = regexp.MustCompile(`(?i)^\s*(?:(?:(begin)(?:\s+(?:work|transaction))?|(start)\s+transaction)` +
+	`(?:\s*,?\s*(?:isolation\s+level\s+(?:serializable|repeatable\s+read|read\s+committed|read\s+uncommitted)|read\s+(?:only|write)|(?:not\s+)?deferrable))*` +
+	`|(commit|end|rollback|abort)(?:\s+(?:work|transaction))?)\s*;?\s*$`)
+
+// gameDB is where the world is read and written: the pool, or the transaction block
+// the player opened with BEGIN.
+type gameDB interface {
+	dbQuerier
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// world returns where this session reads and writes the world. Inside a transaction
+// block, actions see the changes of the ones before them, and nobody else does until
+// COMMIT.
+func (engine *Engine) world() gameDB {
+	if engine.tx != nil {
+		return engine.tx
+	}
+	return engine.db
+}
+
+// inTurn runs fn in a transaction of its own, or a savepoint of the transaction block.
+// A turn waits no longer than DBLockTimeout for rows another player's block has
+// changed, then fizzles rather than hold up its player indefinitely.
+func (engine *Engine) inTurn(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, engine.world(), func(tx pgx.Tx) error {
+		lockTimeout := fmt.Sprintf("%dms", engine.config.DBLockTimeout.Milliseconds())
+		if _, err := tx.Exec(ctx, "SELECT set_config('lock_timeout', $1, true)", lockTimeout); err != nil {
+			return fmt.Errorf("failed to set lock timeout: %w", err)
+		}
+		return fn(tx)
+	})
+}
+
+// isTransactionCommand reports whether a query begins or ends a transaction block.
+func isTransactionCommand(query string) bool {
+	return transactionCommand.MatchString(query)
+}
+
+// checkTransaction refuses a query after an action in the transaction block has failed,
+// until the block is ended.
+func (engine *Engine) checkTransaction(query string) error {
+	if engine.txFailed && !isTransactionCommand(query) {
+		return errTransactionAborted
+	}
+	return nil
+}
+
+// runTransactionCommand runs a query isTransactionCommand accepts and returns its
+// command tag. BEGIN holds the player's actions in a transaction, so they can play out
+// "what if" and then keep the result with COMMIT or undo it with ROLLBACK. Once an
+// action in the block has failed, any other query is refused.
+func (engine *Engine) runTransactionCommand(query string) (string, error) {
+	if err := engine.checkTransaction(query); err != nil {
+		return "", err
+	}
+	match := transactionCommand.FindStringSubmatch(query)
+	command := strings.ToLower(match[1] + match[2] + match[3])
+	switch command {
+	case "begin", "start":
+		if engine.tx != nil {
+			engine.sendWarning(sqlStateActiveTransaction, "there is already a transaction in progress")
+			return "BEGIN", nil
+		}
+		tx, err := engine.db.Begin(context.Background())
+		if err != nil {
+			return "", fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		engine.tx = tx
+		return "BEGIN", nil
+	case "commit", "end":
+		if engine.tx == nil {
+			engine.sendWarning(sqlStateNoActiveTransaction, "there is no transaction in progress")
+			return "COMMIT", nil
+		}
+		if engine.txFailed {
+			engine.endTransaction()
+			return "ROLLBACK", nil
+		}
+		err := engine.tx.Commit(context.Background())
+		engine.tx = nil
+		clear(engine.portals)
+		if err != nil {
+			fmt.Printf("Error committing transaction for player %d: %v\n", engine.playerID, err)
+			return "", errCommitFailed
+		}
+		engine.compactMemoryInBackground()
+		return "COMMIT", nil
+	default:
+		if engine.tx == nil {
+			engine.sendWarning(sqlStateNoActiveTransaction, "there is no transaction in progress")
+			return "ROLLBACK", nil
+		}
+		engine.endTransaction()
+		return "ROLLBACK", nil
+	}
+}
+
+// endTransaction rolls back the open transaction block, if any, undoing every action
+// in it.
+func (engine *Engine) endTransaction() {
+	if engine.tx == nil {
+		return
+	}
+	if err := engine.tx.Rollback(context.Background()); err != nil {
+		fmt.Printf("Error rolling back transaction for player %d: %v\n", engine.playerID, err)
+	}
+	engine.tx = nil
+	engine.txFailed = false
+	clear(engine.portals)
+}
+
+// errIdleInTransaction ends a session whose transaction block sat idle too long.
+var errIdleInTransaction = errors.New("transaction block idle for too long")
+
+// waitIdle is called while the session waits for the client. A transaction block
+// holds a pooled connection and row locks, so one left open longer than TxIdleTimeout
+// is rolled back there and then, rather than when the client comes back.
+func (engine *Engine) waitIdle() {
+	if engine.tx == nil || engine.config.TxIdleTimeout <= 0 {
+		return
+	}
+	engine.txMu.Lock()
+	defer engine.txMu.Unlock()
+	engine.txIdle = true
+	engine.txIdleTimer = time.AfterFunc(engine.config.TxIdleTimeout, engine.expireTransaction)
+}
+
+// stopIdle is called when the client's next message arrives, and reports whether the
+// transaction block was rolled back while it waited.
+func (engine *Engine) stopIdle() bool {
+	engine.txMu.Lock()
+	defer engine.txMu.Unlock()
+	engine.txIdle = false
+	if engine.txIdleTimer != nil {
+		engine.txIdleTimer.Stop()
+		engine.txIdleTimer = nil
+	}
+	return engine.txExpired
+}
+
+// terminateIdle ends a session whose transaction block was rolled back while idle, as
+// PostgreSQL does, with FATAL 25P03.
+func (engine *Engine) terminateIdle() error {
+	engine.transport.Send(&pgproto3.ErrorResponse{
+		Severity:            "FATAL",
+		SeverityUnlocalized: "FATAL",
+		Code:                sqlStateIdleInTransaction,
+		Message:             "terminating connection due to idle-in-transaction timeout",
+		Detail:              "The world grew tired of waiting, and is as it was before BEGIN.",
+	})
+	if err := engine.transport.Flush(); err != nil {
+		fmt.Printf("Error flushing psql backend: %v\n", err)
+	}
+	return errIdleInTransaction
+}
+
+// expireTransaction rolls back a transaction block left idle, unless the client's next
+// message has arrived meanwhile.
+func (engine *Engine) expireTransaction() {
+	engine.txMu.Lock()
+	defer engine.txMu.Unlock()
+	if !engine.txIdle || engine.tx == nil {
+		return
+	}
+	fmt.Printf("Rolling back transaction of player %d, idle for %s\n", engine.playerID, engine.config.TxIdleTimeout)
+	engine.endTransaction()
+	engine.txExpired = true
+}
+
+// sendWarning sends a WARNING notice, as PostgreSQL does for a harmless mistake.
+func (engine *Engine) sendWarning(code, message string) {
+	engine.transport.Send(&pgproto3.NoticeResponse{
+		Severity:            "WARNING",
+		SeverityUnlocalized: "WARNING",
+		Code:                code,
+		Message:             message,
+	})
+}
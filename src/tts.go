@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Piper's synthesis settings. length_scale > 1 is slower speech; noise_scale slightly
+// below default gives less variation, for a more consistent delivery. They are part of
+// every cache key, so changing them doesn't serve audio spoken the old way.
+const (
+	ttsLengthScale = "0.9"
+	ttsNoiseScale  = "0.667"
+)
+
+// ttsService speaks text with piper. Text is spoken a sentence at a time, so the first
+// sentence can be sent while the rest are synthesised, and each sentence's audio is
+// cached on disk under the hash of what produced it, so narration spoken before, such
+// as a location's description, is sent straight away. No more than TTSWorkers piper
+// processes run at once; further requests wait their turn. Browsers may only call it
+// from the pages WSAllowedOrigins lists, as with /ws.
+type ttsService struct {
+	voices         map[string]string
+	defaultVoice   string
+	allowedOrigins []string
+	maxText        int
+	cacheDir       string
+	cacheMax       int64
+	workers        chan struct{}
+
+	// cacheMu guards cacheBytes, roughly how much the cache holds; pruning counts it
+	// afresh, as files may be removed behind the server's back.
+	cacheMu    sync.Mutex
+	cacheBytes int64
+}
+
+func newTTSService(config *Config) (*ttsService, error) {
+	if err := os.MkdirAll(config.TTSCacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create TTS cache directory: %w", err)
+	}
+	tts := &ttsService{
+		voices:         config.TTSVoices,
+		defaultVoice:   config.TTSDefaultVoice,
+		allowedOrigins: config.WSAllowedOrigins,
+		maxText:        config.TTSMaxTextBytes,
+		cacheDir:       config.TTSCacheDir,
+		cacheMax:       config.TTSCacheMaxBytes,
+		workers:        make(chan struct{}, config.TTSWorkers),
+	}
+	tts.cacheMu.Lock()
+	defer tts.cacheMu.Unlock()
+	tts.pruneCache()
+	return tts, nil
+}
+
+// allowCORS lets the page that made a request read the response, if it may; otherwise
+// it answers the request with 403 and reports false.
+func (tts *ttsService) allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+	if !originAllowed(tts.allowedOrigins, r) {
+		log.Printf("Refused TTS request from %s with origin %q", r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	return true
+}
+
+// handleTTS handles GET and POST requests to /tts, streaming the speech of the text as
+// one WAV. GET takes text and voice as query parameters, so an <audio> element can
+// play the speech as it arrives; POST takes them as JSON.
+func (tts *ttsService) handleTTS(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS preflight
+	if !tts.allowCORS(w, r) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	var req struct {
+		Text  string `json:"text"`
+		Voice string `json:"voice"`
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet:
+		req.Text = r.URL.Query().Get("text")
+		req.Voice = r.URL.Query().Get("voice")
+	case http.MethodPost:
+		// Room for the JSON around the text, and escapes within it
+		r.Body = http.MaxBytesReader(w, r.Body, int64(tts.maxText)*2+1024)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(req.Text) > tts.maxText {
+		http.Error(w, fmt.Sprintf("Text is longer than %d bytes", tts.maxText), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sentences := ttsSentences(req.Text)
+	if len(sentences) == 0 {
+		http.Error(w, "Text is required", http.StatusBadRequest)
+		return
+	}
+	if req.Voice == "" {
+		req.Voice = tts.defaultVoice
+	}
+	model, ok := tts.voices[req.Voice]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown voice %q", req.Voice), http.StatusBadRequest)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	started := false
+	for _, sentence := range sentences {
+		audio, err := tts.synthesize(r.Context(), model, sentence)
+		if err == nil {
+			var format, samples []byte
+			if format, samples, err = parseWAV(audio); err == nil {
+				if !started {
+					w.Header().Set("Content-Type", "audio/wav")
+					w.Write(streamingWAVHeader(format))
+					started = true
+				}
+				_, err = w.Write(samples)
+			}
+		}
+		if err != nil {
+			if r.Context().Err() != nil {
+				// The listener has gone, or stopped the playback
+				return
+			}
+			log.Printf("TTS error: %v", err)
+			if !started {
+				http.Error(w, "TTS generation failed", http.StatusInternalServerError)
+			}
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// handleVoices serves the names of the voices /tts can speak in, and the default one.
+func (tts *ttsService) handleVoices(w http.ResponseWriter, r *http.Request) {
+	if !tts.allowCORS(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"voices":  slices.Sorted(maps.Keys(tts.voices)),
+		"default": tts.defaultVoice,
+	})
+}
+
+// ttsSentences splits text into the sentences it is spoken in, each on one line: piper
+// reads stdin line by line and only speaks the first.
+func ttsSentences(text string) []string {
+	var sentences []string
+	writer := narrationWriter{emit: func(sentence string) {
+		sentences = append(sentences, strings.Join(strings.Fields(sentence), " "))
+	}}
+	writer.Write(text)
+	writer.Flush()
+	return sentences
+}
+
+// synthesize returns the WAV of one sentence spoken by a piper model, from the cache if
+// it has been spoken before.
+func (tts *ttsService) synthesize(ctx context.Context, model, sentence string) ([]byte, error) {
+	key := sha256.Sum256([]byte(strings.Join([]string{model, ttsLengthScale, ttsNoiseScale, sentence}, "\x00")))
+	path := filepath.Join(tts.cacheDir, hex.EncodeToString(key[:])+".wav")
+	if audio, err := os.ReadFile(path); err == nil {
+		// Pruning evicts the sentences heard least recently
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return audio, nil
+	}
+
+	select {
+	case tts.workers <- struct{}{}:
+		defer func() { <-tts.workers }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	cmd := exec.CommandContext(ctx, "piper",
+		"--model", model,
+		"--output_file", "-",
+		"--length_scale", ttsLengthScale,
+		"--noise_scale", ttsNoiseScale)
+	cmd.Stdin = strings.NewReader(sentence)
+	audio, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run piper: %w", err)
+	}
+
+	// Written aside and renamed into place, so a concurrent request never reads half a file
+	tmp, err := os.CreateTemp(tts.cacheDir, "*.tmp")
+	if err != nil {
+		log.Printf("Error caching TTS audio: %v", err)
+		return audio, nil
+	}
+	_, err = tmp.Write(audio)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		log.Printf("Error caching TTS audio: %v", err)
+		os.Remove(tmp.Name())
+		return audio, nil
+	}
+
+	tts.cacheMu.Lock()
+	defer tts.cacheMu.Unlock()
+	tts.cacheBytes += int64(len(audio))
+	if tts.cacheMax > 0 && tts.cacheBytes > tts.cacheMax {
+		tts.pruneCache()
+	}
+	return audio, nil
+}
+
+// pruneCache removes the sentences heard least recently until the cache is back under
+// nine tenths of TTSCacheMaxBytes, so it isn't pruned again with the next sentence.
+// cacheMu must be held.
+func (tts *ttsService) pruneCache() {
+	entries, err := os.ReadDir(tts.cacheDir)
+	if err != nil {
+		log.Printf("Error pruning TTS cache: %v", err)
+		return
+	}
+	var files []os.FileInfo
+	tts.cacheBytes = 0
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".wav" {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+			tts.cacheBytes += info.Size()
+		}
+	}
+	if tts.cacheMax == 0 || tts.cacheBytes <= tts.cacheMax {
+		return
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int { return a.ModTime().Compare(b.ModTime()) })
+	removed := 0
+	for _, file := range files {
+		if tts.cacheBytes <= tts.cacheMax/10*9 {
+			break
+		}
+		if err := os.Remove(filepath.Join(tts.cacheDir, file.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error pruning TTS cache: %v", err)
+			continue
+		}
+		tts.cacheBytes -= file.Size()
+		removed++
+	}
+	log.Printf("Pruned %d sentences from the TTS cache", removed)
+}
+
+// parseWAV returns the fmt chunk and the samples of a WAV. Piper writing to a pipe
+// can't go back to fill in the data chunk's size, so the samples are whatever follows
+// its header when the size doesn't fit.
+func parseWAV(audio []byte) (format, samples []byte, err error) {
+	if len(audio) < 12 || !bytes.Equal(audio[0:4], []byte("RIFF")) || !bytes.Equal(audio[8:12], []byte("WAVE")) {
+		return nil, nil, errors.New("not a WAV file")
+	}
+	for rest := audio[12:]; len(rest) >= 8; {
+		id, size := string(rest[0:4]), int(binary.LittleEndian.Uint32(rest[4:8]))
+		rest = rest[8:]
+		if id == "data" {
+			if format == nil {
+				return nil, nil, errors.New("WAV data comes before its format")
+			}
+			if size == 0 || size > len(rest) {
+				size = len(rest)
+			}
+			return format, rest[:size], nil
+		}
+		if size > len(rest) {
+			break
+		}
+		if id == "fmt " {
+			format = rest[:size]
+		}
+		// Chunks are padded to an even length
+		rest = rest[min(size+size%2, len(rest)):]
+	}
+	return nil, nil, errors.New("WAV file has no data")
+}
+
+// streamingWAVHeader starts a WAV of the given format whose length isn't known yet, as
+// sentences are still being spoken; players read it to the end of the response.
+func streamingWAVHeader(format []byte) []byte {
+	var header bytes.Buffer
+	header.WriteString("RIFF")
+	binary.Write(&header, binary.LittleEndian, uint32(0xFFFFFFFF))
+	header.WriteString("WAVEfmt ")
+	binary.Write(&header, binary.LittleEndian, uint32(len(format)))
+	header.Write(format)
+	if len(format)%2 == 1 {
+		header.WriteByte(0)
+	}
+	header.WriteString("data")
+	binary.Write(&header, binary.LittleEndian, uint32(0xFFFFFFFF))
+	return header.Bytes()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// wavChunk encodes a RIFF chunk, with the size given rather than the data's length
+// when size isn't -1.
+func wavChunk(id string, size int, data []byte) []byte {
+	if size < 0 {
+		size = len(data)
+	}
+	chunk := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(size))...)
+	return append(chunk, data...)
+}
+
+func wavFile(chunks ...[]byte) []byte {
+	return append([]byte("RIFF\xff\xff\xff\xffWAVE"), bytes.Join(chunks, nil)...)
+}
+
+func TestParseWAV(t *testing.T) {
+	format := bytes.Repeat([]byte{1}, 16)
+	samples := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name    string
+		audio   []byte
+		format  []byte
+		samples []byte
+		err     string
+	}{
+		{"format then data", wavFile(wavChunk("fmt ", -1, format), wavChunk("data", -1, samples)), format, samples, ""},
+		{"data size unknown", wavFile(wavChunk("fmt ", -1, format), wavChunk("data", 0, samples)), format, samples, ""},
+		{"data size too large", wavFile(wavChunk("fmt ", -1, format), wavChunk("data", 0xFFFFFFFF, samples)), format, samples, ""},
+		{"data followed by another chunk", wavFile(wavChunk("fmt ", -1, format), wavChunk("data", 2, samples)), format, samples[:2], ""},
+		{"other chunks skipped", wavFile(wavChunk("LIST", -1, []byte("abcd")), wavChunk("fmt ", -1, format), wavChunk("data", -1, samples)), format, samples, ""},
+		{"odd chunks are padded", wavFile(wavChunk("LIST", 3, []byte("abc\x00")), wavChunk("fmt ", -1, format), wavChunk("data", -1, samples)), format, samples, ""},
+		{"not RIFF", append([]byte("RIFX\x00\x00\x00\x00WAVE"), wavChunk("data", -1, samples)...), nil, nil, "not a WAV file"},
+		{"not WAVE", append([]byte("RIFF\x00\x00\x00\x00AVI "), wavChunk("data", -1, samples)...), nil, nil, "not a WAV file"},
+		{"too short", []byte("RIFF"), nil, nil, "not a WAV file"},
+		{"data before format", wavFile(wavChunk("data", -1, samples), wavChunk("fmt ", -1, format)), nil, nil, "WAV data comes before its format"},
+		{"no data", wavFile(wavChunk("fmt ", -1, format)), nil, nil, "WAV file has no data"},
+		{"truncated chunk", wavFile(wavChunk("fmt ", 100, format)), nil, nil, "WAV file has no data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, samples, err := parseWAV(tt.audio)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("parseWAV error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseWAV failed: %v", err)
+			}
+			if !bytes.Equal(format, tt.format) || !bytes.Equal(samples, tt.samples) {
+				t.Errorf("parseWAV = %v, %v, want %v, %v", format, samples, tt.format, tt.samples)
+			}
+		})
+	}
+}
+
+func TestStreamingWAVHeader(t *testing.T) {
+	for _, format := range [][]byte{bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 17)} {
+		header := streamingWAVHeader(format)
+		parsed, samples, err := parseWAV(append(header, 9, 9))
+		if err != nil {
+			t.Fatalf("parseWAV of a streaming header failed: %v", err)
+		}
+		if !bytes.Equal(parsed, format) || !bytes.Equal(samples, []byte{9, 9}) {
+			t.Errorf("parseWAV of a streaming header = %v, %v, want %v, [9 9]", parsed, samples, format)
+		}
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir := t.TempDir()
+	heard := time.Now().Add(-time.Hour)
+	for i := range 10 {
+		path := filepath.Join(dir, fmt.Sprintf("%d.wav", i))
+		if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// Sentence 0 was heard last, the rest in order
+		at := heard.Add(time.Duration(i) * time.Minute)
+		if i == 0 {
+			at = heard.Add(time.Hour)
+		}
+		os.Chtimes(path, at, at)
+	}
+	os.WriteFile(filepath.Join(dir, "partial.tmp"), make([]byte, 1000), 0o644)
+
+	tts, err := newTTSService(&Config{TTSCacheDir: dir, TTSCacheMaxBytes: 500, TTSWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	slices.Sort(kept)
+	if want := []string{"0.wav", "7.wav", "8.wav", "9.wav", "partial.tmp"}; !slices.Equal(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	if tts.cacheBytes != 400 {
+		t.Errorf("cacheBytes = %d, want 400", tts.cacheBytes)
+	}
+}
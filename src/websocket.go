@@ -1,274 +1,436 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"os/exec"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgproto3"
 )
 
-var wsUpgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+// Keepalive: the server pings every wsPingPeriod, and a client that sends nothing, not
+// even a pong, for wsPongWait is taken for dead. A write that takes longer than
+// wsWriteWait fails likewise.
+const (
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsWriteWait  = 10 * time.Second
+)
+
+// wsOutboxSize is how many messages, besides a session's replay, may wait to be
+// written before a client is taken for too slow and disconnected. The engine never
+// waits for a client; one that reconnects is sent what it missed from the replay.
+const wsOutboxSize = 64
 
-// WSMessage is the JSON message format for WebSocket client ↔ game server.
-type WSMessage struct {
-	Type     string          `json:"type"`
-	Query    string          `json:"query,omitempty"`
-	Content  string          `json:"content,omitempty"`
-	Message  string          `json:"message,omitempty"`
-	Rows     [][]interface{} `json:"rows,omitempty"`
-	Columns  []string        `json:"columns,omitempty"`
-	RowCount int             `json:"rowCount,omitempty"`
+// errWSClientGone is enqueue's error for a connection that has ended or fallen behind.
+var errWSClientGone = errors.New("WebSocket connection has ended")
+
+// wsRequest is a query from the client, with the ID its answers carry.
+type wsRequest struct {
+	id    string
+	query string
 }
 
+// wsQueryState gathers the rows of the statement being answered.
 type wsQueryState struct {
-	columns []string
-	rows    [][]interface{}
-	query   string
+	wsRequest
+	columns []wsColumn
+	rows    [][]any
 }
 
-// connectToGameServer performs SSL handshake and startup against the local game server.
-func connectToGameServer(addr string) (*pgproto3.Frontend, net.Conn, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	sslReq := make([]byte, 8)
-	binary.BigEndian.PutUint32(sslReq[0:4], 8)
-	binary.BigEndian.PutUint32(sslReq[4:8], 80877103)
-	if _, err := conn.Write(sslReq); err != nil {
-		conn.Close()
-		return nil, nil, err
-	}
+// wsTransport is what the engine of a web client's session talks to: queries arrive
+// as simple queries, and what the engine sends is translated to the messages of
+// ws_protocol.go and handed to the session, which passes them on to the client.
+type wsTransport struct {
+	session *wsSession
+	pending []wsSessionMessage
+	query   *wsQueryState
+}
 
-	buf := make([]byte, 1)
-	if _, err := conn.Read(buf); err != nil || buf[0] != 'S' {
-		conn.Close()
-		return nil, nil, fmt.Errorf("server did not accept SSL: %v", err)
+func (transport *wsTransport) Receive() (pgproto3.FrontendMessage, error) {
+	request, ok := transport.session.next()
+	if !ok {
+		return nil, io.EOF
 	}
+	transport.query = &wsQueryState{wsRequest: request}
+	return &pgproto3.Query{String: request.query}, nil
+}
 
-	tlsConfig := &tls.Config{InsecureSkipVerify: true}
-	tlsConn := tls.Client(conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		conn.Close()
-		return nil, nil, fmt.Errorf("TLS handshake: %w", err)
+// Send translates a message for the client. Rows are gathered into one result per
+// statement, and ReadyForQuery ends the answer to the query.
+func (transport *wsTransport) Send(msg pgproto3.BackendMessage) {
+	current := transport.query
+	if current == nil {
+		// Nothing before the first query, such as the startup's ParameterStatus, concerns the client
+		return
 	}
-
-	frontend := pgproto3.NewFrontend(tlsConn, tlsConn)
-	frontend.Send(&pgproto3.StartupMessage{
-		ProtocolVersion: 196608,
-		Parameters:      map[string]string{"user": "postgres", "database": "postgres"},
-	})
-	if err := frontend.Flush(); err != nil {
-		tlsConn.Close()
-		return nil, nil, err
+	header := func(messageType string) wsHeader {
+		return wsHeader{Type: messageType, ID: current.id}
 	}
-
-	for {
-		msg, err := frontend.Receive()
-		if err != nil {
-			tlsConn.Close()
-			return nil, nil, err
+	switch m := msg.(type) {
+	case *pgproto3.RowDescription:
+		current.columns = make([]wsColumn, len(m.Fields))
+		for i, field := range m.Fields {
+			current.columns[i] = wsColumn{Name: string(field.Name), Type: shortTypeNames[field.DataTypeOID]}
 		}
-		switch msg.(type) {
-		case *pgproto3.ReadyForQuery:
-			return frontend, tlsConn, nil
-		case *pgproto3.ErrorResponse:
-			tlsConn.Close()
-			return nil, nil, fmt.Errorf("startup error from server")
-		default:
-			continue
+	case *pgproto3.DataRow:
+		row := make([]any, len(m.Values))
+		for i, val := range m.Values {
+			if val != nil {
+				row[i] = string(val)
+			}
 		}
+		current.rows = append(current.rows, row)
+	case *pgproto3.CommandComplete:
+		// Only statements that returned rows have a result; actions are told as narrative
+		if current.columns != nil {
+			transport.pending = append(transport.pending, &wsResultMessage{
+				wsHeader: header(wsResult),
+				Command:  string(m.CommandTag),
+				Columns:  current.columns,
+				Rows:     append([][]any{}, current.rows...),
+				RowCount: len(current.rows),
+			})
+		}
+		current.columns, current.rows = nil, nil
+	case *pgproto3.ErrorResponse:
+		transport.pending = append(transport.pending, &wsErrorMessage{wsHeader: header(wsError), Code: m.Code, Message: m.Message, Detail: m.Detail, Hint: m.Hint})
+	case *pgproto3.NoticeResponse:
+		switch {
+		case m.Severity != "":
+			transport.pending = append(transport.pending, &wsNoticeMessage{wsHeader: header(wsNotice), Severity: m.Severity, Code: m.Code, Message: m.Message})
+		case m.Message != "":
+			transport.pending = append(transport.pending, &wsNarrativeMessage{wsHeader: header(wsNarrative), Text: m.Message})
+		}
+	case *pgproto3.ReadyForQuery:
+		transport.pending = append(transport.pending, &wsDoneMessage{wsHeader: header(wsDone), TxStatus: string(m.TxStatus)})
+		transport.query = nil
 	}
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
+// PublishEvents sends what an action changed along with its narrative.
+func (transport *wsTransport) PublishEvents(events []GameEvent) {
+	if transport.query != nil {
+		transport.pending = append(transport.pending, &wsStateMessage{wsHeader: wsHeader{Type: wsState, ID: transport.query.id}, Changes: events})
 	}
-	defer conn.Close()
+}
 
-	log.Printf("New WebSocket connection from %s", r.RemoteAddr)
+// Flush hands what was sent to the session. It doesn't fail when the client has gone:
+// the session keeps the messages for it to collect when it reconnects.
+func (transport *wsTransport) Flush() error {
+	transport.session.send(transport.pending)
+	transport.pending = nil
+	return nil
+}
 
-	// Connect to our own game server on localhost
-	frontend, pgConn, err := connectToGameServer("127.0.0.1:5432")
-	if err != nil {
-		log.Printf("Failed to connect to game server: %v", err)
-		writeWSError(conn, fmt.Sprintf("Failed to connect to game server: %v", err))
-		return
-	}
-	defer pgConn.Close()
+func (transport *wsTransport) SetAuthType(uint32) error {
+	return errors.New("web client sessions don't authenticate")
+}
 
-	var currentQuery *wsQueryState
+// wsConn is one WebSocket a web client is connected by. One goroutine reads it and
+// another writes it, as gorilla allows no more than one of each; everything to write
+// goes through the outbox.
+type wsConn struct {
+	conn   *websocket.Conn
+	outbox chan any
+	// done is closed when the connection is to end, by close, closeWith or a failed
+	// write; written is closed once the writer has finished.
+	done     chan struct{}
+	doneOnce sync.Once
+	written  chan struct{}
+	// closing is the close frame the writer ends with.
+	closing []byte
+}
 
-	go func() {
-		for {
-			var msg WSMessage
-			if err := conn.ReadJSON(&msg); err != nil {
-				log.Printf("WebSocket read error: %v", err)
-				return
-			}
-			if msg.Type == "query" && msg.Query != "" {
-				currentQuery = &wsQueryState{
-					query:   msg.Query,
-					columns: []string{},
-					rows:    [][]interface{}{},
-				}
-				frontend.SendQuery(&pgproto3.Query{String: msg.Query})
-				if err := frontend.Flush(); err != nil {
-					log.Printf("Error sending query: %v", err)
-					writeWSError(conn, fmt.Sprintf("Error sending query: %v", err))
-					return
-				}
-			}
+// newWSConn starts the writer of a connection whose outbox can hold a replay of
+// replayMessages besides what else is waiting.
+func newWSConn(conn *websocket.Conn, replayMessages int) *wsConn {
+	client := &wsConn{
+		conn:    conn,
+		outbox:  make(chan any, replayMessages+1+wsOutboxSize),
+		done:    make(chan struct{}),
+		written: make(chan struct{}),
+		closing: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+	}
+	go client.writeMessages()
+	return client
+}
+
+// readMessages answers the client's hello, joining it to its session, and passes its
+// queries to the session, until the WebSocket closes or the client offers no version
+// we speak. The session is then left to wait for the client to reconnect.
+func (server *Server) readMessages(client *wsConn, remoteAddr net.Addr) {
+	conn := client.conn
+	conn.SetReadLimit(int64(server.config.WSMaxMessageBytes))
+	alive := func() { conn.SetReadDeadline(time.Now().Add(wsPongWait)) }
+	alive()
+	conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	limiter := newRateLimiter(server.config.WSQueriesPerMinute, server.config.WSQueryBurst)
+	var session *wsSession
+	defer func() {
+		if session != nil {
+			session.detach(client)
 		}
 	}()
-
 	for {
-		msg, err := frontend.Receive()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Error receiving from game server: %v", err)
+			log.Printf("WebSocket read error: %v", err)
 			return
 		}
-		switch m := msg.(type) {
-		case *pgproto3.DataRow:
-			if currentQuery != nil {
-				row := make([]interface{}, len(m.Values))
-				for i, val := range m.Values {
-					if val == nil {
-						row[i] = nil
-					} else {
-						row[i] = string(val)
-					}
-				}
-				currentQuery.rows = append(currentQuery.rows, row)
+		alive()
+		var header wsHeader
+		if err := json.Unmarshal(data, &header); err != nil {
+			client.enqueue(protocolError("", "invalid message: %v", err))
+			continue
+		}
+		switch header.Type {
+		case wsHello, wsConnect:
+			if session != nil {
+				client.enqueue(protocolError(header.ID, "hello has already been answered"))
+				continue
 			}
-		case *pgproto3.RowDescription:
-			if currentQuery != nil {
-				columns := make([]string, len(m.Fields))
-				for i, field := range m.Fields {
-					columns[i] = string(field.Name)
+			hello := wsHelloMessage{Versions: []int{1}}
+			if header.Type == wsHello {
+				if err := json.Unmarshal(data, &hello); err != nil {
+					client.enqueue(protocolError(header.ID, "invalid hello: %v", err))
+					continue
 				}
-				currentQuery.columns = columns
 			}
-		case *pgproto3.CommandComplete:
-			if currentQuery != nil {
-				response := WSMessage{
-					Type:     "result",
-					Query:    currentQuery.query,
-					Columns:  currentQuery.columns,
-					Rows:     currentQuery.rows,
-					RowCount: len(currentQuery.rows),
-				}
-				if err := conn.WriteJSON(response); err != nil {
-					log.Printf("Error sending response: %v", err)
-					return
-				}
-				currentQuery = nil
+			version, ok := negotiateVersion(hello.Versions)
+			if !ok {
+				client.enqueue(protocolError(header.ID, "unsupported protocol versions %v; this server speaks %v", hello.Versions, wsProtocolVersions))
+				return
+			}
+			welcome := &wsWelcomeMessage{wsHeader: wsHeader{Type: wsWelcome, ID: header.ID}, Version: version}
+			session = server.joinSession(client, hello, welcome, remoteAddr)
+		case wsQuery:
+			if session == nil {
+				client.enqueue(protocolError(header.ID, "send hello before any query"))
+				continue
 			}
-		case *pgproto3.ErrorResponse:
-			errorMsg := m.Message
-			if errorMsg == "" {
-				errorMsg = m.Severity
+			var query wsQueryMessage
+			if err := json.Unmarshal(data, &query); err != nil {
+				client.enqueue(protocolError(header.ID, "invalid query: %v", err))
+				continue
 			}
-			writeWSError(conn, errorMsg)
-			currentQuery = nil
-		case *pgproto3.ReadyForQuery:
-			// ready for next query
-		case *pgproto3.NoticeResponse:
-			noticeMsg := m.Message
-			if noticeMsg == "" {
-				noticeMsg = m.Severity
+			if !limiter.allow(time.Now()) {
+				client.enqueue(wsErrorMessage{wsHeader: wsHeader{Type: wsError, ID: header.ID}, Code: sqlStateQuotaExceeded,
+					Message: "too many queries", Hint: "Wait a moment before sending more."})
+				continue
 			}
-			if noticeMsg != "" {
-				conn.WriteJSON(WSMessage{Type: "text", Content: noticeMsg})
+			// The engine may be busy with the last query for longer than a pong takes to
+			// arrive, and pongs are only read here; the deadline starts again once it
+			// takes this one
+			conn.SetReadDeadline(time.Time{})
+			if !session.submit(client, wsRequest{id: header.ID, query: query.Query}) {
+				return
 			}
-		case *pgproto3.CopyInResponse, *pgproto3.CopyOutResponse:
-			// no-op
+			alive()
 		default:
-			// ignore other backend messages
+			client.enqueue(protocolError(header.ID, "unknown message type %q", header.Type))
 		}
 	}
 }
 
-func writeWSError(conn *websocket.Conn, message string) {
-	conn.WriteJSON(WSMessage{Type: "error", Message: message})
+// writeMessages writes the outbox to the WebSocket and pings the client, until the
+// connection is to end. Whatever is still in the outbox then is written before the
+// close.
+func (client *wsConn) writeMessages() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		close(client.written)
+	}()
+	for {
+		select {
+		case msg := <-client.outbox:
+			if !client.write(websocket.TextMessage, msg) {
+				return
+			}
+		case <-ticker.C:
+			if !client.write(websocket.PingMessage, nil) {
+				return
+			}
+		case <-client.done:
+			for {
+				select {
+				case msg := <-client.outbox:
+					if !client.write(websocket.TextMessage, msg) {
+						return
+					}
+				default:
+					client.write(websocket.CloseMessage, client.closing)
+					return
+				}
+			}
+		}
+	}
 }
 
-// handleTTS handles POST requests to /tts, generating speech audio from text using espeak-ng.
-func handleTTS(w http.ResponseWriter, r *http.Request) {
-	// Handle CORS preflight
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// write writes one message, as JSON for a text message, and reports whether it could.
+// After a failed write the connection is closed, which stops the reader and detaches
+// the connection from its session.
+func (client *wsConn) write(messageType int, msg any) bool {
+	var data []byte
+	switch messageType {
+	case websocket.TextMessage:
+		var err error
+		if data, err = json.Marshal(msg); err != nil {
+			log.Printf("Error encoding WebSocket message: %v", err)
+			return true
+		}
+	case websocket.CloseMessage:
+		data = msg.([]byte)
+	}
+	client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := client.conn.WriteMessage(messageType, data); err != nil {
+		// Once the reader has answered the client's close, there is nothing more to say
+		if !errors.Is(err, websocket.ErrCloseSent) {
+			log.Printf("WebSocket write error: %v", err)
+		}
+		client.shutdown()
+		client.conn.Close()
+		return false
+	}
+	return true
+}
 
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
+// enqueue hands a message to the writer without waiting. A client whose outbox is full
+// is too slow to keep up, and is disconnected.
+func (client *wsConn) enqueue(msg any) error {
+	select {
+	case <-client.done:
+		return errWSClientGone
+	default:
+	}
+	select {
+	case client.outbox <- msg:
+		return nil
+	default:
+		log.Printf("Disconnecting WebSocket client %s, which has fallen behind", client.conn.RemoteAddr())
+		client.closeWith(websocket.CloseTryAgainLater, "client fell behind")
+		return errWSClientGone
 	}
+}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func (client *wsConn) shutdown() {
+	client.doneOnce.Do(func() { close(client.done) })
+}
+
+// closeWith ends the connection with the given close code and reason, once what is in
+// the outbox has been written.
+func (client *wsConn) closeWith(code int, reason string) {
+	client.doneOnce.Do(func() {
+		client.closing = websocket.FormatCloseMessage(code, reason)
+		close(client.done)
+	})
+}
+
+// close ends the connection, waiting for the writer to send what is left.
+func (client *wsConn) close() {
+	client.shutdown()
+	<-client.written
+}
+
+func protocolError(id, format string, a ...any) wsErrorMessage {
+	return wsErrorMessage{wsHeader: wsHeader{Type: wsError, ID: id}, Code: sqlStateProtocolViolation, Message: fmt.Sprintf(format, a...)}
+}
+
+// rateLimiter is a token bucket: burst queries at once, then perMinute a minute.
+type rateLimiter struct {
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute queries a minute; zero or less
+// allows any number.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	limiter := &rateLimiter{burst: float64(max(burst, 1)), last: time.Now()}
+	if perMinute > 0 {
+		limiter.interval = time.Minute / time.Duration(perMinute)
 	}
+	limiter.tokens = limiter.burst
+	return limiter
+}
 
-	var req struct {
-		Text string `json:"text"`
+func (limiter *rateLimiter) allow(now time.Time) bool {
+	if limiter.interval == 0 {
+		return true
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	limiter.tokens = min(limiter.burst, limiter.tokens+float64(now.Sub(limiter.last))/float64(limiter.interval))
+	limiter.last = now
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+// checkOrigin admits browsers on the pages WSAllowedOrigins lists ("*" for any), or on
+// the WebSocket's own host, and clients that send no Origin, which aren't browsers.
+func (server *Server) checkOrigin(r *http.Request) bool {
+	if originAllowed(server.config.WSAllowedOrigins, r) {
+		return true
 	}
+	log.Printf("Refused WebSocket connection from %s with origin %q", r.RemoteAddr, r.Header.Get("Origin"))
+	return false
+}
 
-	if req.Text == "" {
-		http.Error(w, "Text is required", http.StatusBadRequest)
-		return
+// originAllowed reports whether a request's Origin, if it has one, is one of allowed
+// or on the host the request was made to.
+func originAllowed(allowed []string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
 	}
+	for _, page := range allowed {
+		if page == "*" || strings.EqualFold(strings.TrimSuffix(page, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
 
-	// Piper reads stdin line-by-line and only speaks the first line by default.
-	// Normalize to a single line so the full message is spoken (replace newlines with space).
-	textForPiper := strings.ReplaceAll(req.Text, "\n", " ")
-	textForPiper = strings.TrimSpace(strings.Join(strings.Fields(textForPiper), " "))
-
-	// Run piper with the neural voice model.
-	// length_scale > 1 = slower speech (more gravitas); 1.35 gives a deliberate, weighty delivery.
-	// noise_scale slightly below default = less variation, more consistent gravitas (if supported).
-	cmd := exec.Command("piper",
-		"--model", "/opt/piper-voices/en_US-lessac-medium.onnx",
-		"--output_file", "-",
-		"--length_scale", "0.9",
-		"--noise_scale", "0.667")
-	cmd.Stdin = strings.NewReader(textForPiper)
-	output, err := cmd.Output()
+func (server *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: server.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("TTS error: %v", err)
-		http.Error(w, "TTS generation failed", http.StatusInternalServerError)
+		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
+	defer conn.Close()
+
+	log.Printf("New WebSocket connection from %s", r.RemoteAddr)
 
-	w.Header().Set("Content-Type", "audio/wav")
-	w.Write(output)
+	client := newWSConn(conn, server.config.WSReplayMessages)
+	defer client.close()
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	server.readMessages(client, remoteAddr)
 }
 
 // StartWebSocketServer starts the HTTP server that serves /ws and /tts on the given addr.
-func StartWebSocketServer(addr string) {
+func (server *Server) StartWebSocketServer(addr string) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", handleWebSocket)
-	mux.HandleFunc("/tts", handleTTS)
+	mux.HandleFunc("/ws", server.handleWebSocket)
+	mux.HandleFunc("/ws/schema", handleProtocolSchema)
+	mux.HandleFunc("/tts", server.tts.handleTTS)
+	mux.HandleFunc("/tts/voices", server.tts.handleVoices)
 	log.Printf("WebSocket server %s", addr)
 	if err := http.ListenAndServe(addr, mux); err != nil {
 		log.Printf("WebSocket server error: %v", err)
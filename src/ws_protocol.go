@@ -0,0 +1,155 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"slices"
+)
+
+// The WebSocket protocol is JSON messages with a "type". The client opens with hello,
+// offering the protocol versions it speaks, and the server answers welcome with the
+// one it chose. Each query then carries an ID of the client's choosing, which every
+// message answering it repeats, so queries can be pipelined. ws_protocol.schema.json
+// describes every message and is served at /ws/schema.
+//
+// welcome carries a session token. A client that reconnects offers it in its hello,
+// with the seq of the last message it got, to take up the same session and be sent
+// what it missed (see ws_session.go).
+
+// wsProtocolVersions are the protocol versions this server speaks.
+var wsProtocolVersions = []int{1}
+
+//go:embed ws_protocol.schema.json
+var wsProtocolSchema []byte
+
+// Client message types. connect is what clients sent before the protocol had versions;
+// it is taken as a hello offering version 1.
+const (
+	wsHello   = "hello"
+	wsConnect = "connect"
+	wsQuery   = "query"
+)
+
+// Server message types.
+const (
+	wsWelcome   = "welcome"
+	wsNarrative = "narrative"
+	wsNotice    = "notice"
+	wsState     = "state"
+	wsResult    = "result"
+	wsError     = "error"
+	wsDone      = "done"
+)
+
+// wsHeader starts every message: its type and, for a query and the messages answering
+// it, the query's ID. The messages a session sends are numbered by Seq, from 1.
+type wsHeader struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Seq  int64  `json:"seq,omitempty"`
+}
+
+func (header *wsHeader) sequence(seq int64) {
+	header.Seq = seq
+}
+
+// wsSessionMessage is a message the session sends, which is numbered and kept for
+// replay, as opposed to one only about the connection it is sent over.
+type wsSessionMessage interface {
+	sequence(seq int64)
+}
+
+// wsHelloMessage opens a connection. Session and LastSeq, when given, take up the
+// session of an earlier connection.
+type wsHelloMessage struct {
+	wsHeader
+	Versions []int  `json:"versions"`
+	Session  string `json:"session,omitempty"`
+	LastSeq  int64  `json:"lastSeq,omitempty"`
+}
+
+type wsQueryMessage struct {
+	wsHeader
+	Query string `json:"query"`
+}
+
+// wsWelcomeMessage answers hello. Session is the token to offer on reconnecting, and
+// Player the name the session plays as. Resumed is set when the hello's session was
+// taken up, and Missed when some of what was sent after LastSeq is no longer kept.
+type wsWelcomeMessage struct {
+	wsHeader
+	Version int    `json:"version"`
+	Session string `json:"session"`
+	Player  string `json:"player"`
+	Resumed bool   `json:"resumed"`
+	Missed  bool   `json:"missed,omitempty"`
+}
+
+// wsNarrativeMessage is a piece of the dungeon master's narrative, streamed a sentence
+// or paragraph at a time until the query is done.
+type wsNarrativeMessage struct {
+	wsHeader
+	Text string `json:"text"`
+}
+
+// wsNoticeMessage is a warning about a query that still succeeded, such as COMMIT
+// outside a transaction.
+type wsNoticeMessage struct {
+	wsHeader
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// wsStateMessage lists what an action changed in the player's world.
+type wsStateMessage struct {
+	wsHeader
+	Changes []GameEvent `json:"changes"`
+}
+
+type wsColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// wsResultMessage is the rows one SELECT returned, as text or null.
+type wsResultMessage struct {
+	wsHeader
+	Command  string     `json:"command"`
+	Columns  []wsColumn `json:"columns"`
+	Rows     [][]any    `json:"rows"`
+	RowCount int        `json:"rowCount"`
+}
+
+// wsErrorMessage reports a failed query, with its SQLSTATE, or a message the server
+// couldn't accept (08P01).
+type wsErrorMessage struct {
+	wsHeader
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// wsDoneMessage ends the answer to a query. TxStatus is ReadyForQuery's: I, T or E.
+type wsDoneMessage struct {
+	wsHeader
+	TxStatus string `json:"txStatus"`
+}
+
+// negotiateVersion picks the newest version both sides speak.
+func negotiateVersion(offered []int) (int, bool) {
+	for _, version := range slices.Backward(wsProtocolVersions) {
+		if slices.Contains(offered, version) {
+			return version, true
+		}
+	}
+	return 0, false
+}
+
+// handleProtocolSchema serves the JSON Schema of the WebSocket protocol.
+func handleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(wsProtocolSchema)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A web client's session outlives its WebSocket. The engine plays on while the client
+// is away, and what it sends is kept, numbered, in a replay buffer, so a browser that
+// reloads or a phone that loses signal can reconnect, offer the token welcome gave it,
+// and be sent what it missed. A session nobody reconnects to within WSSessionGrace
+// ends; its token still names the player, so the next connection to offer it plays on
+// as them in a new session.
+
+// wsSessionTokenLifetime is how long a session token names its player.
+const wsSessionTokenLifetime = 30 * 24 * time.Hour
+
+// wsCloseSessionTaken closes a connection whose session another connection has taken
+// up, such as an older tab's. Clients shouldn't reconnect after it.
+const wsCloseSessionTaken = 4000
+
+// wsSessionClaims are what a session token vouches for.
+type wsSessionClaims struct {
+	Session string `json:"sid"`
+	Player  string `json:"player"`
+	Expires int64  `json:"exp"`
+}
+
+// wsSessions keeps the sessions of web clients, and signs and checks their tokens.
+type wsSessions struct {
+	secret []byte
+	mu     sync.Mutex
+	byID   map[string]*wsSession
+}
+
+func newWSSessions(config *Config) (*wsSessions, error) {
+	secret := []byte(config.WSSessionSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate session secret: %w", err)
+		}
+		log.Printf("WS_SESSION_SECRET isn't set; web session tokens won't outlive this server")
+	}
+	return &wsSessions{secret: secret, byID: map[string]*wsSession{}}, nil
+}
+
+// sign returns a token for the claims: their JSON and its HMAC-SHA256, each base64url.
+func (sessions *wsSessions) sign(claims wsSessionClaims) string {
+	payload, _ := json.Marshal(claims)
+	mac := hmac.New(sha256.New, sessions.secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the claims of a token this server signed and that hasn't expired.
+func (sessions *wsSessions) verify(token string, now time.Time) (*wsSessionClaims, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed session token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed session token: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed session token: %w", err)
+	}
+	mac := hmac.New(sha256.New, sessions.secret)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("session token signature doesn't match")
+	}
+	var claims wsSessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed session token: %w", err)
+	}
+	if now.Unix() > claims.Expires {
+		return nil, errors.New("session token has expired")
+	}
+	if claims.Player == "" {
+		return nil, errors.New("session token names no player")
+	}
+	return &claims, nil
+}
+
+func (sessions *wsSessions) lookup(id string) *wsSession {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	return sessions.byID[id]
+}
+
+func (sessions *wsSessions) add(session *wsSession) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sessions.byID[session.id] = session
+}
+
+func (sessions *wsSessions) remove(session *wsSession) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	if sessions.byID[session.id] == session {
+		delete(sessions.byID, session.id)
+	}
+}
+
+// wsReplayed is a message kept for a client that reconnects.
+type wsReplayed struct {
+	seq int64
+	msg wsSessionMessage
+}
+
+// wsReplayBuffer keeps a session's latest messages in a ring: once it is full, each
+// message overwrites the oldest, at head.
+type wsReplayBuffer struct {
+	entries  []wsReplayed
+	head     int
+	capacity int
+}
+
+func newWSReplayBuffer(capacity int) *wsReplayBuffer {
+	return &wsReplayBuffer{entries: make([]wsReplayed, 0, capacity), capacity: capacity}
+}
+
+func (replay *wsReplayBuffer) add(seq int64, msg wsSessionMessage) {
+	switch {
+	case replay.capacity == 0:
+	case len(replay.entries) < replay.capacity:
+		replay.entries = append(replay.entries, wsReplayed{seq: seq, msg: msg})
+	default:
+		replay.entries[replay.head] = wsReplayed{seq: seq, msg: msg}
+		replay.head = (replay.head + 1) % replay.capacity
+	}
+}
+
+// after returns the messages kept that were sent after seq, oldest first, and whether
+// any sent after it are no longer kept, given the number of the latest sent.
+func (replay *wsReplayBuffer) after(seq, latest int64) (msgs []wsSessionMessage, missed bool) {
+	if len(replay.entries) == 0 {
+		return nil, latest > seq
+	}
+	missed = replay.entries[replay.head].seq > seq+1
+	for i := range replay.entries {
+		entry := replay.entries[(replay.head+i)%len(replay.entries)]
+		if entry.seq > seq {
+			msgs = append(msgs, entry.msg)
+		}
+	}
+	return msgs, missed
+}
+
+// wsSession is a web client's session: the engine playing as its player, and the
+// connection, if any, the client is on now.
+type wsSession struct {
+	id       string
+	player   string
+	sessions *wsSessions
+	grace    time.Duration
+	// queries carries the client's queries to the engine; abandoned is closed when the
+	// session is to end, which ends the engine's Receive.
+	queries     chan wsRequest
+	abandoned   chan struct{}
+	abandonOnce sync.Once
+
+	// mu guards the rest, which the engine and the connections' readers share.
+	mu       sync.Mutex
+	client   *wsConn
+	seq      int64
+	replay   *wsReplayBuffer
+	expiry   *time.Timer
+	finished bool
+}
+
+// joinSession answers a client's hello: it takes up the session the hello's token
+// names, if it is still going, or else starts one, as the token's player or a new one.
+func (server *Server) joinSession(client *wsConn, hello wsHelloMessage, welcome *wsWelcomeMessage, remoteAddr net.Addr) *wsSession {
+	sessions := server.sessions
+	player := ""
+	if hello.Session != "" {
+		claims, err := sessions.verify(hello.Session, time.Now())
+		if err != nil {
+			log.Printf("Ignoring session token from %s: %v", remoteAddr, err)
+		} else {
+			if session := sessions.lookup(claims.Session); session != nil && session.player == claims.Player {
+				welcome.Resumed = true
+				if session.attach(client, welcome, hello.LastSeq) {
+					log.Printf("Web client %s resumed session of %q", remoteAddr, session.player)
+					return session
+				}
+				welcome.Resumed = false
+			}
+			player = claims.Player
+		}
+	}
+	if player == "" {
+		player = "web-" + randomHex(4)
+	}
+	session := &wsSession{
+		id:        randomHex(16),
+		player:    player,
+		sessions:  sessions,
+		grace:     server.config.WSSessionGrace,
+		queries:   make(chan wsRequest),
+		abandoned: make(chan struct{}),
+		replay:    newWSReplayBuffer(server.config.WSReplayMessages),
+	}
+	sessions.add(session)
+	session.attach(client, welcome, 0)
+	go session.run(server, remoteAddr)
+	return session
+}
+
+// run plays the session until it is abandoned or the engine fails.
+func (session *wsSession) run(server *Server, remoteAddr net.Addr) {
+	defer session.finish()
+	startupParams := map[string]string{"user": session.player, "database": "postgres", "application_name": "web-client"}
+	engine := NewEngine(&wsTransport{session: session}, server.db, server.narrator, server.config, startupParams, remoteAddr)
+	engine.trusted = true
+	defer engine.Close()
+	if err := engine.Run(); err != nil {
+		log.Printf("Error running web session of %q: %v", session.player, err)
+	}
+}
+
+// attach makes client the session's connection, after sending it welcome, with a fresh
+// token, and replaying what was sent after lastSeq. A connection already attached is
+// closed. It reports false if the session has finished.
+func (session *wsSession) attach(client *wsConn, welcome *wsWelcomeMessage, lastSeq int64) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.finished {
+		return false
+	}
+	if session.expiry != nil {
+		session.expiry.Stop()
+		session.expiry = nil
+	}
+	if session.client != nil {
+		session.client.closeWith(wsCloseSessionTaken, "session resumed elsewhere")
+	}
+	session.client = client
+
+	welcome.Player = session.player
+	welcome.Session = session.sessions.sign(wsSessionClaims{
+		Session: session.id,
+		Player:  session.player,
+		Expires: time.Now().Add(wsSessionTokenLifetime).Unix(),
+	})
+	replayed, missed := session.replay.after(min(max(lastSeq, 0), session.seq), session.seq)
+	welcome.Missed = missed
+	if client.enqueue(welcome) != nil {
+		return true
+	}
+	for _, msg := range replayed {
+		if client.enqueue(msg) != nil {
+			break
+		}
+	}
+	return true
+}
+
+// detach leaves the session without a connection if client is still its connection,
+// and ends it if no client reconnects within the grace period.
+func (session *wsSession) detach(client *wsConn) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.client != client || session.finished {
+		return
+	}
+	session.leave()
+}
+
+// leave leaves the session without a connection until a client reconnects, or the
+// grace period ends it. mu must be held.
+func (session *wsSession) leave() {
+	session.client = nil
+	session.expiry = time.AfterFunc(session.grace, session.expire)
+}
+
+func (session *wsSession) expire() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.client != nil || session.finished {
+		return
+	}
+	log.Printf("Web session of %q ended; nobody reconnected", session.player)
+	session.finished = true
+	session.sessions.remove(session)
+	session.abandon()
+}
+
+func (session *wsSession) abandon() {
+	session.abandonOnce.Do(func() { close(session.abandoned) })
+}
+
+// finish ends the session once its engine has, closing the client's connection.
+func (session *wsSession) finish() {
+	session.sessions.remove(session)
+	session.abandon()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.finished = true
+	if session.expiry != nil {
+		session.expiry.Stop()
+		session.expiry = nil
+	}
+	if session.client != nil {
+		session.client.shutdown()
+		session.client = nil
+	}
+}
+
+// next returns the next query for the engine, or false once the session is abandoned.
+func (session *wsSession) next() (wsRequest, bool) {
+	select {
+	case request := <-session.queries:
+		return request, true
+	case <-session.abandoned:
+		return wsRequest{}, false
+	}
+}
+
+// submit passes a query from client to the engine, waiting while it answers the one
+// before. It reports false if the connection or the session ends first.
+func (session *wsSession) submit(client *wsConn, request wsRequest) bool {
+	select {
+	case session.queries <- request:
+		return true
+	case <-client.done:
+		return false
+	case <-session.abandoned:
+		return false
+	}
+}
+
+// send numbers messages, keeps them for replay and passes them to the client, if it
+// is connected. It never waits for the client: one that has gone or fallen behind is
+// left, to be sent what it missed when it reconnects.
+func (session *wsSession) send(msgs []wsSessionMessage) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for _, msg := range msgs {
+		session.seq++
+		msg.sequence(session.seq)
+		session.replay.add(session.seq, msg)
+		if session.client != nil && session.client.enqueue(msg) != nil {
+			session.leave()
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
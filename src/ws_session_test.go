@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTokens(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	sessions := &wsSessions{secret: []byte("secret"), byID: map[string]*wsSession{}}
+	other := &wsSessions{secret: []byte("another secret"), byID: map[string]*wsSession{}}
+	valid := sessions.sign(wsSessionClaims{Session: "s1", Player: "web-1", Expires: now.Add(time.Hour).Unix()})
+	payload, signature, _ := strings.Cut(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sid":"s1","player":"innkeeper","exp":1800000000}`)) + "." + signature
+
+	tests := []struct {
+		name     string
+		sessions *wsSessions
+		token    string
+		at       time.Time
+		err      string
+	}{
+		{"valid", sessions, valid, now, ""},
+		{"valid until it expires", sessions, valid, now.Add(time.Hour), ""},
+		{"expired", sessions, valid, now.Add(time.Hour + time.Second), "session token has expired"},
+		{"signed by another server", other, valid, now, "session token signature doesn't match"},
+		{"payload changed", sessions, forged, now, "session token signature doesn't match"},
+		{"signature missing", sessions, payload, now, "malformed session token"},
+		{"not base64", sessions, "!!!." + signature, now, "malformed session token"},
+		{"no player", sessions, sessions.sign(wsSessionClaims{Session: "s1", Expires: now.Add(time.Hour).Unix()}), now, "session token names no player"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.sessions.verify(tt.token, tt.at)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("verify error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+			if claims.Session != "s1" || claims.Player != "web-1" {
+				t.Errorf("claims = %+v, want session s1 of web-1", claims)
+			}
+		})
+	}
+}
+
+func TestReplayBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		sent     int64
+		after    int64
+		want     []int64
+		missed   bool
+	}{
+		{"nothing sent", 4, 0, 0, nil, false},
+		{"all kept", 4, 3, 0, []int64{1, 2, 3}, false},
+		{"caught up", 4, 3, 3, nil, false},
+		{"some seen", 4, 3, 1, []int64{2, 3}, false},
+		{"full", 4, 4, 0, []int64{1, 2, 3, 4}, false},
+		{"wrapped, nothing lost", 4, 6, 2, []int64{3, 4, 5, 6}, false},
+		{"wrapped, some lost", 4, 6, 1, []int64{3, 4, 5, 6}, true},
+		{"wrapped, all seen", 4, 10, 10, nil, false},
+		{"wrapped twice", 4, 9, 0, []int64{6, 7, 8, 9}, true},
+		{"nothing kept", 0, 3, 1, nil, true},
+		{"nothing kept, caught up", 0, 3, 3, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replay := newWSReplayBuffer(tt.capacity)
+			for seq := int64(1); seq <= tt.sent; seq++ {
+				msg := &wsNarrativeMessage{}
+				msg.sequence(seq)
+				replay.add(seq, msg)
+			}
+			msgs, missed := replay.after(tt.after, tt.sent)
+			var got []int64
+			for _, msg := range msgs {
+				got = append(got, msg.(*wsNarrativeMessage).Seq)
+			}
+			if !reflect.DeepEqual(got, tt.want) || missed != tt.missed {
+				t.Errorf("after(%d) = %v, missed %v; want %v, missed %v", tt.after, got, missed, tt.want, tt.missed)
+			}
+		})
+	}
+}
+
+func TestSessionSendAndAttach(t *testing.T) {
+	session := &wsSession{
+		id:        "s1",
+		player:    "web-1",
+		sessions:  &wsSessions{secret: []byte("secret"), byID: map[string]*wsSession{}},
+		grace:     time.Hour,
+		abandoned: make(chan struct{}),
+		replay:    newWSReplayBuffer(3),
+	}
+	narrative := func(text string) wsSessionMessage {
+		return &wsNarrativeMessage{wsHeader: wsHeader{Type: wsNarrative}, Text: text}
+	}
+	session.send([]wsSessionMessage{narrative("one"), narrative("two")})
+	session.send([]wsSessionMessage{narrative("three"), narrative("four")})
+
+	tests := []struct {
+		lastSeq int64
+		want    []string
+		missed  bool
+	}{
+		{0, []string{"two", "three", "four"}, true},
+		{1, []string{"two", "three", "four"}, false},
+		{3, []string{"four"}, false},
+		{4, nil, false},
+		// A client can't have seen more than was sent
+		{9, nil, false},
+	}
+	for _, tt := range tests {
+		client := &wsConn{outbox: make(chan any, 10), done: make(chan struct{})}
+		welcome := &wsWelcomeMessage{}
+		if !session.attach(client, welcome, tt.lastSeq) {
+			t.Fatalf("attach after %d failed", tt.lastSeq)
+		}
+		if got := <-client.outbox; got != welcome {
+			t.Fatalf("first message after %d = %#v, want the welcome", tt.lastSeq, got)
+		}
+		if welcome.Missed != tt.missed || welcome.Player != "web-1" {
+			t.Errorf("welcome after %d = %+v, want missed %v for web-1", tt.lastSeq, welcome, tt.missed)
+		}
+		if _, err := session.sessions.verify(welcome.Session, time.Now()); err != nil {
+			t.Errorf("welcome after %d has an invalid token: %v", tt.lastSeq, err)
+		}
+		var got []string
+		for len(client.outbox) > 0 {
+			got = append(got, (<-client.outbox).(*wsNarrativeMessage).Text)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("replay after %d = %v, want %v", tt.lastSeq, got, tt.want)
+		}
+	}
+
+	// Sending on to the attached client numbers on from the replay
+	client := session.client
+	session.send([]wsSessionMessage{narrative("five")})
+	if msg := (<-client.outbox).(*wsNarrativeMessage); msg.Seq != 5 || msg.Text != "five" {
+		t.Errorf("sent %+v, want five numbered 5", msg)
+	}
+	session.finish()
+}
@@ -1,14 +1,37 @@
 import { useState, useEffect, useRef } from 'react'
 import './App.css'
 
+// WebSocket protocol versions this client speaks; see src/ws_protocol.schema.json
+const PROTOCOL_VERSIONS = [1]
+
+// Close code the server uses when another tab takes up this session
+const CLOSE_SESSION_TAKEN = 4000
+
+// The session token and the seq of the last message received are kept per tab, so a
+// reload takes up the same session and is sent what it missed
+const SESSION_KEY = 'session'
+const LAST_SEQ_KEY = 'lastSeq'
+
+// describeChange words one of the changes in a state message.
+const describeChange = (change) => {
+  switch (change.kind) {
+    case 'moved': return `You are now in ${change.name}`
+    case 'item_gained': return `Gained: ${change.name}`
+    case 'item_lost': return `Lost: ${change.name}`
+    case 'npc_attitude_changed': return `${change.name} is now ${change.attitude} towards you`
+    default: return change.kind
+  }
+}
+
 function App() {
   const [connected, setConnected] = useState(false)
   const [loading, setLoading] = useState(false)
   const [query, setQuery] = useState('')
-  const [chatTurns, setChatTurns] = useState([]) // { id, prompt, response: null | { type, ... } }
+  const [chatTurns, setChatTurns] = useState([]) // { id, requestId, prompt, response: null | { type, ... } }
   const [history, setHistory] = useState([])
   const [playingId, setPlayingId] = useState(null)
   const nextIdRef = useRef(0)
+  const nextRequestRef = useRef(0)
   const resultsContentRef = useRef(null)
   const wsRef = useRef(null)
   const queryInputRef = useRef(null)
@@ -40,8 +63,14 @@ function App() {
     ws.onopen = () => {
       console.log('Connected to game server')
       retryCountRef.current = 0
-      setConnected(true)
-      ws.send(JSON.stringify({ type: 'connect' }))
+      // The session starts once the server accepts one of our protocol versions
+      const hello = { type: 'hello', versions: PROTOCOL_VERSIONS }
+      const session = sessionStorage.getItem(SESSION_KEY)
+      if (session) {
+        hello.session = session
+        hello.lastSeq = Number(sessionStorage.getItem(LAST_SEQ_KEY)) || 0
+      }
+      ws.send(JSON.stringify(hello))
     }
     
     ws.onmessage = (event) => {
@@ -50,7 +79,7 @@ function App() {
         handleMessage(data)
       } catch (e) {
         setLoading(false)
-        appendResponseToLastTurn({ type: 'text', content: event.data })
+        appendResponse(null, { type: 'text', content: event.data })
       }
     }
     
@@ -58,14 +87,18 @@ function App() {
       console.error('WebSocket error:', error)
       setLoading(false)
       if (retryCountRef.current >= 2) {
-        appendResponseToLastTurn({ type: 'error', content: 'Connection error. Is the game server running on port 8080?' })
+        appendResponse(null, { type: 'error', content: 'Connection error. Is the game server running on port 8080?' })
       }
     }
     
-    ws.onclose = () => {
+    ws.onclose = (event) => {
       console.log('Disconnected from game server')
       setConnected(false)
       setLoading(false)
+      if (event.code === CLOSE_SESSION_TAKEN) {
+        appendResponse(null, { type: 'error', content: 'This game was resumed in another tab.', hint: 'Reload the page to play here instead.' })
+        return
+      }
       retryCountRef.current += 1
       setTimeout(() => {
         if (!wsRef.current || wsRef.current.readyState === WebSocket.CLOSED) {
@@ -78,30 +111,65 @@ function App() {
   }
 
   const handleMessage = (data) => {
-    setLoading(false)
-    if (data.type === 'result') {
-      appendResponseToLastTurn({
-        type: 'query',
-        query: data.query,
-        rows: data.rows,
-        columns: data.columns,
-        rowCount: data.rowCount,
-      })
-    } else if (data.type === 'error') {
-      appendResponseToLastTurn({ type: 'error', content: data.message })
-    } else if (data.type === 'text') {
-      appendResponseToLastTurn({ type: 'text', content: data.content })
+    if (data.seq) {
+      sessionStorage.setItem(LAST_SEQ_KEY, String(data.seq))
+    }
+    switch (data.type) {
+      case 'welcome':
+        sessionStorage.setItem(SESSION_KEY, data.session)
+        if (!data.resumed) {
+          // A new session numbers its messages from 1 again
+          sessionStorage.setItem(LAST_SEQ_KEY, '0')
+        }
+        if (data.missed) {
+          appendResponse(null, { type: 'notice', content: 'Some of what happened while you were away has been lost.' })
+        }
+        setConnected(true)
+        break
+      case 'done':
+        // The query is answered: stop merging streamed narrative into its last response
+        setLoading(false)
+        setChatTurns(prev => prev.map(turn => turn.requestId === data.id ? { ...turn, done: true } : turn))
+        break
+      case 'narrative':
+        appendResponse(data.id, { type: 'text', content: data.text })
+        break
+      case 'result':
+        appendResponse(data.id, {
+          type: 'query',
+          rows: data.rows,
+          columns: data.columns.map(column => column.name),
+          rowCount: data.rowCount,
+        })
+        break
+      case 'state':
+        appendResponse(data.id, { type: 'state', changes: data.changes })
+        break
+      case 'notice':
+        appendResponse(data.id, { type: 'notice', content: data.message })
+        break
+      case 'error':
+        setLoading(false)
+        appendResponse(data.id, { type: 'error', content: data.message, detail: data.detail, hint: data.hint })
+        break
     }
   }
 
-  const appendResponseToLastTurn = (response) => {
+  // appendResponse adds a response to the query with the given ID, or to the last
+  // one when there is no ID.
+  const appendResponse = (requestId, response) => {
     setChatTurns(prev => {
       const next = [...prev]
-      const last = next[next.length - 1]
+      let index = next.findLastIndex(turn => turn.requestId === requestId)
+      if (requestId == null || index < 0) index = next.length - 1
+      const last = next[index]
       if (last && last.response === null) {
-        next[next.length - 1] = { ...last, response }
+        next[index] = { ...last, response }
+      } else if (last && !last.done && response.type === 'text' && last.response.type === 'text') {
+        // Narrative streams in a sentence at a time; grow the response until the query is done
+        next[index] = { ...last, response: { ...response, content: `${last.response.content} ${response.content}` } }
       } else {
-        next.push({ id: nextIdRef.current++, prompt: null, response })
+        next.splice(index + 1, 0, { id: nextIdRef.current++, requestId: last?.requestId, prompt: null, response })
       }
       return next
     })
@@ -119,8 +187,9 @@ function App() {
     if (wsRef.current && wsRef.current.readyState === WebSocket.OPEN) {
       setLoading(true)
       setHistory(prev => [queryText, ...prev].filter((q, i, arr) => arr.indexOf(q) === i).slice(0, 50))
-      setChatTurns(prev => [...prev, { id: nextIdRef.current++, prompt: queryText, response: null }])
-      wsRef.current.send(JSON.stringify({ type: 'query', query: queryText }))
+      const requestId = `q${nextRequestRef.current++}`
+      setChatTurns(prev => [...prev, { id: nextIdRef.current++, requestId, prompt: queryText, response: null }])
+      wsRef.current.send(JSON.stringify({ type: 'query', id: requestId, query: queryText }))
       setQuery('')
       setTimeout(() => resultsContentRef.current?.scrollTo({ top: resultsContentRef.current.scrollHeight, behavior: 'smooth' }), 50)
     }
@@ -142,7 +211,11 @@ function App() {
 
     // Stop any currently playing audio
     if (audioRef.current) {
+      // Dropping the source also ends the download, so the server stops speaking
+      audioRef.current.onended = audioRef.current.onerror = null
       audioRef.current.pause()
+      audioRef.current.removeAttribute('src')
+      audioRef.current.load()
       audioRef.current = null
     }
 
@@ -160,30 +233,17 @@ function App() {
         ? `${window.location.protocol}//${host}/tts`
         : `${window.location.protocol}//${host}:8080/tts`
 
-      const response = await fetch(ttsUrl, {
-        method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ text })
-      })
-
-      if (!response.ok) {
-        throw new Error('TTS request failed')
-      }
-
-      const blob = await response.blob()
-      const url = URL.createObjectURL(blob)
-      const audio = new Audio(url)
+      // Played straight from the server, so the first sentence is heard while the rest are spoken
+      const audio = new Audio(`${ttsUrl}?${new URLSearchParams({ text })}`)
       audioRef.current = audio
 
       audio.onended = () => {
         setPlayingId(null)
-        URL.revokeObjectURL(url)
         audioRef.current = null
       }
 
       audio.onerror = () => {
         setPlayingId(null)
-        URL.revokeObjectURL(url)
         audioRef.current = null
       }
 
@@ -198,6 +258,8 @@ function App() {
     if (!response) return null
     if (response.type === 'text') return response.content ?? ''
     if (response.type === 'error') return response.content ?? ''
+    if (response.type === 'notice') return response.content ?? ''
+    if (response.type === 'state') return response.changes.map(describeChange).join('. ')
     if (response.type === 'query') {
       if (response.rows?.length > 0 && response.columns?.length > 0) {
         const header = response.columns.join(' | ')
@@ -244,10 +306,30 @@ function App() {
       return (
         <div className="chat-response chat-response--error">
           <div className="response-content">{response.content}</div>
+          {response.detail && <div className="response-detail">{response.detail}</div>}
+          {response.hint && <div className="response-hint">{response.hint}</div>}
           {speakerButton}
         </div>
       )
     }
+    if (response.type === 'notice') {
+      return (
+        <div className="chat-response chat-response--notice">
+          <div className="response-content">{response.content}</div>
+        </div>
+      )
+    }
+    if (response.type === 'state') {
+      return (
+        <div className="chat-response chat-response--state">
+          <ul className="state-changes">
+            {response.changes.map((change, i) => (
+              <li key={i} className={`state-change state-change--${change.kind}`}>{describeChange(change)}</li>
+            ))}
+          </ul>
+        </div>
+      )
+    }
     if (response.type === 'query') {
       if (response.rows && response.rows.length > 0) {
         return (